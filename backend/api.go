@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 100
+	// maxPublishBody bounds a POST /events body
+	maxPublishBody = 1 << 20
+)
+
+// historyResponse is the body returned by GET /events
+type historyResponse struct {
+	Events  []Event `json:"events"`
+	HasMore bool    `json:"has_more"`
+}
+
+// serveEvents handles publishing (POST) and history replay (GET) on /events
+func serveEvents(hub *EventHub, auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			handlePostEvent(hub, auth, w, r)
+		case http.MethodGet:
+			handleListEvents(hub, auth, w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func handlePostEvent(hub *EventHub, auth *authenticator, w http.ResponseWriter, r *http.Request) {
+	tenantID, err := auth.authenticate(r, scopePublish)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPublishBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	var reqs []eventRequest
+	kind := fingerprintEvent
+	switch cloudEventsMode(r) {
+	case "batch":
+		kind = fingerprintEvents
+		reqs, err = parseCloudEventBatch(body)
+	case "structured":
+		reqs, err = oneRequest(parseCloudEvent(body))
+	case "binary":
+		reqs, err = oneRequest(parseBinaryCloudEvent(r.Header, body))
+	default:
+		reqs, err = oneRequest(parseEventRequest(body))
+	}
+	if err != nil {
+		log.Printf("tenant %s: rejected event: %v", tenantID, err)
+		writePublishError(w, err)
+		return
+	}
+	publish := func() ([]Event, error) { return publishAll(hub, tenantID, reqs) }
+	var events []Event
+	if key := r.Header.Get(idempotencyHeader); key != "" {
+		if !validIdempotencyKey(key) {
+			writePublishError(w, errInvalidIdempotencyKey)
+			return
+		}
+		var replayed bool
+		events, replayed, err = hub.publishOnce(tenantID, key, publishFingerprint(kind, reqs), publish)
+		if replayed {
+			log.Printf("tenant %s: replayed publish for idempotency key %q", tenantID, key)
+			w.Header().Set(replayedHeader, "true")
+		}
+	} else {
+		events, err = publish()
+	}
+	if err != nil {
+		writePublishError(w, err)
+		return
+	}
+	if kind == fingerprintEvents {
+		writeJSON(w, http.StatusOK, events)
+		return
+	}
+	writeJSON(w, http.StatusOK, events[0])
+}
+
+func oneRequest(req eventRequest, err error) ([]eventRequest, error) {
+	if err != nil {
+		return nil, err
+	}
+	return []eventRequest{req}, nil
+}
+
+// publishError is a rejected publish, reported to HTTP clients as status
+// and to WebSocket clients as an error reply. violations lists schema
+// failures.
+type publishError struct {
+	status     int
+	msg        string
+	retryAfter time.Duration
+	violations []schemaViolation
+}
+
+// violationsResponse is the body of a publish rejected by a schema
+type violationsResponse struct {
+	Error      string            `json:"error"`
+	Violations []schemaViolation `json:"violations"`
+}
+
+func (e *publishError) Error() string { return e.msg }
+
+var (
+	errBadJSON     = &publishError{status: http.StatusBadRequest, msg: "bad json"}
+	errStoreFailed = &publishError{status: http.StatusInternalServerError, msg: "failed to store event"}
+	// errShuttingDown refuses publishes and connections during shutdown
+	errShuttingDown = &publishError{status: http.StatusServiceUnavailable, msg: "server shutting down"}
+)
+
+// parseEventRequest parses a native publish body
+func parseEventRequest(body []byte) (eventRequest, error) {
+	var req eventRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return req, errBadJSON
+	}
+	return req, nil
+}
+
+// publish parses a native publish body and posts it for tenantID. The
+// WebSocket publish op goes through here and POST /events through
+// publishAll, so both apply the same rules.
+func publish(hub *EventHub, tenantID string, body []byte) (Event, error) {
+	req, err := parseEventRequest(body)
+	if err != nil {
+		log.Printf("tenant %s: rejected event: %v", tenantID, err)
+		return Event{}, err
+	}
+	events, err := publishAll(hub, tenantID, []eventRequest{req})
+	if err != nil {
+		return Event{}, err
+	}
+	return events[0], nil
+}
+
+// publishAll validates every request, checks it against its type's
+// schema, takes them from the tenant's rate limit together and posts them
+// as one unit: nothing is posted unless all of them are valid, allowed
+// and stored.
+func publishAll(hub *EventHub, tenantID string, reqs []eventRequest) ([]Event, error) {
+	for i := range reqs {
+		if pe := checkRequest(hub, tenantID, &reqs[i]); pe != nil {
+			if len(reqs) > 1 {
+				pe = &publishError{status: pe.status, msg: fmt.Sprintf("event %d: %s", i, pe.msg), violations: pe.violations}
+			}
+			return nil, pe
+		}
+	}
+	return postChecked(hub, tenantID, reqs)
+}
+
+// checkRequest validates req and checks it against its type's schema
+func checkRequest(hub *EventHub, tenantID string, req *eventRequest) *publishError {
+	if err := req.validate(); err != nil {
+		return &publishError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := hub.checkSchema(tenantID, req); err != nil {
+		return err.(*publishError)
+	}
+	return nil
+}
+
+// postChecked posts requests that passed checkRequest, subject to the
+// tenant's rate limit. A batch larger than the limit's burst could never
+// be allowed and is refused with 413 instead of 429.
+func postChecked(hub *EventHub, tenantID string, reqs []eventRequest) ([]Event, error) {
+	if len(reqs) == 0 {
+		return []Event{}, nil
+	}
+	if !hub.beginPublish() {
+		return nil, errShuttingDown
+	}
+	defer hub.endPublish()
+	if burst := hub.publishBurst(tenantID); burst > 0 && len(reqs) > burst {
+		// waiting would not help; the batch must be split
+		return nil, &publishError{status: http.StatusRequestEntityTooLarge,
+			msg: fmt.Sprintf("batch of %d events exceeds the rate limit burst of %d", len(reqs), burst)}
+	}
+	if ok, wait := hub.allowPublish(tenantID, len(reqs)); !ok {
+		log.Printf("tenant %s: publish rate limited (%d rejected)", tenantID, hub.rateLimitedCount(tenantID))
+		return nil, &publishError{status: http.StatusTooManyRequests, msg: "rate limit exceeded", retryAfter: wait}
+	}
+	events := make([]Event, len(reqs))
+	for i := range reqs {
+		events[i] = reqs[i].event(tenantID)
+	}
+	events, err := hub.addEvents(tenantID, events)
+	if err != nil {
+		log.Printf("tenant %s: failed to store events: %v", tenantID, err)
+		return nil, errStoreFailed
+	}
+	for _, e := range events {
+		log.Printf("tenant %s: event posted: %s (took %s)", tenantID, e.Message, e.Elapsed)
+	}
+	return events, nil
+}
+
+// writePublishError answers a rejected publish, with a Retry-After header
+// when the client was rate limited
+func writePublishError(w http.ResponseWriter, err error) {
+	var pe *publishError
+	if !errors.As(err, &pe) {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if pe.retryAfter > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(pe.retryAfter))
+	}
+	if len(pe.violations) > 0 {
+		writeJSON(w, pe.status, violationsResponse{Error: pe.msg, Violations: pe.violations})
+		return
+	}
+	http.Error(w, pe.msg, pe.status)
+}
+
+func handleListEvents(hub *EventHub, auth *authenticator, w http.ResponseWriter, r *http.Request) {
+	tenantID, err := auth.authenticate(r, scopeRead)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	q, err := parseHistoryQuery(r, hub.maxEvents)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events, more, err := hub.history(tenantID, q)
+	if errors.Is(err, errCursorNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, historyResponse{Events: events, HasMore: more})
+}
+
+// parseHistoryQuery reads limit, before, after, since, until, topic and
+// filter from the URL. limit may not exceed maxLimit.
+func parseHistoryQuery(r *http.Request, maxLimit int) (historyQuery, error) {
+	v := r.URL.Query()
+	q := historyQuery{
+		Limit:  min(defaultHistoryLimit, maxLimit),
+		Before: v.Get("before"),
+		After:  v.Get("after"),
+		Topic:  v.Get("topic"),
+	}
+	if q.Topic != "" && !validPattern(q.Topic) {
+		return q, errInvalidTopic
+	}
+	if src := v.Get("filter"); src != "" {
+		f, err := compileFilter(src)
+		if err != nil {
+			return q, err
+		}
+		q.Filter = f
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxLimit {
+			return q, errors.New("invalid limit")
+		}
+		q.Limit = n
+	}
+	var err error
+	if q.Since, err = parseTimeParam(v.Get("since")); err != nil {
+		return q, errors.New("invalid since")
+	}
+	if q.Until, err = parseTimeParam(v.Get("until")); err != nil {
+		return q, errors.New("invalid until")
+	}
+	return q, nil
+}
+
+func parseTimeParam(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scopes granted by tenant tokens
+const (
+	scopePublish = "events:publish"
+	scopeRead    = "events:read"
+	scopeSchemas = "schemas:write"
+)
+
+// clockSkew is the leeway allowed when checking exp and nbf
+const clockSkew = 30 * time.Second
+
+// maxTenantLength bounds tenant IDs in bytes. The file store names logs
+// after the hex-encoded ID, which must fit the usual 255-byte file name.
+const maxTenantLength = 100
+
+// tokenClaims is the payload of a tenant token. Scope is a space-separated
+// list as in RFC 8693.
+type tokenClaims struct {
+	Tenant    string `json:"tenant"`
+	Scope     string `json:"scope,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+func (c tokenClaims) hasScope(scope string) bool {
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authError is an authentication failure with the HTTP status to report
+type authError struct {
+	status int
+	msg    string
+}
+
+func (e *authError) Error() string { return e.msg }
+
+var (
+	errMissingTenant     = &authError{http.StatusBadRequest, "missing tenant"}
+	errTenantTooLong     = &authError{http.StatusBadRequest, "tenant ID too long"}
+	errMissingToken      = &authError{http.StatusUnauthorized, "missing token"}
+	errInvalidToken      = &authError{http.StatusUnauthorized, "invalid token"}
+	errExpiredToken      = &authError{http.StatusUnauthorized, "token expired"}
+	errInsufficientScope = &authError{http.StatusForbidden, "insufficient scope"}
+	errTenantMismatch    = &authError{http.StatusForbidden, "tenant mismatch"}
+	errUnmappedCert      = &authError{http.StatusForbidden, "client certificate not mapped to a tenant"}
+)
+
+// authenticator resolves the tenant a request acts for. With a secret it
+// requires an HS256 JWT bearer token and takes the tenant from its verified
+// claims. Without one it trusts the X-Tenant-ID header or tenant query
+// parameter, which is only suitable for local development. A verified TLS
+// client certificate, when trusted, authenticates like a token.
+type authenticator struct {
+	secret        []byte
+	tickets       *ticketStore
+	now           func() time.Time
+	clientCerts   bool
+	clientTenants map[string]string
+}
+
+func newAuthenticator(secret []byte) *authenticator {
+	if len(secret) == 0 {
+		log.Println("WARNING: authentication is disabled; any client can act for any tenant. Never expose this server.")
+	}
+	return &authenticator{secret: secret, tickets: newTicketStore(ticketTTL), now: time.Now}
+}
+
+func (a *authenticator) enabled() bool {
+	return len(a.secret) > 0
+}
+
+// trustClientCerts lets verified client certificates act for a tenant:
+// the one tenants maps their common name to or, without a mapping, the
+// common name itself
+func (a *authenticator) trustClientCerts(tenants map[string]string) {
+	a.clientCerts = true
+	a.clientTenants = tenants
+}
+
+// certClaims returns the claims of r's verified client certificate, if
+// client certificates are trusted and r presented one. They grant publish
+// and read; managing schemas still needs a token.
+func (a *authenticator) certClaims(r *http.Request) (tokenClaims, bool, error) {
+	if !a.clientCerts || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return tokenClaims{}, false, nil
+	}
+	tenant := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(a.clientTenants) > 0 {
+		tenant = a.clientTenants[tenant]
+	}
+	if tenant == "" {
+		return tokenClaims{}, true, errUnmappedCert
+	}
+	return tokenClaims{Tenant: tenant, Scope: scopePublish + " " + scopeRead}, true, nil
+}
+
+// authenticate returns the tenant r may act for with the given scope
+func (a *authenticator) authenticate(r *http.Request, scope string) (string, error) {
+	claims, err := a.claims(r, scope)
+	return claims.Tenant, err
+}
+
+// claims returns the verified claims of r's client certificate or bearer
+// token after checking that they grant scope. Without a secret every scope
+// is granted to the tenant the client names.
+func (a *authenticator) claims(r *http.Request, scope string) (tokenClaims, error) {
+	claimed := requestedTenant(r)
+	if claims, ok, err := a.certClaims(r); ok {
+		if err != nil {
+			return tokenClaims{}, err
+		}
+		return authorize(claims, claimed, scope)
+	}
+	if !a.enabled() {
+		if claimed == "" {
+			return tokenClaims{}, errMissingTenant
+		}
+		if len(claimed) > maxTenantLength {
+			return tokenClaims{}, errTenantTooLong
+		}
+		return tokenClaims{Tenant: claimed, Scope: scopePublish + " " + scopeRead + " " + scopeSchemas}, nil
+	}
+	token := bearerToken(r)
+	if token == "" {
+		return tokenClaims{}, errMissingToken
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return tokenClaims{}, err
+	}
+	return authorize(claims, claimed, scope)
+}
+
+// authenticateTicket resolves a WebSocket handshake, which must present a
+// ticket from POST /ws-tickets or a client certificate when tokens are
+// required
+func (a *authenticator) authenticateTicket(r *http.Request, scope string) (tokenClaims, error) {
+	ticket := r.URL.Query().Get("ticket")
+	if ticket == "" {
+		if _, hasCert, _ := a.certClaims(r); a.enabled() && !hasCert {
+			return tokenClaims{}, errMissingToken
+		}
+		return a.claims(r, scope)
+	}
+	claims, err := a.tickets.redeem(ticket)
+	if err != nil {
+		return tokenClaims{}, err
+	}
+	return authorize(claims, requestedTenant(r), scope)
+}
+
+// authorize checks that claims grant scope and match any tenant the
+// client named
+func authorize(claims tokenClaims, claimed, scope string) (tokenClaims, error) {
+	if len(claims.Tenant) > maxTenantLength {
+		return tokenClaims{}, errTenantTooLong
+	}
+	if !claims.hasScope(scope) {
+		return tokenClaims{}, errInsufficientScope
+	}
+	if claimed != "" && claimed != claims.Tenant {
+		return tokenClaims{}, errTenantMismatch
+	}
+	return claims, nil
+}
+
+// verify checks the token signature and validity window
+func (a *authenticator) verify(token string) (tokenClaims, error) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return claims, errInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, a.sign(parts[0]+"."+parts[1])) {
+		return claims, errInvalidToken
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil || claims.Tenant == "" {
+		return claims, errInvalidToken
+	}
+	now := a.now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(clockSkew)) {
+		return claims, errExpiredToken
+	}
+	if claims.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return claims, errInvalidToken
+	}
+	return claims, nil
+}
+
+func (a *authenticator) sign(input string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(input))
+	return mac.Sum(nil)
+}
+
+// signToken issues a token for claims, for use by trusted tooling
+func (a *authenticator) signToken(claims tokenClaims) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(a.sign(input)), nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// requestedTenant returns the tenant named by the client, if any
+func requestedTenant(r *http.Request) string {
+	if id := r.Header.Get("X-Tenant-ID"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("tenant")
+}
+
+// bearerToken extracts the token from the Authorization header. Tokens
+// are never read from the URL, where they would end up in access logs;
+// clients that cannot set headers use a ticket instead.
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// writeAuthError reports an authentication failure to the client
+func writeAuthError(w http.ResponseWriter, err error) {
+	var ae *authError
+	if !errors.As(err, &ae) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if ae.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="eventfeed"`)
+	}
+	http.Error(w, ae.msg, ae.status)
+}
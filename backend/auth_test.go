@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("test-secret")
+
+func mustToken(t *testing.T, tenant, scope string, ttl time.Duration) string {
+	t.Helper()
+	now := time.Now()
+	token, err := newAuthenticator(testSecret).signToken(tokenClaims{
+		Tenant:    tenant,
+		Scope:     scope,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("signToken: %v", err)
+	}
+	return token
+}
+
+func TestAuthenticatorVerify(t *testing.T) {
+	auth := newAuthenticator(testSecret)
+	valid := mustToken(t, "tenantA", scopeRead, time.Hour)
+	parts := strings.Split(valid, ".")
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"tenant":"tenantB","scope":"events:read","exp":9999999999}`)) + "." + parts[2]
+	other, _ := newAuthenticator([]byte("other")).signToken(tokenClaims{Tenant: "tenantA", Scope: scopeRead, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	future, _ := auth.signToken(tokenClaims{Tenant: "tenantA", Scope: scopeRead, NotBefore: time.Now().Add(time.Hour).Unix(), ExpiresAt: time.Now().Add(2 * time.Hour).Unix()})
+
+	testCases := []struct {
+		name   string
+		header map[string]string
+		target string
+		scope  string
+		tenant string
+		err    error
+	}{
+		{"valid", map[string]string{"Authorization": "Bearer " + valid}, "/", scopeRead, "tenantA", nil},
+		{"query token", nil, "/?access_token=" + valid, scopeRead, "", errMissingToken},
+		{"matching tenant", map[string]string{"Authorization": "Bearer " + valid, "X-Tenant-ID": "tenantA"}, "/", scopeRead, "tenantA", nil},
+		{"missing", nil, "/", scopeRead, "", errMissingToken},
+		{"raw tenant ignored", map[string]string{"X-Tenant-ID": "tenantA"}, "/?tenant=tenantA", scopeRead, "", errMissingToken},
+		{"malformed", map[string]string{"Authorization": "Bearer abc"}, "/", scopeRead, "", errInvalidToken},
+		{"alg none", map[string]string{"Authorization": "Bearer " + unsigned}, "/", scopeRead, "", errInvalidToken},
+		{"forged claims", map[string]string{"Authorization": "Bearer " + forged}, "/", scopeRead, "", errInvalidToken},
+		{"wrong secret", map[string]string{"Authorization": "Bearer " + other}, "/", scopeRead, "", errInvalidToken},
+		{"expired", map[string]string{"Authorization": "Bearer " + mustToken(t, "tenantA", scopeRead, -time.Hour)}, "/", scopeRead, "", errExpiredToken},
+		{"not yet valid", map[string]string{"Authorization": "Bearer " + future}, "/", scopeRead, "", errInvalidToken},
+		{"scope", map[string]string{"Authorization": "Bearer " + valid}, "/", scopePublish, "", errInsufficientScope},
+		{"tenant mismatch", map[string]string{"Authorization": "Bearer " + valid, "X-Tenant-ID": "tenantB"}, "/", scopeRead, "", errTenantMismatch},
+		{"query tenant mismatch", map[string]string{"Authorization": "Bearer " + valid}, "/?tenant=tenantB", scopeRead, "", errTenantMismatch},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			for k, v := range tc.header {
+				r.Header.Set(k, v)
+			}
+			tenant, err := auth.authenticate(r, tc.scope)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if tenant != tc.tenant {
+				t.Fatalf("expected tenant %q, got %q", tc.tenant, tenant)
+			}
+		})
+	}
+}
+
+func TestAuthenticatedServer(t *testing.T) {
+	srv := httptest.NewServer(newServer(defaultConfig(), newEventHub(defaultConfig()), newAuthenticator(testSecret)))
+	defer srv.Close()
+	client := srv.Client()
+
+	publishA := mustToken(t, "tenantA", scopePublish, time.Hour)
+	readA := mustToken(t, "tenantA", scopeRead, time.Hour)
+	readB := mustToken(t, "tenantB", scopeRead, time.Hour)
+
+	post := func(token, tenantHeader string) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/events", bytes.NewBufferString(`{"message":"secret"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if tenantHeader != "" {
+			req.Header.Set("X-Tenant-ID", tenantHeader)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post("", "tenantA"); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for raw tenant header, got %d", status)
+	}
+	if status := post(readA, ""); status != http.StatusForbidden {
+		t.Fatalf("expected 403 for read-only token, got %d", status)
+	}
+	if status := post(publishA, "tenantB"); status != http.StatusForbidden {
+		t.Fatalf("expected 403 for tenant mismatch, got %d", status)
+	}
+	long := strings.Repeat("t", maxTenantLength+1)
+	if status := post(mustToken(t, long, scopePublish, time.Hour), ""); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an overlong tenant ID, got %d", status)
+	}
+
+	if _, err := dialWS(srv.URL + "/ws?tenant=tenantA"); err == nil {
+		t.Fatalf("websocket without ticket should fail")
+	}
+	if _, err := dialWS(srv.URL + "/ws?access_token=" + readA); err == nil {
+		t.Fatalf("websocket with a bearer token instead of a ticket should fail")
+	}
+	wsA, err := dialWS(srv.URL + "/ws?ticket=" + issueTicket(t, client, srv.URL, readA))
+	if err != nil {
+		t.Fatalf("dial tenantA: %v", err)
+	}
+	defer wsA.Close()
+	wsB, err := dialWS(srv.URL + "/ws?ticket=" + issueTicket(t, client, srv.URL, readB) + "&tenant=tenantB")
+	if err != nil {
+		t.Fatalf("dial tenantB: %v", err)
+	}
+	defer wsB.Close()
+
+	if status := post(publishA, ""); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	var ev Event
+	if err := wsA.ReadJSON(&ev, time.Second); err != nil || ev.TenantID != "tenantA" {
+		t.Fatalf("tenantA should receive its event: %+v (%v)", ev, err)
+	}
+	if err := wsB.ReadJSON(&ev, 200*time.Millisecond); err == nil {
+		t.Fatalf("tenantB should not receive tenantA event")
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/events", nil)
+	req.Header.Set("Authorization", "Bearer "+readB)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	defer resp.Body.Close()
+	var h historyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(h.Events) != 0 {
+		t.Fatalf("tenantB token must not read tenantA history: %+v", h.Events)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Limits on POST /events/batch
+const (
+	maxBatchEvents = 1000
+	maxBatchBody   = 16 << 20
+)
+
+var errBatchTooLarge = &publishError{status: http.StatusRequestEntityTooLarge, msg: fmt.Sprintf("batch larger than %d events or %d bytes", maxBatchEvents, maxBatchBody)}
+
+// batchResult reports one item of a batch: the ID of the published event
+// or why the item was rejected
+type batchResult struct {
+	Index      int               `json:"index"`
+	ID         string            `json:"id,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Violations []schemaViolation `json:"violations,omitempty"`
+}
+
+// batchResponse is the body returned by POST /events/batch. Published is
+// the number of events posted, which is either all of them or none.
+type batchResponse struct {
+	Published int           `json:"published"`
+	Results   []batchResult `json:"results"`
+}
+
+// batchItem is a parsed item of a batch body; err is set when the item
+// itself is malformed
+type batchItem struct {
+	req eventRequest
+	err *publishError
+}
+
+// serveBatch handles POST /events/batch. The body is a JSON array of
+// events or NDJSON, one event per line, read as a stream. The batch is
+// published as a unit: if any item is invalid nothing is posted and the
+// results say which items failed and why.
+func serveBatch(hub *EventHub, auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tenantID, err := auth.authenticate(r, scopePublish)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		items, err := readBatch(http.MaxBytesReader(w, r.Body, maxBatchBody))
+		if err != nil {
+			log.Printf("tenant %s: rejected batch: %v", tenantID, err)
+			writePublishError(w, err)
+			return
+		}
+
+		resp := batchResponse{Results: make([]batchResult, len(items))}
+		reqs := make([]eventRequest, len(items))
+		var failed *publishError
+		for i := range items {
+			resp.Results[i].Index = i
+			pe := items[i].err
+			if pe == nil {
+				pe = checkRequest(hub, tenantID, &items[i].req)
+			}
+			if pe != nil {
+				resp.Results[i].Error = pe.msg
+				resp.Results[i].Violations = pe.violations
+				if failed == nil {
+					failed = pe
+				}
+			}
+			reqs[i] = items[i].req
+		}
+		if failed != nil {
+			log.Printf("tenant %s: rejected batch of %d events", tenantID, len(items))
+			writeJSON(w, failed.status, resp)
+			return
+		}
+
+		publish := func() ([]Event, error) { return postChecked(hub, tenantID, reqs) }
+		var events []Event
+		if key := r.Header.Get(idempotencyHeader); key != "" {
+			if !validIdempotencyKey(key) {
+				writePublishError(w, errInvalidIdempotencyKey)
+				return
+			}
+			var replayed bool
+			events, replayed, err = hub.publishOnce(tenantID, key, publishFingerprint(fingerprintBatch, reqs), publish)
+			if replayed {
+				w.Header().Set(replayedHeader, "true")
+			}
+		} else {
+			events, err = publish()
+		}
+		if err != nil {
+			writePublishError(w, err)
+			return
+		}
+		resp.Published = len(events)
+		for i, e := range events {
+			resp.Results[i].ID = e.ID
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// readBatch parses a batch body, telling a JSON array from NDJSON by its
+// first non-blank byte. Items are decoded one at a time; a body that is
+// not JSON at all fails as a whole, while an item that is not an event
+// only fails itself.
+func readBatch(body io.Reader) ([]batchItem, error) {
+	br := bufio.NewReader(body)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, batchReadError(err)
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+			continue
+		case '[':
+			return readBatchArray(br)
+		}
+		return readBatchLines(br)
+	}
+}
+
+func readBatchArray(r io.Reader) ([]batchItem, error) {
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil {
+		return nil, batchReadError(err)
+	}
+	var items []batchItem
+	for dec.More() {
+		if len(items) == maxBatchEvents {
+			return nil, errBatchTooLarge
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, batchReadError(err)
+		}
+		items = append(items, parseBatchItem(raw))
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, batchReadError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, batchReadError(err)
+	}
+	if len(items) == 0 {
+		return nil, &publishError{status: http.StatusBadRequest, msg: "empty batch"}
+	}
+	return items, nil
+}
+
+func readBatchLines(r io.Reader) ([]batchItem, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), maxPublishBody)
+	var items []batchItem
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(items) == maxBatchEvents {
+			return nil, errBatchTooLarge
+		}
+		items = append(items, parseBatchItem(line))
+	}
+	if errors.Is(sc.Err(), bufio.ErrTooLong) {
+		return nil, &publishError{status: http.StatusRequestEntityTooLarge, msg: fmt.Sprintf("event larger than %d bytes", maxPublishBody)}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, batchReadError(err)
+	}
+	if len(items) == 0 {
+		return nil, &publishError{status: http.StatusBadRequest, msg: "empty batch"}
+	}
+	return items, nil
+}
+
+func parseBatchItem(raw []byte) batchItem {
+	if len(raw) > maxPublishBody {
+		return batchItem{err: &publishError{status: http.StatusRequestEntityTooLarge, msg: fmt.Sprintf("event larger than %d bytes", maxPublishBody)}}
+	}
+	req, err := parseEventRequest(raw)
+	if err != nil {
+		return batchItem{err: errBadJSON}
+	}
+	return batchItem{req: req}
+}
+
+// batchReadError maps a failure reading the body: an exceeded size limit
+// is 413, an empty body or anything else bad json
+func batchReadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errBatchTooLarge
+	}
+	if err == io.EOF {
+		return &publishError{status: http.StatusBadRequest, msg: "empty batch"}
+	}
+	return errBadJSON
+}
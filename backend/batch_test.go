@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadBatch(t *testing.T) {
+	cases := []struct {
+		name   string
+		body   string
+		n      int
+		status int
+	}{
+		{"array", ` [{"message":"a"}, {"message":"b"}]`, 2, 0},
+		{"ndjson", "{\"message\":\"a\"}\r\n\n{\"message\":\"b\"}\n{\"message\":\"c\"}", 3, 0},
+		{"bad item", `[{"message":"a"}, 7]`, 2, 0},
+		{"bad line", "{\"message\":\"a\"}\n{oops", 2, 0},
+		{"broken array", `[{"message":"a"}`, 0, http.StatusBadRequest},
+		{"trailing data", `[{"message":"a"}] {}`, 0, http.StatusBadRequest},
+		{"empty", "  \n", 0, http.StatusBadRequest},
+		{"empty array", `[]`, 0, http.StatusBadRequest},
+		{"too many", strings.Repeat("{}\n", maxBatchEvents+1), 0, http.StatusRequestEntityTooLarge},
+		{"long line", `{"message":"` + strings.Repeat("x", maxPublishBody) + `"}`, 0, http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range cases {
+		items, err := readBatch(strings.NewReader(tc.body))
+		if tc.status != 0 {
+			pe, ok := err.(*publishError)
+			if !ok || pe.status != tc.status {
+				t.Errorf("%s: expected status %d, got %v", tc.name, tc.status, err)
+			}
+			continue
+		}
+		if err != nil || len(items) != tc.n {
+			t.Errorf("%s: got %d items (%v), want %d", tc.name, len(items), err, tc.n)
+		}
+	}
+	items, _ := readBatch(strings.NewReader(`[{"message":"a"}, 7]`))
+	if items[0].err != nil || items[0].req.Message != "a" || items[1].err != errBadJSON {
+		t.Fatalf("unexpected items %+v", items)
+	}
+}
+
+func TestBatchPublish(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openFileStore(dir, syncAlways, 0)
+	hub, _ := openEventHub(defaultConfig(), store)
+	srv := httptest.NewServer(newServer(defaultConfig(), hub, newAuthenticator(nil)))
+	defer srv.Close()
+	client := srv.Client()
+
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	post := func(body string) (int, batchResponse) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/events/batch", strings.NewReader(body))
+		req.Header.Set("X-Tenant-ID", "tenantA")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		var br batchResponse
+		json.Unmarshal(b, &br)
+		return resp.StatusCode, br
+	}
+
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf(`{"topic":"backfill","message":"m%d"}`, i))
+	}
+	status, resp := post(strings.Join(lines, "\n") + "\n")
+	if status != http.StatusOK || resp.Published != 50 || len(resp.Results) != 50 {
+		t.Fatalf("ndjson batch: %d %+v", status, resp)
+	}
+	for i, r := range resp.Results {
+		if r.Index != i || r.ID == "" || r.Error != "" {
+			t.Fatalf("unexpected result %+v", r)
+		}
+		if ev := readEvent(t, ws); ev.ID != r.ID || ev.Message != fmt.Sprintf("m%d", i) {
+			t.Fatalf("event %d broadcast out of order: %+v", i, ev)
+		}
+	}
+
+	// one bad item rejects the whole batch and every failure is reported
+	status, resp = post(`[{"message":"ok"}, {"topic":"a.*"}, {"message":"ok"}, "nope"]`)
+	if status != http.StatusBadRequest || resp.Published != 0 || len(resp.Results) != 4 {
+		t.Fatalf("invalid batch: %d %+v", status, resp)
+	}
+	if resp.Results[0].Error != "" || resp.Results[0].ID != "" || resp.Results[1].Error != errInvalidTopic.Error() || resp.Results[3].Error != "bad json" {
+		t.Fatalf("unexpected results %+v", resp.Results)
+	}
+
+	hub.setSchema("tenantA", "order", mustCompileSchema(t, `{"type":"object","required":["id"]}`))
+	status, resp = post(`[{"type":"order","data":{"id":1}}, {"type":"order","data":{}}]`)
+	if status != http.StatusUnprocessableEntity || len(resp.Results[1].Violations) != 1 || resp.Results[1].Violations[0].Pointer != "/data/id" {
+		t.Fatalf("schema failure: %d %+v", status, resp)
+	}
+
+	var ev Event
+	if err := ws.ReadJSON(&ev, 200*time.Millisecond); err == nil {
+		t.Fatalf("rejected batches must not be broadcast, got %+v", ev)
+	}
+
+	store.Close()
+	store, _ = openFileStore(dir, syncAlways, 0)
+	defer store.Close()
+	hub, _ = openEventHub(defaultConfig(), store)
+	events, _, _ := hub.history("tenantA", historyQuery{Limit: 100})
+	if len(events) != 50 || events[49].Message != "m49" {
+		t.Fatalf("expected the 50 batched events to be stored, got %d", len(events))
+	}
+}
+
+func TestBatchNearLimitStored(t *testing.T) {
+	store, _ := openFileStore(t.TempDir(), syncNever, 0)
+	defer store.Close()
+	hub, _ := openEventHub(defaultConfig(), store)
+	srv := httptest.NewServer(newServer(defaultConfig(), hub, newAuthenticator(nil)))
+	defer srv.Close()
+
+	// characters JSON escapes for HTML, and invalid UTF-8 that decodes to
+	// a 3-byte replacement character, must not outgrow the record limit
+	n := maxBatchBody / maxPublishBody
+	var body strings.Builder
+	for i := 0; i < n; i++ {
+		fill := "<"
+		if i%2 == 1 {
+			fill = "\xff"
+		}
+		fmt.Fprintf(&body, `{"message":"%s"}`+"\n", strings.Repeat(fill, maxPublishBody-64))
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/events/batch", strings.NewReader(body.String()))
+	req.Header.Set("X-Tenant-ID", "tenantA")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, b)
+	}
+	events, err := store.Load("tenantA", 0)
+	if err != nil || len(events) != n {
+		t.Fatalf("expected %d stored events, got %d (%v)", n, len(events), err)
+	}
+}
+
+func TestBatchStoreFailure(t *testing.T) {
+	hub, _ := openEventHub(defaultConfig(), failingStore{})
+	conn := &fakeConn{}
+	hub.registerConn("t1", conn)
+	reqs := []eventRequest{{Message: "a"}, {Message: "b"}}
+	if _, err := publishAll(hub, "t1", reqs); err != errStoreFailed {
+		t.Fatalf("expected errStoreFailed, got %v", err)
+	}
+	if len(conn.msgs) != 0 {
+		t.Fatalf("nothing should be broadcast when the store fails, got %+v", conn.msgs)
+	}
+}
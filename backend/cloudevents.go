@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// CloudEvents 1.0 support. Published CloudEvents map onto eventRequest:
+// type, source and subject keep their meaning, a JSON object in data
+// becomes Data and a string becomes Message. The producer's id is kept in
+// the ceid metadata entry, delivered as an extension of that name; the
+// topic extension sets the topic and the remaining extensions become
+// metadata. The time attribute is dropped in favour of the server's
+// receive time, which orders the feed.
+const (
+	ceSpecVersion     = "1.0"
+	ceStructuredType  = "application/cloudevents+json"
+	ceBatchType       = "application/cloudevents-batch+json"
+	ceProducerIDKey   = "ceid"
+	ceDefaultType     = "eventfeed.event"
+	formatCloudEvents = "cloudevents"
+	ceHeaderPrefix    = "Ce-"
+)
+
+// ceContextAttributes are the attributes defined by the specification,
+// which are never treated as extensions
+var ceContextAttributes = map[string]bool{
+	"specversion":     true,
+	"id":              true,
+	"source":          true,
+	"type":            true,
+	"subject":         true,
+	"time":            true,
+	"datacontenttype": true,
+	"dataschema":      true,
+	"data":            true,
+	"data_base64":     true,
+}
+
+var errUnsupportedData = &publishError{status: http.StatusUnsupportedMediaType, msg: "unsupported data content type"}
+
+// cloudEventsMode returns the content mode of a publish request: "binary",
+// "structured", "batch", or "" for the native format
+func cloudEventsMode(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == ceStructuredType:
+		return "structured"
+	case mediaType == ceBatchType:
+		return "batch"
+	case r.Header.Get("Ce-Specversion") != "":
+		return "binary"
+	}
+	return ""
+}
+
+// parseCloudEvent maps one structured-mode event to a request
+func parseCloudEvent(body []byte) (eventRequest, error) {
+	var attrs map[string]json.RawMessage
+	if err := json.Unmarshal(body, &attrs); err != nil {
+		return eventRequest{}, errBadJSON
+	}
+	var req eventRequest
+	str := func(name string) (string, error) {
+		raw, ok := attrs[name]
+		if !ok {
+			return "", nil
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", ceError("%s must be a string", name)
+		}
+		return s, nil
+	}
+	values := make(map[string]string)
+	for _, name := range []string{"specversion", "id", "source", "type", "subject", "datacontenttype", "dataschema", "data_base64"} {
+		s, err := str(name)
+		if err != nil {
+			return req, err
+		}
+		values[name] = s
+	}
+	if err := req.setContext(values["specversion"], values["id"], values["source"], values["type"], values["subject"]); err != nil {
+		return req, err
+	}
+	if values["dataschema"] != "" {
+		req.setMetadata("dataschema", values["dataschema"])
+	}
+	for name, raw := range attrs {
+		if ceContextAttributes[name] {
+			continue
+		}
+		v, err := extensionValue(raw)
+		if err != nil {
+			return req, ceError("extension %s must be a string, number or boolean", name)
+		}
+		req.setExtension(name, v)
+	}
+	if data, ok := attrs["data"]; ok {
+		if _, both := attrs["data_base64"]; both {
+			return req, ceError("data and data_base64 are exclusive")
+		}
+		return req, req.setJSONData(data)
+	}
+	if values["data_base64"] != "" {
+		b, err := base64.StdEncoding.DecodeString(values["data_base64"])
+		if err != nil {
+			return req, ceError("invalid data_base64")
+		}
+		return req, req.setData(values["datacontenttype"], b)
+	}
+	return req, nil
+}
+
+// parseCloudEventBatch maps a batched-mode array of events to requests
+func parseCloudEventBatch(body []byte) ([]eventRequest, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, errBadJSON
+	}
+	reqs := make([]eventRequest, 0, len(items))
+	for i, item := range items {
+		req, err := parseCloudEvent(item)
+		var pe *publishError
+		if errors.As(err, &pe) {
+			return nil, &publishError{status: pe.status, msg: fmt.Sprintf("event %d: %s", i, pe.msg)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// parseBinaryCloudEvent maps a binary-mode request, whose attributes are
+// ce- headers and whose body is the data, to a request
+func parseBinaryCloudEvent(h http.Header, body []byte) (eventRequest, error) {
+	var req eventRequest
+	attr := func(name string) string {
+		v := h.Get(ceHeaderPrefix + name)
+		if s, err := url.PathUnescape(v); err == nil {
+			return s
+		}
+		return v
+	}
+	if err := req.setContext(attr("specversion"), attr("id"), attr("source"), attr("type"), attr("subject")); err != nil {
+		return req, err
+	}
+	if s := attr("dataschema"); s != "" {
+		req.setMetadata("dataschema", s)
+	}
+	for key := range h {
+		if !strings.HasPrefix(key, ceHeaderPrefix) {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(key, ceHeaderPrefix))
+		if !ceContextAttributes[name] {
+			req.setExtension(name, attr(name))
+		}
+	}
+	if len(body) == 0 {
+		return req, nil
+	}
+	return req, req.setData(h.Get("Content-Type"), body)
+}
+
+func ceError(format string, args ...interface{}) error {
+	return &publishError{status: http.StatusBadRequest, msg: "invalid cloudevent: " + fmt.Sprintf(format, args...)}
+}
+
+// setContext checks and applies the required context attributes
+func (r *eventRequest) setContext(specversion, id, source, typ, subject string) error {
+	if specversion != ceSpecVersion {
+		return ceError("unsupported specversion %q", specversion)
+	}
+	if id == "" || source == "" || typ == "" {
+		return ceError("id, source and type are required")
+	}
+	r.Source, r.Type, r.Subject = source, typ, subject
+	r.setMetadata(ceProducerIDKey, id)
+	return nil
+}
+
+// setExtension applies an extension attribute; topic selects the topic
+func (r *eventRequest) setExtension(name, value string) {
+	if name == "topic" {
+		r.Topic = value
+		return
+	}
+	r.setMetadata(name, value)
+}
+
+func (r *eventRequest) setMetadata(key, value string) {
+	if r.Metadata == nil {
+		r.Metadata = make(map[string]string)
+	}
+	r.Metadata[key] = value
+}
+
+// setJSONData applies a structured-mode data member
+func (r *eventRequest) setJSONData(raw json.RawMessage) error {
+	d := bytes.TrimSpace(raw)
+	switch {
+	case len(d) == 0 || bytes.Equal(d, []byte("null")):
+	case d[0] == '{':
+		r.Data = raw
+	case d[0] == '"':
+		return json.Unmarshal(d, &r.Message)
+	default:
+		return ceError("data must be a JSON object or string")
+	}
+	return nil
+}
+
+// setData applies data of the given content type: JSON is handled like
+// structured data and text becomes the message
+func (r *eventRequest) setData(contentType string, b []byte) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if contentType == "" {
+		mediaType, err = "application/json", nil
+	}
+	switch {
+	case err != nil:
+		return errUnsupportedData
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		if !json.Valid(b) {
+			return errBadJSON
+		}
+		return r.setJSONData(b)
+	case strings.HasPrefix(mediaType, "text/"):
+		if !utf8.Valid(b) {
+			return ceError("text data must be UTF-8")
+		}
+		r.Message = string(b)
+		return nil
+	}
+	return errUnsupportedData
+}
+
+// extensionValue renders an extension attribute as a string
+func extensionValue(raw json.RawMessage) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case float64, bool:
+		return string(bytes.TrimSpace(raw)), nil
+	}
+	return "", fmt.Errorf("unsupported extension value")
+}
+
+// validExtensionName reports whether name may be used as an extension
+// attribute: lower-case ASCII letters and digits
+func validExtensionName(name string) bool {
+	if name == "" || ceContextAttributes[name] {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// cloudEvent renders e in the CloudEvents structured JSON format. Events
+// published natively get a source naming the tenant and a generic type;
+// the tenant, topic, sequence numbers and, alongside data, the message
+// travel as extensions, as do metadata entries with valid extension names.
+func cloudEvent(e Event) map[string]interface{} {
+	ce := map[string]interface{}{
+		"specversion": ceSpecVersion,
+		"id":          e.ID,
+		"source":      e.Source,
+		"type":        e.Type,
+		"time":        e.Timestamp,
+		"tenantid":    e.TenantID,
+	}
+	if e.Source == "" {
+		ce["source"] = "/tenants/" + url.PathEscape(e.TenantID)
+	}
+	if e.Type == "" {
+		ce["type"] = ceDefaultType
+	}
+	if e.Subject != "" {
+		ce["subject"] = e.Subject
+	}
+	if e.Topic != "" {
+		ce["topic"] = e.Topic
+	}
+	if e.Seq > 0 {
+		ce["sequence"] = strconv.FormatUint(e.Seq, 10)
+	}
+	if e.PrevSeq > 0 {
+		ce["prevsequence"] = strconv.FormatUint(e.PrevSeq, 10)
+	}
+	for k, v := range e.Metadata {
+		if k == "dataschema" || (validExtensionName(k) && ce[k] == nil) {
+			ce[k] = v
+		}
+	}
+	switch {
+	case e.Data != nil:
+		ce["datacontenttype"] = "application/json"
+		ce["data"] = e.Data
+		if e.Message != "" {
+			ce["message"] = e.Message
+		}
+	case e.Message != "":
+		ce["datacontenttype"] = "text/plain"
+		ce["data"] = e.Message
+	}
+	return ce
+}
+
+// outputFormat reads the format query parameter of a subscribe request and
+// reports whether CloudEvents were requested
+func outputFormat(r *http.Request) (bool, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "":
+		return false, nil
+	case formatCloudEvents:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported format %q", f)
+	}
+}
+
+// encodeOutput converts events to CloudEvents for connections that asked
+// for them; other messages are sent as they are
+func encodeOutput(v interface{}, cloudEvents bool) interface{} {
+	if e, ok := v.(Event); ok && cloudEvents {
+		return cloudEvent(e)
+	}
+	return v
+}
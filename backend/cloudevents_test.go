@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCloudEvent(t *testing.T) {
+	req, err := parseCloudEvent([]byte(`{
+		"specversion": "1.0",
+		"id": "evt-1",
+		"source": "/billing",
+		"type": "invoice.paid",
+		"subject": "inv-9",
+		"time": "2024-01-01T00:00:00Z",
+		"datacontenttype": "application/json",
+		"dataschema": "https://example.com/invoice.json",
+		"topic": "billing.invoices",
+		"traceparent": "00-abc",
+		"attempt": 2,
+		"data": {"amount": 10}
+	}`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if req.Type != "invoice.paid" || req.Source != "/billing" || req.Subject != "inv-9" || req.Topic != "billing.invoices" {
+		t.Fatalf("unexpected attributes %+v", req)
+	}
+	if string(req.Data) != `{"amount": 10}` {
+		t.Fatalf("unexpected data %s", req.Data)
+	}
+	want := map[string]string{
+		ceProducerIDKey: "evt-1",
+		"dataschema":    "https://example.com/invoice.json",
+		"traceparent":   "00-abc",
+		"attempt":       "2",
+	}
+	if len(req.Metadata) != len(want) {
+		t.Fatalf("unexpected metadata %v", req.Metadata)
+	}
+	for k, v := range want {
+		if req.Metadata[k] != v {
+			t.Fatalf("metadata %s = %q, want %q", k, req.Metadata[k], v)
+		}
+	}
+
+	req, err = parseCloudEvent([]byte(`{"specversion":"1.0","id":"2","source":"s","type":"t","datacontenttype":"text/plain","data_base64":"aGVsbG8="}`))
+	if err != nil || req.Message != "hello" {
+		t.Fatalf("expected base64 text data as message, got %+v (%v)", req, err)
+	}
+
+	for _, body := range []string{
+		`{"specversion":"0.3","id":"1","source":"s","type":"t"}`,
+		`{"specversion":"1.0","source":"s","type":"t"}`,
+		`{"specversion":"1.0","id":"1","type":"t"}`,
+		`{"specversion":"1.0","id":1,"source":"s","type":"t"}`,
+		`{"specversion":"1.0","id":"1","source":"s","type":"t","data":[1]}`,
+		`{"specversion":"1.0","id":"1","source":"s","type":"t","ext":{"a":1}}`,
+		`{"specversion":"1.0","id":"1","source":"s","type":"t","data":{},"data_base64":"e30="}`,
+		`{"specversion":"1.0","id":"1","source":"s","type":"t","datacontenttype":"image/png","data_base64":"AAAA"}`,
+		`[]`,
+	} {
+		if _, err := parseCloudEvent([]byte(body)); err == nil {
+			t.Errorf("%s: expected error", body)
+		}
+	}
+}
+
+func TestCloudEventOutput(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ce := cloudEvent(Event{ID: "e1", TenantID: "acme", Message: "hi", Timestamp: ts})
+	if ce["specversion"] != "1.0" || ce["id"] != "e1" || ce["source"] != "/tenants/acme" ||
+		ce["type"] != ceDefaultType || ce["datacontenttype"] != "text/plain" || ce["data"] != "hi" || ce["tenantid"] != "acme" {
+		t.Fatalf("unexpected native mapping %v", ce)
+	}
+
+	ce = cloudEvent(Event{
+		ID: "e2", TenantID: "acme", Topic: "billing", Type: "invoice.paid", Source: "/billing",
+		Subject: "inv-9", Message: "note", Data: json.RawMessage(`{"amount":10}`), Timestamp: ts,
+		Metadata: map[string]string{ceProducerIDKey: "evt-1", "traceparent": "00-abc", "Bad-Name": "x", "id": "clash"},
+	})
+	b, _ := json.Marshal(ce)
+	var got map[string]interface{}
+	json.Unmarshal(b, &got)
+	want := map[string]interface{}{
+		"specversion": "1.0", "id": "e2", "source": "/billing", "type": "invoice.paid", "subject": "inv-9",
+		"time": "2024-05-01T12:00:00Z", "tenantid": "acme", "topic": "billing", "traceparent": "00-abc", "ceid": "evt-1",
+		"message": "note", "datacontenttype": "application/json", "data": map[string]interface{}{"amount": float64(10)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected attributes %s", b)
+	}
+	for k, v := range want {
+		if gb, _ := json.Marshal(got[k]); string(gb) != mustJSON(v) {
+			t.Fatalf("%s = %s, want %s", k, gb, mustJSON(v))
+		}
+	}
+}
+
+func TestCloudEventProducerIDRoundTrip(t *testing.T) {
+	if !validExtensionName(ceProducerIDKey) {
+		t.Fatalf("%q is not a valid extension name", ceProducerIDKey)
+	}
+	req, err := parseCloudEvent([]byte(`{"specversion":"1.0","id":"evt-1","source":"/billing","type":"invoice.paid","data":{}}`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	ce := cloudEvent(Event{ID: "e1", TenantID: "acme", Type: req.Type, Source: req.Source, Data: req.Data, Metadata: req.Metadata})
+	if ce["id"] != "e1" || ce[ceProducerIDKey] != "evt-1" {
+		t.Fatalf("producer id lost on delivery: %v", ce)
+	}
+}
+
+func mustJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestCloudEventsEndToEnd(t *testing.T) {
+	srv, hub := setupTestServer()
+	defer srv.Close()
+	client := srv.Client()
+
+	if _, err := dialWS(srv.URL + "/ws?tenant=tenantA&format=xml"); err == nil {
+		t.Fatalf("unknown format should fail the handshake")
+	}
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA&format=cloudevents")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	stream := dialSSE(t, srv.URL+"/events/stream?tenant=tenantA&format=cloudevents", nil)
+	defer stream.Close()
+	// the first keep-alive proves the subscription is registered
+	for m := range stream.msgs {
+		if m.comment == "keep-alive" {
+			break
+		}
+	}
+
+	post := func(contentType string, header map[string]string, body string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/events", strings.NewReader(body))
+		req.Header.Set("X-Tenant-ID", "tenantA")
+		req.Header.Set("Content-Type", contentType)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	status, body := post("application/cloudevents+json; charset=utf-8", nil,
+		`{"specversion":"1.0","id":"a1","source":"/orders","type":"order.created","data":{"n":1}}`)
+	if status != http.StatusOK {
+		t.Fatalf("structured: %d %s", status, body)
+	}
+	status, body = post("text/plain", map[string]string{
+		"Ce-Specversion": "1.0", "Ce-Id": "a2", "Ce-Source": "/chat", "Ce-Type": "chat.message",
+		"Ce-Subject": "room%201", "Ce-Topic": "chat.general",
+	}, "hello there")
+	if status != http.StatusOK {
+		t.Fatalf("binary: %d %s", status, body)
+	}
+	status, body = post("application/cloudevents-batch+json", nil, `[
+		{"specversion":"1.0","id":"b1","source":"/orders","type":"order.paid","data":{"n":2}},
+		{"specversion":"1.0","id":"b2","source":"/orders","type":"order.shipped","data":"parcel"}
+	]`)
+	var batch []Event
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &batch) != nil || len(batch) != 2 {
+		t.Fatalf("batch: %d %s", status, body)
+	}
+
+	status, body = post("application/cloudevents-batch+json", nil, `[
+		{"specversion":"1.0","id":"c1","source":"/orders","type":"order.paid"},
+		{"specversion":"1.0","id":"c2","type":"order.paid"}
+	]`)
+	if status != http.StatusBadRequest || !strings.Contains(body, "event 1") {
+		t.Fatalf("invalid batch: %d %s", status, body)
+	}
+	if status, _ := post("image/png", map[string]string{"Ce-Specversion": "1.0", "Ce-Id": "x", "Ce-Source": "s", "Ce-Type": "t"}, "\x89PNG"); status != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 for binary data, got %d", status)
+	}
+
+	events, _, _ := hub.history("tenantA", historyQuery{Limit: 10})
+	if len(events) != 4 {
+		t.Fatalf("expected 4 stored events, got %d", len(events))
+	}
+	if e := events[1]; e.Message != "hello there" || e.Subject != "room 1" || e.Topic != "chat.general" || e.Metadata[ceProducerIDKey] != "a2" {
+		t.Fatalf("unexpected binary mapping %+v", e)
+	}
+
+	wantTypes := []string{"order.created", "chat.message", "order.paid", "order.shipped"}
+	for i, typ := range wantTypes {
+		var ce map[string]interface{}
+		if err := ws.ReadJSON(&ce, time.Second); err != nil {
+			t.Fatalf("ws read: %v", err)
+		}
+		if ce["specversion"] != "1.0" || ce["type"] != typ || ce["id"] != events[i].ID {
+			t.Fatalf("unexpected websocket cloudevent %v", ce)
+		}
+		m := stream.next(t)
+		if m.id != events[i].ID || !strings.Contains(m.data, `"specversion":"1.0"`) || !strings.Contains(m.data, `"type":"`+typ+`"`) {
+			t.Fatalf("unexpected sse cloudevent %+v", m)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server's runtime settings. loadConfig starts from
+// defaultConfig and overlays a config file, EVENTFEED_* environment
+// variables and command-line flags, each taking precedence over the one
+// before.
+type Config struct {
+	// Addr is the address the server listens on
+	Addr string
+	// FrontendDir holds the static frontend, served under / and /static/;
+	// empty serves no frontend
+	FrontendDir string
+	// MaxEvents is the number of events kept in each tenant's history
+	MaxEvents int
+	// DataDir persists history when set; otherwise it lives in memory
+	DataDir string
+	// Fsync controls how often the event store syncs to disk
+	Fsync syncPolicy
+	// TokenSecret is the key tenant tokens are signed with. It is required
+	// unless InsecureNoAuth is set.
+	TokenSecret string
+	// InsecureNoAuth runs without a secret, trusting the tenant clients
+	// name; only for local development
+	InsecureNoAuth bool
+	// RateLimits bounds publishes per tenant
+	RateLimits rateLimits
+	// IdempotencyWindow is how long idempotency keys are remembered
+	IdempotencyWindow time.Duration
+	// ShutdownDelay is how long a shutdown keeps serving after readiness
+	// turns false, before it starts refusing and draining. It should exceed
+	// the readiness probe period times its failure threshold.
+	ShutdownDelay time.Duration
+	// DrainTimeout bounds a graceful shutdown
+	DrainTimeout time.Duration
+	// TLSCert and TLSKey are PEM files to serve HTTPS with; they are
+	// reloaded when they change
+	TLSCert, TLSKey string
+	// DevTLS serves HTTPS with a generated self-signed certificate
+	DevTLS bool
+	// TLSClientCA is a PEM bundle of CAs whose client certificates
+	// authenticate a tenant
+	TLSClientCA string
+	// TLSClientTenants maps client certificate common names to tenants;
+	// when empty the common name is the tenant
+	TLSClientTenants map[string]string
+	// MetricsTenants is how many tenants /metrics labels individually;
+	// the rest are summed under one label. Tenant IDs are only exposed
+	// behind MetricsToken.
+	MetricsTenants int
+	// MetricsToken, when set, must be presented to read /metrics
+	MetricsToken string
+	// Conn configures WebSocket and SSE connections
+	Conn connOptions
+}
+
+// defaultFrontendDir is where the frontend sits relative to backend/. When
+// it is missing the server starts without a frontend.
+const defaultFrontendDir = "../frontend"
+
+func defaultConfig() Config {
+	return Config{
+		Addr:              ":8080",
+		FrontendDir:       defaultFrontendDir,
+		MaxEvents:         defaultMaxEvents,
+		Fsync:             syncAlways,
+		IdempotencyWindow: defaultIdempotencyWindow,
+		ShutdownDelay:     defaultShutdownDelay,
+		DrainTimeout:      defaultDrainTimeout,
+		Conn:              defaultConnOptions(),
+	}
+}
+
+// setting is one configurable value. key names it in a config file; the
+// environment variable is EVENTFEED_ followed by the upper-cased key and
+// the flag is the key with dashes. Secrets are not accepted as flags,
+// which other users could read from the process list, and boolean flags
+// may be given without a value.
+type setting struct {
+	key    string
+	usage  string
+	secret bool
+	isBool bool
+	set    func(c *Config, s string) error
+}
+
+func (s setting) env() string { return "EVENTFEED_" + strings.ToUpper(s.key) }
+
+func (s setting) flag() string { return strings.ReplaceAll(s.key, "_", "-") }
+
+var settings = []setting{
+	{key: "addr", usage: "address to listen on", set: func(c *Config, s string) error {
+		c.Addr = s
+		return nil
+	}},
+	{key: "frontend_dir", usage: "directory of the static frontend; empty serves none", set: func(c *Config, s string) error {
+		c.FrontendDir = s
+		return nil
+	}},
+	intSetting("max_events", "events kept in each tenant's history", func(c *Config) *int { return &c.MaxEvents }),
+	{key: "data_dir", usage: "directory to persist history in; empty keeps it in memory", set: func(c *Config, s string) error {
+		c.DataDir = s
+		return nil
+	}},
+	{key: "fsync", usage: "when to sync the event store: always, interval or never", set: func(c *Config, s string) (err error) {
+		c.Fsync, err = parseSyncPolicy(s)
+		return err
+	}},
+	{key: "token_secret", usage: "secret that tenant tokens are signed with", secret: true, set: func(c *Config, s string) error {
+		c.TokenSecret = s
+		return nil
+	}},
+	boolSetting("insecure_no_auth", "run without token_secret, trusting client-supplied tenant IDs; local development only", func(c *Config) *bool { return &c.InsecureNoAuth }),
+	{key: "rate_limit", usage: `publish limit for every tenant as "rate:burst"`, set: func(c *Config, s string) (err error) {
+		c.RateLimits.Default, err = parseRateLimit(s)
+		return err
+	}},
+	{key: "tenant_rate_limits", usage: `per-tenant publish limits as "tenant=rate:burst,..."`, set: func(c *Config, s string) (err error) {
+		c.RateLimits.Tenants, err = parseTenantRateLimits(s)
+		return err
+	}},
+	durationSetting("idempotency_window", "how long idempotency keys are remembered", func(c *Config) *time.Duration { return &c.IdempotencyWindow }),
+	durationSetting("shutdown_delay", "how long to keep serving after readiness turns false on shutdown", func(c *Config) *time.Duration { return &c.ShutdownDelay }),
+	durationSetting("drain_timeout", "how long a graceful shutdown may take", func(c *Config) *time.Duration { return &c.DrainTimeout }),
+	{key: "tls_cert", usage: "PEM certificate file to serve HTTPS with", set: func(c *Config, s string) error {
+		c.TLSCert = s
+		return nil
+	}},
+	{key: "tls_key", usage: "PEM private key file for tls_cert", set: func(c *Config, s string) error {
+		c.TLSKey = s
+		return nil
+	}},
+	boolSetting("dev_tls", "serve HTTPS with a generated self-signed certificate, for local testing", func(c *Config) *bool { return &c.DevTLS }),
+	{key: "tls_client_ca", usage: "PEM CA bundle to verify client certificates against", set: func(c *Config, s string) error {
+		c.TLSClientCA = s
+		return nil
+	}},
+	{key: "tls_client_tenants", usage: `client certificate common names to tenants as "name=tenant,..."`, set: func(c *Config, s string) (err error) {
+		c.TLSClientTenants, err = parseClientTenants(s)
+		return err
+	}},
+	intSetting("metrics_tenants", "tenants labelled individually in /metrics; needs metrics_token", func(c *Config) *int { return &c.MetricsTenants }),
+	{key: "metrics_token", usage: "bearer token required to read /metrics", secret: true, set: func(c *Config, s string) error {
+		c.MetricsToken = s
+		return nil
+	}},
+	intSetting("queue_size", "messages queued per connection", func(c *Config) *int { return &c.Conn.QueueSize }),
+	{key: "overflow_policy", usage: "what to do when a queue is full: disconnect, drop-oldest or drop-newest", set: func(c *Config, s string) (err error) {
+		c.Conn.Overflow, err = parseOverflowPolicy(s)
+		return err
+	}},
+	intSetting("slow_close_code", "close code for slow consumers, 1008 or 1013", func(c *Config) *int { return &c.Conn.SlowCloseCode }),
+	intSetting("max_message_size", "largest client message in bytes", func(c *Config) *int { return &c.Conn.MaxMessageSize }),
+	durationSetting("ping_interval", "interval between WebSocket pings; 0 disables heartbeats", func(c *Config) *time.Duration { return &c.Conn.PingInterval }),
+	durationSetting("pong_timeout", "how long past a ping a peer may stay silent", func(c *Config) *time.Duration { return &c.Conn.PongTimeout }),
+	durationSetting("write_timeout", "deadline for each WebSocket frame or SSE write; 0 disables it", func(c *Config) *time.Duration { return &c.Conn.WriteTimeout }),
+	boolSetting("compression", "negotiate permessage-deflate", func(c *Config) *bool { return &c.Conn.Compression }),
+	intSetting("compression_threshold", "smallest message in bytes worth compressing", func(c *Config) *int { return &c.Conn.CompressionThreshold }),
+	boolSetting("compression_context_takeover", "keep the compression context across messages", func(c *Config) *bool { return &c.Conn.CompressionContextTakeover }),
+}
+
+func intSetting(key, usage string, field func(*Config) *int) setting {
+	return setting{key: key, usage: usage, set: func(c *Config, s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("not an integer: %q", s)
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func durationSetting(key, usage string, field func(*Config) *time.Duration) setting {
+	return setting{key: key, usage: usage, set: func(c *Config, s string) error {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("not a duration: %q", s)
+		}
+		*field(c) = d
+		return nil
+	}}
+}
+
+func boolSetting(key, usage string, field func(*Config) *bool) setting {
+	return setting{key: key, usage: usage, isBool: true, set: func(c *Config, s string) error {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("not a boolean: %q", s)
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+func lookupSetting(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// loadConfig builds the configuration from args, the environment as seen
+// through lookupEnv and the config file named by -config or
+// EVENTFEED_CONFIG, and validates it. A variable that is set but empty
+// still overrides the file and the defaults.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("eventfeed", flag.ContinueOnError)
+	configPath, _ := lookupEnv("EVENTFEED_CONFIG")
+	path := fs.String("config", configPath, "JSON or TOML config file")
+	type flagValue struct {
+		s     setting
+		value string
+	}
+	var flags []flagValue
+	for _, s := range settings {
+		if s.secret {
+			continue
+		}
+		s := s
+		record := func(v string) error {
+			// parsed now for the error message, applied after file and environment
+			if err := s.set(&Config{}, v); err != nil {
+				return err
+			}
+			flags = append(flags, flagValue{s, v})
+			return nil
+		}
+		if s.isBool {
+			fs.BoolFunc(s.flag(), s.usage, record)
+		} else {
+			fs.Func(s.flag(), s.usage, record)
+		}
+	}
+	// errors are returned to the caller; only -h prints the usage
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fs.SetOutput(os.Stderr)
+			fs.Usage()
+		}
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if *path != "" {
+		values, err := readConfigFile(*path)
+		if err != nil {
+			return cfg, err
+		}
+		for _, kv := range values {
+			where := *path
+			if kv.line > 0 {
+				where = fmt.Sprintf("%s:%d", *path, kv.line)
+			}
+			s, ok := lookupSetting(kv.key)
+			if !ok {
+				return cfg, fmt.Errorf("%s: unknown setting %q", where, kv.key)
+			}
+			if err := s.set(&cfg, kv.value); err != nil {
+				return cfg, fmt.Errorf("%s: %s: %v", where, kv.key, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := lookupEnv(s.env()); ok {
+			if err := s.set(&cfg, v); err != nil {
+				return cfg, fmt.Errorf("%s: %v", s.env(), err)
+			}
+		}
+	}
+	for _, f := range flags {
+		f.s.set(&cfg, f.value)
+	}
+	if cfg.FrontendDir == defaultFrontendDir {
+		if fi, err := os.Stat(cfg.FrontendDir); err != nil || !fi.IsDir() {
+			log.Printf("warning: frontend_dir %q not found, serving no frontend", cfg.FrontendDir)
+			cfg.FrontendDir = ""
+		}
+	}
+	return cfg, cfg.validate()
+}
+
+// validate checks the ranges and combinations parsing cannot
+func (c Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Addr != "", "addr must not be empty")
+	check(c.TokenSecret != "" || c.InsecureNoAuth, "token_secret is required; set insecure_no_auth to run without authentication")
+	if c.FrontendDir != "" {
+		fi, err := os.Stat(c.FrontendDir)
+		check(err == nil && fi.IsDir(), "frontend_dir %q is not a directory", c.FrontendDir)
+	}
+	check(c.MaxEvents >= 1, "max_events must be at least 1, got %d", c.MaxEvents)
+	check(c.IdempotencyWindow >= 0, "idempotency_window must not be negative")
+	check(c.ShutdownDelay >= 0, "shutdown_delay must not be negative")
+	check(c.DrainTimeout > 0, "drain_timeout must be positive")
+	check(c.MetricsTenants >= 0, "metrics_tenants must not be negative")
+	check(c.MetricsTenants == 0 || c.MetricsToken != "", "metrics_tenants needs metrics_token")
+	check(c.Conn.QueueSize >= 1, "queue_size must be at least 1, got %d", c.Conn.QueueSize)
+	check(c.Conn.SlowCloseCode == closePolicyViolation || c.Conn.SlowCloseCode == closeTryAgainLater,
+		"slow_close_code must be 1008 or 1013, got %d", c.Conn.SlowCloseCode)
+	check(c.Conn.MaxMessageSize >= 1, "max_message_size must be at least 1, got %d", c.Conn.MaxMessageSize)
+	check(c.Conn.PingInterval >= 0 && c.Conn.PongTimeout >= 0 && c.Conn.WriteTimeout >= 0,
+		"ping_interval, pong_timeout and write_timeout must not be negative")
+	check(c.Conn.CompressionThreshold >= 0, "compression_threshold must not be negative")
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls_cert and tls_key must be set together")
+	check(!c.DevTLS || c.TLSCert == "", "dev_tls cannot be combined with tls_cert")
+	check(c.TLSClientCA == "" || c.TLSCert != "" || c.DevTLS, "tls_client_ca needs tls_cert or dev_tls")
+	check(len(c.TLSClientTenants) == 0 || c.TLSClientCA != "", "tls_client_tenants needs tls_client_ca")
+	return errors.Join(errs...)
+}
+
+// configValue is one key = value pair read from a config file; line is
+// zero for JSON files
+type configValue struct {
+	key, value string
+	line       int
+}
+
+// readConfigFile reads a JSON object or a TOML subset: top-level
+// key = value lines with string, integer, float or boolean values and #
+// comments. Either way every value is handed to its setting as text.
+func readConfigFile(path string) ([]configValue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values []configValue
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		values, err = parseJSONConfig(trimmed)
+	} else {
+		values, err = parseTOMLConfig(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+func parseJSONConfig(data []byte) ([]configValue, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	values := make([]configValue, 0, len(obj))
+	for key, raw := range obj {
+		v := configValue{key: key}
+		var s string
+		switch {
+		case json.Unmarshal(raw, &s) == nil:
+			v.value = s
+		case len(raw) > 0 && raw[0] != '{' && raw[0] != '[' && string(raw) != "null":
+			v.value = string(raw) // number or boolean
+		default:
+			return nil, fmt.Errorf("%s: value must be a string, number or boolean", key)
+		}
+		values = append(values, v)
+	}
+	// map order is random; sort so errors are reported the same every time
+	sort.Slice(values, func(i, j int) bool { return values[i].key < values[j].key })
+	return values, nil
+}
+
+func parseTOMLConfig(data []byte) ([]configValue, error) {
+	var values []configValue
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		key, raw = strings.TrimSpace(key), strings.TrimSpace(raw)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("line %d: %s set twice", n, key)
+		}
+		seen[key] = true
+		value, err := tomlValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		values = append(values, configValue{key: key, value: value, line: n})
+	}
+	return values, sc.Err()
+}
+
+// tomlValue decodes a basic or literal string, or returns a bare number
+// or boolean as written, without the underscores a number may use as
+// digit separators. A trailing # comment is dropped.
+func tomlValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		for i := 1; i < len(raw); i++ {
+			if raw[i] == '\\' {
+				i++
+				continue
+			}
+			if raw[i] == '"' {
+				if err := tomlTrailer(raw[i+1:]); err != nil {
+					return "", err
+				}
+				return strconv.Unquote(raw[:i+1])
+			}
+		}
+		return "", errors.New("unterminated string")
+	case strings.HasPrefix(raw, "'"):
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", errors.New("unterminated string")
+		}
+		return raw[1 : end+1], tomlTrailer(raw[end+2:])
+	}
+	if i := strings.IndexByte(raw, '#'); i >= 0 {
+		raw = strings.TrimSpace(raw[:i])
+	}
+	if raw == "" || strings.ContainsAny(raw, "[]{}\"' ") {
+		return "", fmt.Errorf("unsupported value %q", raw)
+	}
+	if n := strings.ReplaceAll(raw, "_", ""); n != raw {
+		if _, err := strconv.ParseFloat(n, 64); err == nil {
+			return n, nil
+		}
+	}
+	return raw, nil
+}
+
+// tomlTrailer accepts only a comment after a quoted value
+func tomlTrailer(s string) error {
+	s = strings.TrimSpace(s)
+	if s != "" && s[0] != '#' {
+		return fmt.Errorf("unexpected %q after value", s)
+	}
+	return nil
+}
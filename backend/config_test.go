@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func envMap(env map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "eventfeed.toml", `
+# deployment defaults
+addr = ":9000"
+max_events = 500
+queue_size = 64 # per connection
+drain_timeout = "30s"
+overflow_policy = 'drop-oldest'
+compression = true
+`)
+	env := map[string]string{
+		"EVENTFEED_CONFIG":       path,
+		"EVENTFEED_MAX_EVENTS":   "200",
+		"EVENTFEED_RATE_LIMIT":   "5:10",
+		"EVENTFEED_TOKEN_SECRET": "s3cret",
+	}
+	cfg, err := loadConfig([]string{"-max-events", "50", "-frontend-dir", t.TempDir()}, envMap(env))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Addr != ":9000" || cfg.Conn.QueueSize != 64 || cfg.DrainTimeout != 30*time.Second ||
+		cfg.Conn.Overflow != dropOldest || !cfg.Conn.Compression {
+		t.Fatalf("file settings not applied: %+v", cfg)
+	}
+	if cfg.MaxEvents != 50 {
+		t.Fatalf("flag should win over env and file, got max_events %d", cfg.MaxEvents)
+	}
+	if cfg.RateLimits.Default != (rateLimit{Rate: 5, Burst: 10}) || cfg.TokenSecret != "s3cret" {
+		t.Fatalf("env setting not applied: %+v", cfg.RateLimits)
+	}
+	if cfg.IdempotencyWindow != defaultIdempotencyWindow || cfg.ShutdownDelay != defaultShutdownDelay ||
+		cfg.Conn.PingInterval != defaultConnOptions().PingInterval {
+		t.Fatalf("unset settings should keep their defaults: %+v", cfg)
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	path := writeConfigFile(t, "eventfeed.json", `{"addr": "127.0.0.1:8081", "max_events": 10, "fsync": "never", "compression": false, "insecure_no_auth": true}`)
+	cfg, err := loadConfig([]string{"-config", path, "-frontend-dir", ""}, envMap(nil))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.Addr != "127.0.0.1:8081" || cfg.MaxEvents != 10 || cfg.Fsync != syncNever {
+		t.Fatalf("json settings not applied: %+v", cfg)
+	}
+}
+
+func TestLoadConfigEmptyValues(t *testing.T) {
+	path := writeConfigFile(t, "eventfeed.toml", "frontend_dir = \"/srv/frontend\"\nmax_events = 1_000\naddr = host_a:80\n")
+	env := map[string]string{"EVENTFEED_FRONTEND_DIR": "", "EVENTFEED_INSECURE_NO_AUTH": "true"}
+	cfg, err := loadConfig([]string{"-config", path}, envMap(env))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.FrontendDir != "" {
+		t.Fatalf("an empty env value should override the file, got %q", cfg.FrontendDir)
+	}
+	if cfg.MaxEvents != 1000 || cfg.Addr != "host_a:80" {
+		t.Fatalf("underscores should only be dropped from numbers: %+v", cfg)
+	}
+
+	// the default frontend is optional
+	t.Chdir(t.TempDir())
+	cfg, err = loadConfig([]string{"-insecure-no-auth"}, envMap(nil))
+	if err != nil || cfg.FrontendDir != "" {
+		t.Fatalf("missing default frontend: %q %v", cfg.FrontendDir, err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+		want string
+	}{
+		{name: "no secret", want: "token_secret is required"},
+		{name: "bad flag value", args: []string{"-max-events", "many"}, want: "not an integer"},
+		{name: "secret flag", args: []string{"-token-secret", "s"}, want: "not defined"},
+		{name: "bad env", env: map[string]string{"EVENTFEED_PING_INTERVAL": "soon"}, want: "EVENTFEED_PING_INTERVAL"},
+		{name: "out of range", args: []string{"-max-events", "0"}, want: "max_events must be at least 1"},
+		{name: "close code", env: map[string]string{"EVENTFEED_SLOW_CLOSE_CODE": "1000"}, want: "1008 or 1013"},
+		{name: "frontend", args: []string{"-frontend-dir", "/does/not/exist"}, want: "frontend_dir"},
+		{name: "cert without key", args: []string{"-tls-cert", "tls.crt"}, want: "set together"},
+		{name: "client ca without tls", args: []string{"-tls-client-ca", "ca.pem"}, want: "needs tls_cert or dev_tls"},
+		{name: "bad tenant mapping", args: []string{"-tls-client-tenants", "svc-a"}, want: "invalid client tenant mapping"},
+		{name: "tenant labels without token", args: []string{"-metrics-tenants", "5"}, want: "metrics_tenants needs metrics_token"},
+		{name: "unknown key", file: "addr = \":1\"\nlisten = \":2\"\n", want: `:2: unknown setting "listen"`},
+		{name: "table", file: "[server]\naddr = \":1\"\n", want: "line 1: expected key = value"},
+		{name: "array", file: "addr = [1]\n", want: "unsupported value"},
+		{name: "duplicate", file: "addr = \":1\"\naddr = \":2\"\n", want: "set twice"},
+		{name: "json nested", file: `{"addr": {"host": "x"}}`, want: "must be a string"},
+	}
+	for _, tc := range cases {
+		args := tc.args
+		if tc.file != "" {
+			args = append([]string{"-config", writeConfigFile(t, "config", tc.file)}, args...)
+		}
+		_, err := loadConfig(args, envMap(tc.env))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestConfigSizesHistory(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxEvents = 3
+	hub := newEventHub(cfg)
+	for i := 0; i < 5; i++ {
+		hub.postEvent("t1", "msg")
+	}
+	if events, _, _ := hub.history("t1", historyQuery{}); len(events) != 3 || events[0].Seq != 3 {
+		t.Fatalf("expected the last 3 events, got %+v", events)
+	}
+}
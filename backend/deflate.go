@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// deflateTail is the empty stored block that ends every flushed deflate
+// stream; RFC 7692 strips it from messages and the receiver restores it
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// deflateFinal is an empty final stored block. The inflater appends it
+// after deflateTail so that a complete message ends the stream cleanly
+// and running out of input means the message was cut short.
+var deflateFinal = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// maxWindow is the LZ77 window of compress/flate in bytes (2^15)
+const maxWindow = 1 << 15
+
+// deflateParams are the negotiated permessage-deflate parameters
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	// serverMaxWindowBits echoes a server_max_window_bits offer, which
+	// RFC 7692 requires the response to carry
+	serverMaxWindowBits bool
+}
+
+// String renders the Sec-WebSocket-Extensions response value
+func (p deflateParams) String() string {
+	s := "permessage-deflate"
+	if p.serverNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if p.clientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	if p.serverMaxWindowBits {
+		s += "; server_max_window_bits=15"
+	}
+	return s
+}
+
+// negotiateDeflate picks the first permessage-deflate offer in the request
+// that the server can honour. compress/flate always uses a 32 KiB window,
+// so offers limiting server_max_window_bits below 15 are declined; any
+// client window fits the inflater. The server drops its compression
+// context after every message unless contextTakeover is set.
+func negotiateDeflate(h http.Header, contextTakeover bool) *deflateParams {
+	for _, offer := range parseExtensions(h) {
+		if offer.name != "permessage-deflate" {
+			continue
+		}
+		if p, ok := acceptDeflateOffer(offer.params, contextTakeover); ok {
+			return p
+		}
+	}
+	return nil
+}
+
+func acceptDeflateOffer(params map[string]string, contextTakeover bool) (*deflateParams, bool) {
+	p := &deflateParams{serverNoContextTakeover: !contextTakeover}
+	for name, value := range params {
+		switch name {
+		case "server_no_context_takeover":
+			if value != "" {
+				return nil, false
+			}
+			p.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			if value != "" {
+				return nil, false
+			}
+			p.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			if bits, ok := windowBits(value); !ok || bits < 15 {
+				return nil, false
+			}
+			p.serverMaxWindowBits = true
+		case "client_max_window_bits":
+			if _, ok := windowBits(value); value != "" && !ok {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	return p, true
+}
+
+func windowBits(s string) (int, bool) {
+	n, err := strconv.Atoi(s)
+	return n, err == nil && n >= 8 && n <= 15
+}
+
+// extensionOffer is one element of a Sec-WebSocket-Extensions header
+type extensionOffer struct {
+	name   string
+	params map[string]string
+}
+
+// parseExtensions splits the Sec-WebSocket-Extensions headers into offers.
+// An offer repeating a parameter is dropped, as RFC 7692 requires it to be
+// declined.
+func parseExtensions(h http.Header) []extensionOffer {
+	var offers []extensionOffer
+	for _, v := range h.Values("Sec-WebSocket-Extensions") {
+	next:
+		for _, ext := range strings.Split(v, ",") {
+			parts := strings.Split(ext, ";")
+			offer := extensionOffer{
+				name:   strings.ToLower(strings.TrimSpace(parts[0])),
+				params: make(map[string]string),
+			}
+			for _, p := range parts[1:] {
+				name, value, _ := strings.Cut(p, "=")
+				name = strings.ToLower(strings.TrimSpace(name))
+				if _, dup := offer.params[name]; dup {
+					continue next
+				}
+				offer.params[name] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+			offers = append(offers, offer)
+		}
+	}
+	return offers
+}
+
+// flateWriters pools compressors for connections that reset their context
+// after every message, so idle connections do not each hold one
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// deflater compresses outgoing messages for one connection. It is only
+// used by the connection's writer goroutine.
+type deflater struct {
+	contextTakeover bool
+	fw              *flate.Writer
+	buf             bytes.Buffer
+}
+
+func newDeflater(contextTakeover bool) *deflater {
+	d := &deflater{contextTakeover: contextTakeover}
+	if contextTakeover {
+		d.fw, _ = flate.NewWriter(&d.buf, flate.BestSpeed)
+	}
+	return d
+}
+
+// compress returns the message payload for p with the trailing empty
+// block removed
+func (d *deflater) compress(p []byte) ([]byte, error) {
+	d.buf.Reset()
+	fw := d.fw
+	if !d.contextTakeover {
+		fw = flateWriters.Get().(*flate.Writer)
+		fw.Reset(&d.buf)
+		defer flateWriters.Put(fw)
+	}
+	if _, err := fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	out := bytes.TrimSuffix(d.buf.Bytes(), deflateTail)
+	if len(out) == 0 {
+		out = []byte{0x00}
+	}
+	return append([]byte(nil), out...), nil
+}
+
+// inflater decompresses incoming messages for one connection, keeping the
+// last window of output as the dictionary when the client reuses its
+// context
+type inflater struct {
+	contextTakeover bool
+	fr              io.ReadCloser
+	dict            []byte
+}
+
+func newInflater(contextTakeover bool) *inflater {
+	return &inflater{contextTakeover: contextTakeover}
+}
+
+// decompress inflates p, failing once the output would exceed limit or
+// with 1007 when p is not valid deflate data
+func (f *inflater) decompress(p []byte, limit int) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail), bytes.NewReader(deflateFinal))
+	if f.fr == nil {
+		f.fr = flate.NewReaderDict(src, f.dict)
+	} else if err := f.fr.(flate.Resetter).Reset(src, f.dict); err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(f.fr, int64(limit)+1))
+	if err != nil {
+		return nil, &closeError{code: closeInvalidPayload, reason: "invalid compressed payload"}
+	}
+	if len(out) > limit {
+		return nil, &closeError{code: closeMessageTooBig, reason: "message too big"}
+	}
+	if f.contextTakeover {
+		f.dict = append(f.dict, out...)
+		if len(f.dict) > maxWindow {
+			f.dict = append(f.dict[:0], f.dict[len(f.dict)-maxWindow:]...)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiateDeflate(t *testing.T) {
+	cases := []struct {
+		name            string
+		offer           string
+		contextTakeover bool
+		want            string
+	}{
+		{"none", "", true, ""},
+		{"other extension", "x-webkit-deflate-frame", true, ""},
+		{"plain", "permessage-deflate", true, "permessage-deflate"},
+		{"no takeover by default", "permessage-deflate", false, "permessage-deflate; server_no_context_takeover"},
+		{"client window bits", "permessage-deflate; client_max_window_bits", true, "permessage-deflate"},
+		{"client no takeover", "permessage-deflate; client_no_context_takeover", true, "permessage-deflate; client_no_context_takeover"},
+		{"server no takeover", "permessage-deflate; server_no_context_takeover", true, "permessage-deflate; server_no_context_takeover"},
+		{"small server window", "permessage-deflate; server_max_window_bits=10", true, ""},
+		{"fallback offer", "permessage-deflate; server_max_window_bits=10, permessage-deflate", true, "permessage-deflate"},
+		{"full server window without takeover", "permessage-deflate; server_max_window_bits=15", false, "permessage-deflate; server_no_context_takeover; server_max_window_bits=15"},
+		{"full server window", `permessage-deflate; server_max_window_bits="15"`, true, "permessage-deflate; server_max_window_bits=15"},
+		{"unknown param", "permessage-deflate; foo=1", true, ""},
+		{"duplicate param", "permessage-deflate; client_no_context_takeover; client_no_context_takeover", true, ""},
+		{"bad window", "permessage-deflate; client_max_window_bits=99", true, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			if tc.offer != "" {
+				h.Set("Sec-WebSocket-Extensions", tc.offer)
+			}
+			got := ""
+			if p := negotiateDeflate(h, tc.contextTakeover); p != nil {
+				got = p.String()
+			}
+			if got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	for _, takeover := range []bool{true, false} {
+		d := newDeflater(takeover)
+		f := newInflater(takeover)
+		for i, msg := range []string{
+			strings.Repeat(`{"message":"hello"}`, 50),
+			strings.Repeat(`{"message":"hello"}`, 50),
+			"",
+		} {
+			p, err := d.compress([]byte(msg))
+			if err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+			if bytes.HasSuffix(p, deflateTail) {
+				t.Fatalf("tail not stripped")
+			}
+			out, err := f.decompress(p, 1<<20)
+			if err != nil {
+				t.Fatalf("takeover=%v message %d: %v", takeover, i, err)
+			}
+			if string(out) != msg {
+				t.Fatalf("takeover=%v message %d: got %q", takeover, i, out)
+			}
+		}
+	}
+}
+
+func TestInflateLimit(t *testing.T) {
+	p, _ := newDeflater(false).compress(bytes.Repeat([]byte("a"), 4096))
+	_, err := newInflater(false).decompress(p, 1024)
+	var ce *closeError
+	if !errors.As(err, &ce) || ce.code != closeMessageTooBig {
+		t.Fatalf("expected 1009, got %v", err)
+	}
+}
+
+func TestInflateInvalid(t *testing.T) {
+	// a final block of the reserved type 3
+	_, err := newInflater(false).decompress([]byte{0xff, 0xff, 0xff}, 1024)
+	var ce *closeError
+	if !errors.As(err, &ce) || ce.code != closeInvalidPayload || ce.reason != "invalid compressed payload" {
+		t.Fatalf("expected 1007, got %v", err)
+	}
+
+	msg := strings.Repeat(`{"message":"hello"}`, 50)
+	p, _ := newDeflater(false).compress([]byte(msg))
+	for name, payload := range map[string][]byte{
+		"truncated": p[:len(p)/2],
+		// a stored block whose length and its complement disagree
+		"corrupt": {0x00, 0x05, 0x00, 0x00, 0x00},
+	} {
+		out, err := newInflater(false).decompress(payload, 1<<20)
+		if !errors.As(err, &ce) || ce.code != closeInvalidPayload {
+			t.Fatalf("%s payload: expected 1007, got %q, %v", name, out, err)
+		}
+	}
+}
+
+// inflateMessage decompresses a server message the way a client would
+func inflateMessage(t *testing.T, p []byte) string {
+	t.Helper()
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail)))
+	out, err := io.ReadAll(r)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		t.Fatalf("inflate: %v", err)
+	}
+	return string(out)
+}
+
+// readRawFrame returns the first header byte and payload of a server frame
+func readRawFrame(t *testing.T, c net.Conn) (byte, []byte) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	var b0 [1]byte
+	if _, err := io.ReadFull(c, b0[:]); err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	opcode, payload, err := readFrame(io.MultiReader(bytes.NewReader([]byte{b0[0] & 0x8F}), c))
+	if err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	return b0[0]&0xF0 | opcode, payload
+}
+
+func TestCompressedWebsocket(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	opts := defaultConnOptions()
+	opts.CompressionThreshold = 64
+	ws := newWSConn(server, nil, opts, &deflateParams{})
+	go ws.readLoop("tenant1", func() {})
+
+	big := strings.Repeat("x", 200)
+	ws.WriteJSON(map[string]string{"message": big})
+	b0, payload := readRawFrame(t, client)
+	if b0&rsv1 == 0 {
+		t.Fatalf("expected RSV1 on a large message")
+	}
+	if got := inflateMessage(t, payload); !strings.Contains(got, big) {
+		t.Fatalf("unexpected message %q", got)
+	}
+
+	ws.WriteJSON(map[string]string{"message": "hi"})
+	b0, payload = readRawFrame(t, client)
+	if b0&rsv1 != 0 || string(payload) != `{"message":"hi"}` {
+		t.Fatalf("small message should be sent uncompressed, got %#x %q", b0, payload)
+	}
+
+	// a compressed text message from the client is accepted
+	p, _ := newDeflater(false).compress([]byte("hello"))
+	writeCompressedFrame(client, p)
+	// an uncompressed close completes the handshake
+	writeClientFrame(client, true, opClose, closePayload(closeNormal, ""), true)
+	b0, payload = readRawFrame(t, client)
+	if b0&0x0F != opClose || b0&rsv1 != 0 {
+		t.Fatalf("expected uncompressed close, got %#x %q", b0, payload)
+	}
+	if code, _, _ := parseClose(payload); code != closeNormal {
+		t.Fatalf("expected 1000, got %d", code)
+	}
+}
+
+func TestCompressedFrameWithoutExtension(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ws := newWSConn(server, nil, defaultConnOptions(), nil)
+	go ws.readLoop("tenant1", func() {})
+
+	p, _ := newDeflater(false).compress([]byte("hello"))
+	writeCompressedFrame(client, p)
+	b0, payload := readRawFrame(t, client)
+	if b0&0x0F != opClose {
+		t.Fatalf("expected close, got %#x", b0)
+	}
+	if code, _, _ := parseClose(payload); code != closeProtocolError {
+		t.Fatalf("expected 1002, got %d", code)
+	}
+}
+
+func TestServeWSNegotiatesDeflate(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		opts := defaultConnOptions()
+		opts.Compression = enabled
+		srv := httptest.NewServer(serveWS(newEventHub(defaultConfig()), newAuthenticator(nil), opts))
+		host := strings.TrimPrefix(srv.URL, "http://")
+		conn, err := net.Dial("tcp", host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := "GET /?tenant=t1 HTTP/1.1\r\nHost: " + host + "\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+			"Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n\r\n"
+		conn.Write([]byte(req))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := resp.Header.Get("Sec-WebSocket-Extensions")
+		if enabled && got != "permessage-deflate; server_no_context_takeover" {
+			t.Fatalf("unexpected extension response %q", got)
+		}
+		if !enabled && got != "" {
+			t.Fatalf("compression disabled but negotiated %q", got)
+		}
+		conn.Close()
+		srv.Close()
+	}
+}
+
+// writeCompressedFrame sends a masked text frame with RSV1 set
+func writeCompressedFrame(w io.Writer, payload []byte) {
+	var buf bytes.Buffer
+	writeClientFrame(&buf, true, opText, payload, true)
+	frame := buf.Bytes()
+	frame[0] |= rsv1
+	w.Write(frame)
+}
@@ -1,19 +1,104 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"log"
 	"time"
 )
 
-// Event represents a single event message
+// Limits on the structured fields of a published event
+const (
+	maxAttributeLength = 256
+	maxDataSize        = 64 << 10
+	maxMetadataEntries = 32
+	maxMetadataKey     = 64
+	maxMetadataValue   = 1024
+)
+
+// Event represents a single event message. Seq numbers a tenant's events
+// from 1 in the order every subscriber receives them; PrevSeq, set only on
+// delivery, is the seq of the event sent before it on the same connection.
+// Type, Source and Subject describe what happened and where; Data is an
+// arbitrary JSON object kept exactly as published and Metadata holds
+// string headers.
 type Event struct {
-	ID        string    `json:"id"`
-	TenantID  string    `json:"tenant_id"`
-	Message   string    `json:"message"`
-	Timestamp time.Time `json:"timestamp"`
-	Elapsed   string    `json:"elapsed"`
+	ID        string            `json:"id"`
+	Seq       uint64            `json:"seq"`
+	PrevSeq   uint64            `json:"prev_seq,omitempty"`
+	TenantID  string            `json:"tenant_id"`
+	Topic     string            `json:"topic,omitempty"`
+	Type      string            `json:"type,omitempty"`
+	Source    string            `json:"source,omitempty"`
+	Subject   string            `json:"subject,omitempty"`
+	Message   string            `json:"message"`
+	Data      json.RawMessage   `json:"data,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	Elapsed   string            `json:"elapsed"`
+}
+
+// eventRequest is the body of a publish. Only message is required to be
+// present, so clients that send nothing else keep working.
+type eventRequest struct {
+	Topic    string            `json:"topic"`
+	Type     string            `json:"type"`
+	Source   string            `json:"source"`
+	Subject  string            `json:"subject"`
+	Message  string            `json:"message"`
+	Data     json.RawMessage   `json:"data"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// validate checks the request against the event limits
+func (r *eventRequest) validate() error {
+	if !validTopic(r.Topic) {
+		return errInvalidTopic
+	}
+	for _, a := range []struct{ name, value string }{
+		{"type", r.Type}, {"source", r.Source}, {"subject", r.Subject},
+	} {
+		if len(a.value) > maxAttributeLength {
+			return fmt.Errorf("%s longer than %d bytes", a.name, maxAttributeLength)
+		}
+	}
+	if len(r.Data) > maxDataSize {
+		return fmt.Errorf("data larger than %d bytes", maxDataSize)
+	}
+	if d := bytes.TrimSpace(r.Data); len(d) > 0 && !bytes.Equal(d, []byte("null")) && d[0] != '{' {
+		return fmt.Errorf("data must be a JSON object")
+	}
+	if len(r.Metadata) > maxMetadataEntries {
+		return fmt.Errorf("more than %d metadata entries", maxMetadataEntries)
+	}
+	for k, v := range r.Metadata {
+		if k == "" || len(k) > maxMetadataKey {
+			return fmt.Errorf("metadata keys must be 1-%d bytes", maxMetadataKey)
+		}
+		if len(v) > maxMetadataValue {
+			return fmt.Errorf("metadata %q longer than %d bytes", k, maxMetadataValue)
+		}
+	}
+	return nil
+}
+
+// event builds the event to store for tenantID from the request
+func (r *eventRequest) event(tenantID string) Event {
+	e := newEvent(tenantID, r.Message)
+	e.Topic = r.Topic
+	e.Type = r.Type
+	e.Source = r.Source
+	e.Subject = r.Subject
+	if d := bytes.TrimSpace(r.Data); len(d) > 0 && !bytes.Equal(d, []byte("null")) {
+		e.Data = r.Data
+	}
+	if len(r.Metadata) > 0 {
+		e.Metadata = r.Metadata
+	}
+	return e
 }
 
 // newEvent creates a new event with generated ID and current timestamp
@@ -22,7 +107,7 @@ func newEvent(tenantID, message string) Event {
 		ID:        generateID(),
 		TenantID:  tenantID,
 		Message:   message,
-		Timestamp: time.Now().UTC().Truncate(time.Second),
+		Timestamp: time.Now().UTC(),
 	}
 }
 
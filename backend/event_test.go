@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventRequestValidate(t *testing.T) {
+	long := strings.Repeat("x", maxAttributeLength+1)
+	manyMeta := make(map[string]string)
+	for i := 0; i <= maxMetadataEntries; i++ {
+		manyMeta[fmt.Sprintf("k%d", i)] = "v"
+	}
+	cases := []struct {
+		name string
+		req  eventRequest
+		ok   bool
+	}{
+		{"message only", eventRequest{Message: "hi"}, true},
+		{"full", eventRequest{Type: "order.created", Source: "/shop", Subject: "17", Data: json.RawMessage(`{"a":1}`), Metadata: map[string]string{"trace": "abc"}}, true},
+		{"null data", eventRequest{Data: json.RawMessage(`null`)}, true},
+		{"long type", eventRequest{Type: long}, false},
+		{"long source", eventRequest{Source: long}, false},
+		{"long subject", eventRequest{Subject: long}, false},
+		{"array data", eventRequest{Data: json.RawMessage(`[1,2]`)}, false},
+		{"string data", eventRequest{Data: json.RawMessage(`"x"`)}, false},
+		{"large data", eventRequest{Data: json.RawMessage(`{"a":"` + strings.Repeat("x", maxDataSize) + `"}`)}, false},
+		{"many metadata", eventRequest{Metadata: manyMeta}, false},
+		{"empty metadata key", eventRequest{Metadata: map[string]string{"": "v"}}, false},
+		{"long metadata value", eventRequest{Metadata: map[string]string{"k": strings.Repeat("x", maxMetadataValue+1)}}, false},
+		{"wildcard topic", eventRequest{Topic: "orders.*"}, false},
+	}
+	for _, tc := range cases {
+		if err := tc.req.validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestStructuredEvents(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openFileStore(dir, syncAlways, 0)
+	hub, _ := openEventHub(defaultConfig(), store)
+	srv := httptest.NewServer(newServer(defaultConfig(), hub, newAuthenticator(nil)))
+	defer srv.Close()
+	client := srv.Client()
+
+	filter := url.QueryEscape(`data.region == "eu"`)
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA&filter=" + filter)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	post := func(body string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/events", strings.NewReader(body))
+		req.Header.Set("X-Tenant-ID", "tenantA")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	data := `{"region":"eu","items":[{"sku":"a-1","qty":2}],"total":19.5}`
+	body := `{"type":"order.created","source":"/shop","subject":"order-17","message":"new order",` +
+		`"data":` + data + `,"metadata":{"traceparent":"00-abc"}}`
+	if status, resp := post(body); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", status, resp)
+	}
+	post(`{"message":"plain"}`)
+	post(`{"message":"us","data":{"region":"us"}}`)
+
+	check := func(e Event) {
+		t.Helper()
+		if e.Type != "order.created" || e.Source != "/shop" || e.Subject != "order-17" ||
+			e.Message != "new order" || e.Metadata["traceparent"] != "00-abc" {
+			t.Fatalf("unexpected event %+v", e)
+		}
+		if string(e.Data) != data {
+			t.Fatalf("data changed: %s", e.Data)
+		}
+	}
+	var ev Event
+	if err := ws.ReadJSON(&ev, time.Second); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	check(ev)
+	if err := ws.ReadJSON(&ev, 200*time.Millisecond); err == nil {
+		t.Fatalf("filter on data.region should drop the other events, got %+v", ev)
+	}
+
+	if status, resp := post(`{"message":"x","data":[1]}`); status != http.StatusBadRequest || !strings.Contains(resp, "data must be a JSON object") {
+		t.Fatalf("expected 400 for non-object data, got %d: %s", status, resp)
+	}
+	if status, _ := post(`{"message":"` + strings.Repeat("x", maxPublishBody) + `"}`); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for oversized body, got %d", status)
+	}
+
+	store.Close()
+	store, _ = openFileStore(dir, syncAlways, 0)
+	defer store.Close()
+	hub, _ = openEventHub(defaultConfig(), store)
+	events, _, _ := hub.history("tenantA", historyQuery{Limit: 10})
+	if len(events) != 3 {
+		t.Fatalf("expected 3 stored events, got %d", len(events))
+	}
+	check(events[0])
+	if events[1].Data != nil || events[1].Metadata != nil || events[1].Type != "" {
+		t.Fatalf("plain event should have no structured fields: %+v", events[1])
+	}
+	b, _ := json.Marshal(events[1])
+	if bytes.Contains(b, []byte(`"data"`)) || bytes.Contains(b, []byte(`"type"`)) {
+		t.Fatalf("plain event should serialize as before: %s", b)
+	}
+}
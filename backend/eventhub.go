@@ -1,87 +1,536 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const maxEvents = 1000
+const defaultMaxEvents = 1000
 
 // Conn defines minimal methods for a websocket connection
 // real websocket or mock must implement this interface
 // WriteJSON should serialize v as JSON and send
 // Close closes the connection
 // in our simple implementation, only text frames with JSON will be used
-
+//
+// WriteJSON is called with the tenant lock held so that every subscriber
+// sees events in sequence order; it must queue v rather than wait on the
+// network.
 type Conn interface {
 	WriteJSON(v interface{}) error
 	Close() error
 }
 
-// TenantHub manages events and connections for a single tenant
+// goingAwayConn is implemented by connections that can tell their client
+// the server is going away. goAway sends what is already queued and then
+// the notice; the returned channel is closed once it has been written.
+type goingAwayConn interface {
+	goAway() <-chan struct{}
+}
+
+// backlogWriter is implemented by connections with a bounded send queue.
+// Replayed history is queued through it so the overflow policy meant for
+// live traffic cannot drop part of a resume.
+type backlogWriter interface {
+	writeBacklog(v interface{}) error
+}
+
+// resyncWriter is implemented by connections that bound resync replays.
+// Only one replay may be queued at a time, and it counts against the
+// send queue.
+type resyncWriter interface {
+	resyncPending() bool
+	writeResync(v interface{}) error
+}
+
+// TenantHub manages events and connections for a single tenant. Each
+// connection subscribes to one or more topic patterns, each with an
+// optional filter; subscribers indexes the connections by pattern so a
+// publish only visits matching patterns. History keeps the last maxEvents
+// events, seq is the sequence number of the latest event and schemas holds
+// the registered schema of each event type. delivered holds the seq of the
+// last event queued to each connection, sent along with the next one as
+// prev_seq so that a subscriber whose topics or filters skip events can
+// still tell a gap.
 type TenantHub struct {
+	maxEvents   int
 	events      []Event
-	connections map[Conn]bool
-	mu          sync.Mutex
+	seq         uint64
+	connections map[Conn]map[string]*filter
+	subscribers map[string]map[Conn]*filter
+	delivered   map[Conn]uint64
+	schemas     map[string]*schema
+	store       EventStore
+	bucket      tokenBucket
+	rateLimited atomic.Uint64
+	// telemetry for /metrics; fanout is shared by the hub's tenants
+	metricLabel   string
+	posted        atomic.Uint64
+	dropped       atomic.Uint64
+	writeFailures atomic.Uint64
+	fanout        *histogram
+	idempotency   idempotencyKeys
+	// closing sends new connections away once a shutdown begins
+	closing bool
+	mu      sync.Mutex
 }
 
-func newTenantHub() *TenantHub {
+func newTenantHub(maxEvents int) *TenantHub {
 	return &TenantHub{
+		maxEvents:   maxEvents,
 		events:      make([]Event, 0, maxEvents),
-		connections: make(map[Conn]bool),
+		connections: make(map[Conn]map[string]*filter),
+		subscribers: make(map[string]map[Conn]*filter),
+		delivered:   make(map[Conn]uint64),
+		schemas:     make(map[string]*schema),
+	}
+}
+
+// addEvent stores the event, broadcasts it, and returns the stored event with the Elapsed field populated.
+// When a store is attached the event is persisted first and nothing is
+// broadcast if that fails.
+func (h *TenantHub) addEvent(e Event) (Event, error) {
+	events, err := h.addEvents([]Event{e})
+	if err != nil {
+		return Event{}, err
 	}
+	return events[0], nil
 }
 
-// addEvent stores the event, broadcasts it, and returns the stored event with the Elapsed field populated
-func (h *TenantHub) addEvent(e Event) Event {
+// addEvents numbers events, stores them as one unit and queues them to
+// their subscribers in order. Everything happens under the tenant lock, so
+// sequence numbers, history and every subscriber agree on one order. The
+// events are persisted together: either all of them are stored and
+// delivered or, if the store fails, none are and no number is used up.
+func (h *TenantHub) addEvents(events []Event) ([]Event, error) {
 	start := time.Now()
 	h.mu.Lock()
-	if len(h.events) >= maxEvents {
-		h.events = h.events[1:]
+	for i := range events {
+		events[i].Seq = h.seq + uint64(i) + 1
+	}
+	if h.store != nil {
+		if err := h.store.Append(events...); err != nil {
+			h.mu.Unlock()
+			return nil, err
+		}
+	}
+	h.seq += uint64(len(events))
+	h.posted.Add(uint64(len(events)))
+	h.events = append(h.events, events...)
+	if len(h.events) > h.maxEvents {
+		h.events = h.events[len(h.events)-h.maxEvents:]
+	}
+
+	var failed []Conn
+	for _, e := range events {
+		for _, c := range h.matchingConns(e) {
+			out := e
+			out.PrevSeq = h.delivered[c]
+			h.delivered[c] = e.Seq
+			if err := c.WriteJSON(out); err != nil {
+				log.Printf("tenant %s: failed to write event: %v", e.TenantID, err)
+				h.writeFailures.Add(1)
+				h.dropConn(c)
+				failed = append(failed, c)
+			}
+		}
 	}
-	h.events = append(h.events, e)
-	idx := len(h.events) - 1
 
-	conns := make([]Conn, 0, len(h.connections))
-	for c := range h.connections {
-		conns = append(conns, c)
+	took := time.Since(start)
+	if h.fanout != nil {
+		h.fanout.observe(took)
+	}
+	elapsed := took.String()
+	offset := len(h.events) - len(events)
+	for i := range events {
+		events[i].Elapsed = elapsed
+		if offset+i >= 0 {
+			h.events[offset+i].Elapsed = elapsed
+		}
 	}
 	h.mu.Unlock()
 
-	for _, c := range conns {
-		if err := c.WriteJSON(e); err != nil {
-			log.Printf("tenant %s: failed to write event: %v", e.TenantID, err)
-			h.mu.Lock()
-			delete(h.connections, c)
-			h.mu.Unlock()
-			if err := c.Close(); err != nil {
-				log.Printf("tenant %s: failed to close connection: %v", e.TenantID, err)
+	for _, c := range failed {
+		if err := c.Close(); err != nil {
+			log.Printf("tenant %s: failed to close connection: %v", events[0].TenantID, err)
+		}
+	}
+	return events, nil
+}
+
+// matchingConns returns, once each, the connections with a subscription
+// whose pattern matches the topic of e and whose filter accepts it. The
+// caller must hold h.mu.
+func (h *TenantHub) matchingConns(e Event) []Conn {
+	var conns []Conn
+	var doc interface{}
+	seen := make(map[Conn]bool)
+	for pattern, subs := range h.subscribers {
+		if !topicMatches(pattern, e.Topic) {
+			continue
+		}
+		for c, f := range subs {
+			if seen[c] {
+				continue
+			}
+			if f != nil {
+				if doc == nil {
+					doc = eventDoc(e)
+				}
+				if !f.matches(doc) {
+					continue
+				}
 			}
+			seen[c] = true
+			conns = append(conns, c)
 		}
 	}
+	return conns
+}
+
+// historyQuery selects a page of stored events. Before and After are event
+// IDs used as exclusive cursors; Since (inclusive) and Until (exclusive)
+// bound the event timestamps, Topic is a pattern the event topics must
+// match and Filter must accept the events. Zero values leave that side
+// unbounded.
+type historyQuery struct {
+	Limit  int
+	Before string
+	After  string
+	Since  time.Time
+	Until  time.Time
+	Topic  string
+	Filter *filter
+}
 
-	elapsed := time.Since(start).String()
+var errCursorNotFound = errors.New("cursor not found")
+
+// errResyncPending refuses a resync while an earlier one is still queued
+var errResyncPending = errors.New("resync already in progress")
+
+// errNotRegistered refuses a request on a connection the tenant no longer
+// delivers to, such as one dropped while a resync was queued
+var errNotRegistered = errors.New("connection not registered")
+
+// history returns up to q.Limit stored events in chronological order and
+// reports whether further matching events exist in the paging direction.
+// Paging runs forward from an After cursor and backward from the newest
+// event otherwise.
+func (h *TenantHub) history(q historyQuery) ([]Event, bool, error) {
 	h.mu.Lock()
-	h.events[idx].Elapsed = elapsed
-	h.mu.Unlock()
-	e.Elapsed = elapsed
+	defer h.mu.Unlock()
 
-	return e
+	lo, hi := 0, len(h.events)
+	if q.After != "" {
+		i := h.indexOf(q.After)
+		if i < 0 {
+			return nil, false, errCursorNotFound
+		}
+		lo = i + 1
+	}
+	if q.Before != "" {
+		i := h.indexOf(q.Before)
+		if i < 0 {
+			return nil, false, errCursorNotFound
+		}
+		hi = i
+	}
+
+	matched := make([]Event, 0)
+	for i := lo; i < hi; i++ {
+		e := h.events[i]
+		if !q.Since.IsZero() && e.Timestamp.Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && !e.Timestamp.Before(q.Until) {
+			continue
+		}
+		if q.Topic != "" && !topicMatches(q.Topic, e.Topic) {
+			continue
+		}
+		if q.Filter != nil && !q.Filter.matches(eventDoc(e)) {
+			continue
+		}
+		matched = append(matched, e)
+	}
+	if q.Limit <= 0 || len(matched) <= q.Limit {
+		return matched, false, nil
+	}
+	if q.After != "" && q.Before == "" {
+		return matched[:q.Limit], true, nil
+	}
+	return matched[len(matched)-q.Limit:], true, nil
+}
+
+// indexOf returns the position of the event with the given ID or -1.
+// The caller must hold h.mu.
+func (h *TenantHub) indexOf(id string) int {
+	for i := len(h.events) - 1; i >= 0; i-- {
+		if h.events[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// subscription is a topic pattern a connection receives, with an optional
+// filter on the events
+type subscription struct {
+	Pattern string
+	Filter  *filter
 }
 
-// addConn registers a new connection
-func (h *TenantHub) addConn(c Conn) {
+// addConn registers a new connection with subs, or subscribed to every
+// event when none are given
+func (h *TenantHub) addConn(c Conn, subs ...subscription) {
 	h.mu.Lock()
-	h.connections[c] = true
-	h.mu.Unlock()
+	defer h.mu.Unlock()
+	if h.closing {
+		sendAway(c)
+		return
+	}
+	h.subscribeAll(c, subs)
+}
+
+// subscribeAll registers c with its initial subscriptions. The caller must
+// hold h.mu.
+func (h *TenantHub) subscribeAll(c Conn, subs []subscription) {
+	if len(subs) == 0 {
+		subs = []subscription{{Pattern: defaultSubscription}}
+	}
+	h.connections[c] = make(map[string]*filter)
+	for _, s := range subs {
+		h.subscribeLocked(c, s)
+	}
+}
+
+func (h *TenantHub) subscribeLocked(c Conn, s subscription) {
+	h.connections[c][s.Pattern] = s.Filter
+	subs := h.subscribers[s.Pattern]
+	if subs == nil {
+		subs = make(map[Conn]*filter)
+		h.subscribers[s.Pattern] = subs
+	}
+	subs[c] = s.Filter
+}
+
+// subscribe adds s to the subscriptions of c, replacing the filter of an
+// existing subscription to the same pattern. Connections that are no
+// longer registered get errNotRegistered.
+func (h *TenantHub) subscribe(c Conn, s subscription) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	patterns, ok := h.connections[c]
+	if !ok {
+		return errNotRegistered
+	}
+	if _, exists := patterns[s.Pattern]; !exists && len(patterns) >= maxSubscriptions {
+		return errTooManySubscriptions
+	}
+	h.subscribeLocked(c, s)
+	return nil
+}
+
+// unsubscribe stops delivering topics matched by pattern to c
+func (h *TenantHub) unsubscribe(c Conn, pattern string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if patterns, ok := h.connections[c]; ok {
+		delete(patterns, pattern)
+		h.unindex(c, pattern)
+	}
+}
+
+// unindex removes c from the subscribers of pattern. The caller must hold
+// h.mu.
+func (h *TenantHub) unindex(c Conn, pattern string) {
+	if subs := h.subscribers[pattern]; subs != nil {
+		delete(subs, c)
+		if len(subs) == 0 {
+			delete(h.subscribers, pattern)
+		}
+	}
+}
+
+// dropConn forgets c and its subscriptions and reports whether it was
+// registered. The caller must hold h.mu.
+func (h *TenantHub) dropConn(c Conn) bool {
+	patterns, ok := h.connections[c]
+	if !ok {
+		return false
+	}
+	for p := range patterns {
+		h.unindex(c, p)
+	}
+	delete(h.connections, c)
+	delete(h.delivered, c)
+	return true
+}
+
+// resumeConn replays the events stored after the event with ID since and
+// then registers c for live delivery with subs. The
+// replay is queued while holding the hub lock, so every event is delivered
+// exactly once: events stored before registration are replayed and later
+// ones are broadcast. If since is no longer in history a history_truncated
+// message precedes a replay of everything still stored.
+func (h *TenantHub) resumeConn(c Conn, since string, subs ...subscription) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closing {
+		sendAway(c)
+		return errShuttingDown
+	}
+	start := 0
+	var prev uint64
+	var notice *controlMessage
+	if i := h.indexOf(since); i >= 0 {
+		start = i + 1
+		prev = h.events[i].Seq
+	} else {
+		notice = &controlMessage{Op: opHistoryTruncated, Since: since}
+	}
+	h.subscribeAll(c, subs)
+	return h.replayLocked(c, start, prev, notice)
+}
+
+// resumeConnSeq is resumeConn for a client that last saw sequence number
+// seq
+func (h *TenantHub) resumeConnSeq(c Conn, seq uint64, subs ...subscription) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closing {
+		sendAway(c)
+		return errShuttingDown
+	}
+	start, prev, notice := h.seqStart(seq)
+	h.subscribeAll(c, subs)
+	return h.replayLocked(c, start, prev, notice)
+}
+
+// resyncConn replays to a registered connection the stored events after
+// seq that its subscriptions accept, for a client that noticed a gap. The
+// client sees events it already has again and skips them by sequence
+// number. Connections that are no longer registered get
+// errNotRegistered.
+func (h *TenantHub) resyncConn(c Conn, seq uint64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.connections[c]; !ok {
+		return errNotRegistered
+	}
+	start, prev, notice := h.seqStart(seq)
+	r, ok := c.(resyncWriter)
+	if !ok {
+		return h.replayLocked(c, start, prev, notice)
+	}
+	if r.resyncPending() {
+		return errResyncPending
+	}
+	return h.replayWith(c, r.writeResync, start, prev, notice)
+}
+
+// seqStart returns the index of the first stored event after seq, the
+// prev_seq of the first event replayed from there and, when events after
+// seq have already left history, the history_truncated notice to send
+// first. A seq ahead of the tenant's gets a seq_reset notice and a replay
+// of the whole window. The caller must hold h.mu.
+func (h *TenantHub) seqStart(seq uint64) (int, uint64, *controlMessage) {
+	if seq > h.seq {
+		// numbering restarted, as after a restart without a store; the
+		// client's seq means nothing here, so everything stored is new
+		return 0, 0, &controlMessage{Op: opSeqReset, SinceSeq: seq}
+	}
+	start := sort.Search(len(h.events), func(i int) bool { return h.events[i].Seq > seq })
+	if seq < h.seq && (len(h.events) == 0 || h.events[0].Seq > seq+1) {
+		return start, 0, &controlMessage{Op: opHistoryTruncated, SinceSeq: seq}
+	}
+	return start, seq, nil
+}
+
+// replayLocked queues to c the stored events from index start that its
+// subscriptions accept, preceded by notice when set. The first of them
+// carries prev as its prev_seq. Replays bypass the bound of the send
+// queue; a connection that cannot take one is dropped. The caller must
+// hold h.mu.
+func (h *TenantHub) replayLocked(c Conn, start int, prev uint64, notice *controlMessage) error {
+	write := c.WriteJSON
+	if b, ok := c.(backlogWriter); ok {
+		write = b.writeBacklog
+	}
+	return h.replayWith(c, write, start, prev, notice)
+}
+
+// replayWith is replayLocked queuing each message with write
+func (h *TenantHub) replayWith(c Conn, write func(interface{}) error, start int, prev uint64, notice *controlMessage) error {
+	if notice != nil {
+		if err := write(*notice); err != nil {
+			h.dropConn(c)
+			return err
+		}
+	}
+	for _, e := range h.events[start:] {
+		if !h.subscribed(c, e) {
+			continue
+		}
+		e.PrevSeq = prev
+		prev = e.Seq
+		if err := write(e); err != nil {
+			h.dropConn(c)
+			return err
+		}
+	}
+	// a resync replays events already queued; live ones continue after
+	// the newer of the two
+	if prev > h.delivered[c] {
+		h.delivered[c] = prev
+	}
+	return nil
+}
+
+// subscribed reports whether one of c's subscriptions accepts e. The
+// caller must hold h.mu.
+func (h *TenantHub) subscribed(c Conn, e Event) bool {
+	var doc interface{}
+	for p, f := range h.connections[c] {
+		if !topicMatches(p, e.Topic) {
+			continue
+		}
+		if f == nil {
+			return true
+		}
+		if doc == nil {
+			doc = eventDoc(e)
+		}
+		if f.matches(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendAway closes a connection the hub no longer serves, telling the
+// client the server is going away when the connection supports it
+func sendAway(c Conn) {
+	if g, ok := c.(goingAwayConn); ok {
+		g.goAway()
+		return
+	}
+	c.Close()
 }
 
 // removeConn removes a connection
 func (h *TenantHub) removeConn(c Conn) {
 	h.mu.Lock()
-	if _, ok := h.connections[c]; ok {
-		delete(h.connections, c)
+	if h.dropConn(c) {
 		if err := c.Close(); err != nil {
 			log.Printf("failed to close connection: %v", err)
 		}
@@ -89,40 +538,491 @@ func (h *TenantHub) removeConn(c Conn) {
 	h.mu.Unlock()
 }
 
-// EventHub manages tenants
+// EventHub manages tenants. Once unready is set the hub reports that it
+// should get no new traffic while still serving it; once shuttingDown is
+// set publishes are refused. publishes tracks the ones still in flight.
+// restored counts the tenants recovered from the store.
 type EventHub struct {
-	tenants map[string]*TenantHub
-	mu      sync.Mutex
+	tenants           map[string]*TenantHub
+	store             EventStore
+	maxEvents         int
+	metrics           *metrics
+	limits            rateLimits
+	idempotencyWindow time.Duration
+	restored          int
+	unready           bool
+	shuttingDown      bool
+	publishes         sync.WaitGroup
+	mu                sync.Mutex
 }
 
-func newEventHub() *EventHub {
-	return &EventHub{tenants: make(map[string]*TenantHub)}
+// newEventHub returns a hub that keeps history in memory only, sized and
+// limited as cfg says
+func newEventHub(cfg Config) *EventHub {
+	return &EventHub{
+		tenants:           make(map[string]*TenantHub),
+		maxEvents:         cfg.MaxEvents,
+		metrics:           newMetrics(cfg.MetricsTenants),
+		limits:            cfg.RateLimits,
+		idempotencyWindow: cfg.IdempotencyWindow,
+	}
 }
 
-// postEvent creates and stores event for tenant
-func (h *EventHub) postEvent(tenantID, message string) Event {
+// openEventHub returns a hub that persists events to store, with each
+// tenant's history window rebuilt from what the store already holds
+func openEventHub(cfg Config, store EventStore) (*EventHub, error) {
+	h := newEventHub(cfg)
+	h.store = store
+	tenants, err := store.Tenants()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range tenants {
+		events, err := store.Load(id, h.maxEvents)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", id, err)
+		}
+		t := h.ensureTenant(id)
+		t.events = append(t.events, events...)
+		t.seq = numberRestored(t.events)
+		log.Printf("tenant %s: restored %d events up to seq %d", id, len(events), t.seq)
+	}
+	h.restored = len(tenants)
+	if ss, ok := store.(schemaStore); ok {
+		schemas, err := ss.LoadSchemas()
+		if err != nil {
+			return nil, err
+		}
+		for id, docs := range schemas {
+			t := h.ensureTenant(id)
+			for typ, raw := range docs {
+				s, err := compileSchema(raw)
+				if err != nil {
+					log.Printf("tenant %s: skipping stored schema for %s: %v", id, typ, err)
+					continue
+				}
+				t.schemas[typ] = s
+			}
+		}
+	}
+	return h, nil
+}
+
+// numberRestored gives restored events that were stored without a
+// sequence number one, counting back from the next numbered event, and
+// returns the latest sequence number. Logs written before events were
+// numbered thus get the same numbers on every restart.
+func numberRestored(events []Event) uint64 {
+	next := uint64(len(events)) + 1
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Seq == 0 && next > 1 {
+			events[i].Seq = next - 1
+		}
+		next = events[i].Seq
+	}
+	if len(events) == 0 {
+		return 0
+	}
+	return events[len(events)-1].Seq
+}
+
+// setRateLimits configures the per-tenant publish limits
+func (h *EventHub) setRateLimits(l rateLimits) {
+	h.mu.Lock()
+	h.limits = l
+	h.mu.Unlock()
+}
+
+// publishOnce runs publish unless the tenant already published under key
+// within the idempotency window, in which case the stored events are
+// returned and replayed is true. Concurrent requests with the same key
+// wait for the first; a key reused for a different publish is rejected
+// with errIdempotencyConflict.
+func (h *EventHub) publishOnce(tenantID, key string, fingerprint [sha256.Size]byte, publish func() ([]Event, error)) (events []Event, replayed bool, err error) {
+	h.mu.Lock()
+	tenant := h.ensureTenant(tenantID)
+	window := h.idempotencyWindow
+	h.mu.Unlock()
+	p, owner, err := tenant.idempotency.begin(key, fingerprint, time.Now())
+	if err != nil {
+		return nil, false, err
+	}
+	if !owner {
+		return p.events, true, nil
+	}
+	events, err = publish()
+	tenant.idempotency.finish(p, events, err, window, time.Now())
+	return events, false, err
+}
+
+// allowPublish takes n events from the tenant's publish allowance. When the
+// limit is exceeded the rejection is counted and the wait until the
+// publish would succeed is returned.
+func (h *EventHub) allowPublish(tenantID string, n int) (bool, time.Duration) {
+	h.mu.Lock()
+	limit := h.limits.forTenant(tenantID)
+	if limit.Rate <= 0 {
+		h.mu.Unlock()
+		return true, 0
+	}
+	tenant := h.ensureTenant(tenantID)
+	h.mu.Unlock()
+	ok, wait := tenant.bucket.take(limit, n, time.Now())
+	if !ok {
+		tenant.rateLimited.Add(1)
+	}
+	return ok, wait
+}
+
+// publishBurst returns the most events the tenant may publish at once, or
+// zero when its publishes are not limited
+func (h *EventHub) publishBurst(tenantID string) int {
+	h.mu.Lock()
+	limit := h.limits.forTenant(tenantID)
+	h.mu.Unlock()
+	if limit.Rate <= 0 {
+		return 0
+	}
+	return int(limit.capacity())
+}
+
+// rateLimitedCount returns the number of rate-limited publishes of a tenant
+func (h *EventHub) rateLimitedCount(tenantID string) uint64 {
+	h.mu.Lock()
+	tenant := h.tenants[tenantID]
+	h.mu.Unlock()
+	if tenant == nil {
+		return 0
+	}
+	return tenant.rateLimited.Load()
+}
+
+// rateLimitRejections returns the number of rate-limited publishes per tenant
+func (h *EventHub) rateLimitRejections() map[string]uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make(map[string]uint64)
+	for id, t := range h.tenants {
+		if n := t.rateLimited.Load(); n > 0 {
+			counts[id] = n
+		}
+	}
+	return counts
+}
+
+// schemaFor returns the schema registered for an event type, or nil
+func (h *EventHub) schemaFor(tenantID, typ string) *schema {
+	h.mu.Lock()
+	tenant := h.tenants[tenantID]
+	h.mu.Unlock()
+	if tenant == nil {
+		return nil
+	}
+	tenant.mu.Lock()
+	defer tenant.mu.Unlock()
+	return tenant.schemas[typ]
+}
+
+// schemaTypes lists the event types of a tenant that have a schema
+func (h *EventHub) schemaTypes(tenantID string) []string {
+	types := []string{}
+	h.mu.Lock()
+	tenant := h.tenants[tenantID]
+	h.mu.Unlock()
+	if tenant == nil {
+		return types
+	}
+	tenant.mu.Lock()
+	for typ := range tenant.schemas {
+		types = append(types, typ)
+	}
+	tenant.mu.Unlock()
+	sort.Strings(types)
+	return types
+}
+
+// setSchema registers or replaces the schema of an event type, persisting
+// the tenant's schemas first when the store keeps them
+func (h *EventHub) setSchema(tenantID, typ string, s *schema) error {
 	h.mu.Lock()
 	tenant := h.ensureTenant(tenantID)
 	h.mu.Unlock()
-	e := newEvent(tenantID, message)
+	tenant.mu.Lock()
+	defer tenant.mu.Unlock()
+	if _, ok := tenant.schemas[typ]; !ok && len(tenant.schemas) >= maxSchemas {
+		return errTooManySchemas
+	}
+	docs := tenant.schemaDocs()
+	docs[typ] = s.raw
+	if err := h.saveSchemas(tenantID, docs); err != nil {
+		return err
+	}
+	tenant.schemas[typ] = s
+	return nil
+}
+
+// deleteSchema removes the schema of an event type
+func (h *EventHub) deleteSchema(tenantID, typ string) error {
+	h.mu.Lock()
+	tenant := h.tenants[tenantID]
+	h.mu.Unlock()
+	if tenant == nil {
+		return errSchemaNotFound
+	}
+	tenant.mu.Lock()
+	defer tenant.mu.Unlock()
+	if _, ok := tenant.schemas[typ]; !ok {
+		return errSchemaNotFound
+	}
+	docs := tenant.schemaDocs()
+	delete(docs, typ)
+	if err := h.saveSchemas(tenantID, docs); err != nil {
+		return err
+	}
+	delete(tenant.schemas, typ)
+	return nil
+}
+
+func (h *EventHub) saveSchemas(tenantID string, docs map[string]json.RawMessage) error {
+	if ss, ok := h.store.(schemaStore); ok {
+		return ss.SaveSchemas(tenantID, docs)
+	}
+	return nil
+}
+
+// schemaDocs returns the documents of the registered schemas. The caller
+// must hold h.mu.
+func (h *TenantHub) schemaDocs() map[string]json.RawMessage {
+	docs := make(map[string]json.RawMessage, len(h.schemas))
+	for typ, s := range h.schemas {
+		docs[typ] = s.raw
+	}
+	return docs
+}
+
+// checkSchema validates the data of req against the schema registered for
+// its type. Events without a type, or of a type without a schema, pass.
+func (h *EventHub) checkSchema(tenantID string, req *eventRequest) error {
+	if req.Type == "" {
+		return nil
+	}
+	s := h.schemaFor(tenantID, req.Type)
+	if s == nil {
+		return nil
+	}
+	if violations := s.validateData(req.Data); len(violations) > 0 {
+		return &publishError{
+			status:     http.StatusUnprocessableEntity,
+			msg:        fmt.Sprintf("event does not match the schema of %s", req.Type),
+			violations: violations,
+		}
+	}
+	return nil
+}
+
+// dropCounter returns the counter of messages dropped from the tenant's
+// send queues
+func (h *EventHub) dropCounter(tenantID string) *atomic.Uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return &h.ensureTenant(tenantID).dropped
+}
+
+// beginPublish admits a publish unless the hub is shutting down. Admitted
+// publishes must call endPublish when done.
+func (h *EventHub) beginPublish() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shuttingDown {
+		return false
+	}
+	h.publishes.Add(1)
+	return true
+}
+
+func (h *EventHub) endPublish() {
+	h.publishes.Done()
+}
+
+// accepting reports whether the hub still takes new connections
+func (h *EventHub) accepting() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.shuttingDown
+}
+
+// markUnready fails readiness checks ahead of a shutdown, while the hub
+// keeps serving, so load balancers stop sending it new connections
+func (h *EventHub) markUnready() {
+	h.mu.Lock()
+	h.unready = true
+	h.mu.Unlock()
+}
+
+// shutdown refuses new publishes and connections, waits for the publishes
+// in flight and then sends every connection away, waiting until each has
+// been told. It gives up waiting when ctx is done.
+func (h *EventHub) shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.shuttingDown = true
+	tenants := make([]*TenantHub, 0, len(h.tenants))
+	for _, t := range h.tenants {
+		tenants = append(tenants, t)
+	}
+	h.mu.Unlock()
+
+	published := make(chan struct{})
+	go func() {
+		h.publishes.Wait()
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for publishes: %w", ctx.Err())
+	}
+
+	var told []<-chan struct{}
+	n := 0
+	for _, t := range tenants {
+		t.mu.Lock()
+		t.closing = true
+		for c := range t.connections {
+			n++
+			if g, ok := c.(goingAwayConn); ok {
+				told = append(told, g.goAway())
+			} else {
+				c.Close()
+			}
+		}
+		t.mu.Unlock()
+	}
+	log.Printf("shutdown: closing %d connections", n)
+	for _, done := range told {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return fmt.Errorf("closing connections: %w", ctx.Err())
+		}
+	}
+	return nil
+}
+
+// closeStore flushes and closes the event store, if any
+func (h *EventHub) closeStore() error {
+	if h.store == nil {
+		return nil
+	}
+	return h.store.Close()
+}
+
+// postEvent creates and stores event for tenant
+func (h *EventHub) postEvent(tenantID, message string) (Event, error) {
+	return h.addEvent(newEvent(tenantID, message))
+}
+
+// addEvent stores e for its tenant and delivers it to the subscribers of
+// its topic
+func (h *EventHub) addEvent(e Event) (Event, error) {
+	h.mu.Lock()
+	tenant := h.ensureTenant(e.TenantID)
+	h.mu.Unlock()
 	return tenant.addEvent(e)
 }
 
+// addEvents stores and delivers events of one tenant as a unit
+func (h *EventHub) addEvents(tenantID string, events []Event) ([]Event, error) {
+	h.mu.Lock()
+	tenant := h.ensureTenant(tenantID)
+	h.mu.Unlock()
+	return tenant.addEvents(events)
+}
+
 func (h *EventHub) ensureTenant(id string) *TenantHub {
 	if t, ok := h.tenants[id]; ok {
 		return t
 	}
-	t := newTenantHub()
+	t := newTenantHub(h.maxEvents)
+	t.store = h.store
+	t.metricLabel = h.metrics.tenantLabel(id)
+	t.fanout = h.metrics.fanout
+	t.closing = h.shuttingDown
 	h.tenants[id] = t
 	return t
 }
 
-// registerConn registers connection to tenant
-func (h *EventHub) registerConn(tenantID string, c Conn) {
+// history returns stored events for tenant; unknown tenants have none
+func (h *EventHub) history(tenantID string, q historyQuery) ([]Event, bool, error) {
+	h.mu.Lock()
+	tenant := h.tenants[tenantID]
+	h.mu.Unlock()
+	if tenant == nil {
+		if q.Before != "" || q.After != "" {
+			return nil, false, errCursorNotFound
+		}
+		return []Event{}, false, nil
+	}
+	return tenant.history(q)
+}
+
+// registerConn registers connection to tenant with subs, or subscribed to
+// every event when none are given
+func (h *EventHub) registerConn(tenantID string, c Conn, subs ...subscription) {
+	h.mu.Lock()
+	tenant := h.ensureTenant(tenantID)
+	h.mu.Unlock()
+	tenant.addConn(c, subs...)
+}
+
+// resumeConn registers connection to tenant after replaying the events
+// that followed since
+func (h *EventHub) resumeConn(tenantID string, c Conn, since string, subs ...subscription) error {
 	h.mu.Lock()
 	tenant := h.ensureTenant(tenantID)
 	h.mu.Unlock()
-	tenant.addConn(c)
+	return tenant.resumeConn(c, since, subs...)
+}
+
+// resumeConnSeq registers connection to tenant after replaying the events
+// numbered after seq
+func (h *EventHub) resumeConnSeq(tenantID string, c Conn, seq uint64, subs ...subscription) error {
+	h.mu.Lock()
+	tenant := h.ensureTenant(tenantID)
+	h.mu.Unlock()
+	return tenant.resumeConnSeq(c, seq, subs...)
+}
+
+// resyncConn replays the events numbered after seq to a connection of
+// tenant
+func (h *EventHub) resyncConn(tenantID string, c Conn, seq uint64) error {
+	h.mu.Lock()
+	tenant := h.tenants[tenantID]
+	h.mu.Unlock()
+	if tenant == nil {
+		return errNotRegistered
+	}
+	return tenant.resyncConn(c, seq)
+}
+
+// subscribe adds a subscription to a registered connection
+func (h *EventHub) subscribe(tenantID string, c Conn, s subscription) error {
+	h.mu.Lock()
+	tenant := h.tenants[tenantID]
+	h.mu.Unlock()
+	if tenant == nil {
+		return errNotRegistered
+	}
+	return tenant.subscribe(c, s)
+}
+
+// unsubscribe removes a topic pattern from a registered connection
+func (h *EventHub) unsubscribe(tenantID string, c Conn, pattern string) {
+	h.mu.Lock()
+	tenant := h.tenants[tenantID]
+	h.mu.Unlock()
+	if tenant != nil {
+		tenant.unsubscribe(c, pattern)
+	}
 }
 
 // unregisterConn removes connection from tenant
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Filters are small boolean expressions over an event's JSON form, for
+// example
+//
+//	data.severity >= "warn" && data.region == "eu"
+//
+// Paths are dot-separated field names into the event object; a missing
+// field is null. Literals are double-quoted strings, numbers, true, false
+// and null. Comparisons are == != < <= > >=, combined with &&, || and !
+// and grouped with parentheses; a bare path is true when it holds
+// anything other than null, false, 0 or "". Values of different types are
+// never equal and never ordered, except that the log levels in
+// severityLevels order by severity rather than alphabetically.
+//
+// Expressions are compiled once when subscribing and only walk the parsed
+// tree per event, which keeps fan-out cheap and filters free of side
+// effects.
+const (
+	maxFilterLength = 1024
+	maxFilterNodes  = 64
+)
+
+// severityLevels ranks the severity names filters order specially
+var severityLevels = map[string]int{
+	"trace":    0,
+	"debug":    1,
+	"info":     2,
+	"notice":   3,
+	"warn":     4,
+	"warning":  4,
+	"error":    5,
+	"critical": 6,
+	"fatal":    6,
+}
+
+// filter is a compiled filter expression
+type filter struct {
+	root filterNode
+}
+
+// filterNode is one node of a compiled expression
+type filterNode interface {
+	eval(doc interface{}) interface{}
+}
+
+// filterError reports an expression that does not compile
+type filterError struct{ err error }
+
+func (e *filterError) Error() string { return "invalid filter: " + e.err.Error() }
+
+// compileFilter parses src into a filter. Errors are *filterError.
+func compileFilter(src string) (*filter, error) {
+	root, err := parseFilter(src)
+	if err != nil {
+		return nil, &filterError{err}
+	}
+	return &filter{root: root}, nil
+}
+
+func parseFilter(src string) (filterNode, error) {
+	if len(src) > maxFilterLength {
+		return nil, fmt.Errorf("filter longer than %d bytes", maxFilterLength)
+	}
+	toks, err := lexFilter(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	return root, nil
+}
+
+// matches reports whether the event document doc satisfies f. A nil
+// filter matches everything.
+func (f *filter) matches(doc interface{}) bool {
+	if f == nil {
+		return true
+	}
+	return truthy(f.root.eval(doc))
+}
+
+// eventDoc returns the generic JSON form of e that filters evaluate
+func eventDoc(e Event) interface{} {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil
+	}
+	var doc interface{}
+	json.Unmarshal(b, &doc)
+	return doc
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokPath
+	tokString
+	tokNumber
+	tokKeyword
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+	val  interface{}
+}
+
+// filterOps lists the operators, longest first so that "<=" wins over "<"
+var filterOps = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!"}
+
+func lexFilter(src string) ([]filterToken, error) {
+	var toks []filterToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			toks = append(toks, filterToken{kind: tokLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			toks = append(toks, filterToken{kind: tokRParen, text: ")", pos: i})
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d", i)
+			}
+			toks = append(toks, filterToken{kind: tokString, text: src[i : j+1], pos: i, val: s})
+			i = j + 1
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(src) && strings.IndexByte("0123456789.eE+-", src[j]) >= 0 {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at %d", src[i:j], i)
+			}
+			toks = append(toks, filterToken{kind: tokNumber, text: src[i:j], pos: i, val: n})
+			i = j
+		case isIdentByte(c, true):
+			j := i + 1
+			for j < len(src) && (isIdentByte(src[j], false) || src[j] == '.') {
+				j++
+			}
+			word := src[i:j]
+			switch word {
+			case "true", "false", "null":
+				var v interface{}
+				if word != "null" {
+					v = word == "true"
+				}
+				toks = append(toks, filterToken{kind: tokKeyword, text: word, pos: i, val: v})
+			default:
+				for _, part := range strings.Split(word, ".") {
+					if part == "" {
+						return nil, fmt.Errorf("invalid path %q at %d", word, i)
+					}
+				}
+				toks = append(toks, filterToken{kind: tokPath, text: word, pos: i})
+			}
+			i = j
+		default:
+			op := ""
+			for _, o := range filterOps {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			toks = append(toks, filterToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, filterToken{kind: tokEOF, text: "end of filter", pos: len(src)}), nil
+}
+
+func isIdentByte(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// filterParser is a recursive descent parser over the token list
+type filterParser struct {
+	toks  []filterToken
+	i     int
+	nodes int
+	depth int
+}
+
+func (p *filterParser) peek() filterToken { return p.toks[p.i] }
+
+func (p *filterParser) next() filterToken {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// node counts a new node against the size limit
+func (p *filterParser) node(n filterNode) (filterNode, error) {
+	p.nodes++
+	if p.nodes > maxFilterNodes {
+		return nil, fmt.Errorf("filter has more than %d terms", maxFilterNodes)
+	}
+	return n, nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().text == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.node(orNode{left, right}); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().text == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.node(andNode{left, right}); err != nil {
+			return nil, err
+		}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxFilterNodes {
+		return nil, fmt.Errorf("filter nested too deeply")
+	}
+	if t := p.peek(); t.kind == tokOp && t.text == "!" {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return p.node(notNode{x})
+	}
+	if p.peek().kind == tokLParen {
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokRParen {
+			return nil, fmt.Errorf("expected \")\" at %d", t.pos)
+		}
+		return x, nil
+	}
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.kind != tokOp {
+		return left, nil
+	}
+	switch t.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return p.node(compareNode{op: t.text, left: left, right: right})
+}
+
+func (p *filterParser) parseOperand() (filterNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokPath:
+		return p.node(pathNode(strings.Split(t.text, ".")))
+	case tokString, tokNumber, tokKeyword:
+		return p.node(literalNode{t.val})
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", describeToken(t), t.pos)
+}
+
+func describeToken(t filterToken) string {
+	if t.kind == tokEOF {
+		return t.text
+	}
+	return strconv.Quote(t.text)
+}
+
+type literalNode struct{ v interface{} }
+
+func (n literalNode) eval(interface{}) interface{} { return n.v }
+
+// pathNode looks up a field path in the event document
+type pathNode []string
+
+func (n pathNode) eval(doc interface{}) interface{} {
+	v := doc
+	for _, name := range n {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = obj[name]
+	}
+	return v
+}
+
+type notNode struct{ x filterNode }
+
+func (n notNode) eval(doc interface{}) interface{} { return !truthy(n.x.eval(doc)) }
+
+type andNode struct{ left, right filterNode }
+
+func (n andNode) eval(doc interface{}) interface{} {
+	return truthy(n.left.eval(doc)) && truthy(n.right.eval(doc))
+}
+
+type orNode struct{ left, right filterNode }
+
+func (n orNode) eval(doc interface{}) interface{} {
+	return truthy(n.left.eval(doc)) || truthy(n.right.eval(doc))
+}
+
+type compareNode struct {
+	op          string
+	left, right filterNode
+}
+
+func (n compareNode) eval(doc interface{}) interface{} {
+	a, b := n.left.eval(doc), n.right.eval(doc)
+	switch n.op {
+	case "==":
+		return equalValues(a, b)
+	case "!=":
+		return !equalValues(a, b)
+	}
+	c, ok := compareValues(a, b)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case string:
+		return x != ""
+	}
+	return true
+}
+
+// equalValues compares scalars; objects and arrays never compare equal
+func equalValues(a, b interface{}) bool {
+	switch x := a.(type) {
+	case nil:
+		return b == nil
+	case bool:
+		y, ok := b.(bool)
+		return ok && x == y
+	case float64:
+		y, ok := b.(float64)
+		return ok && x == y
+	case string:
+		y, ok := b.(string)
+		return ok && x == y
+	}
+	return false
+}
+
+// compareValues orders two numbers or two strings, ranking severity names
+// by level
+func compareValues(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		lx, okx := severityLevels[strings.ToLower(x)]
+		ly, oky := severityLevels[strings.ToLower(y)]
+		if okx && oky {
+			return lx - ly, true
+		}
+		return strings.Compare(x, y), true
+	}
+	return 0, false
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterEval(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{
+		"topic": "orders.created",
+		"message": "hello",
+		"severity": "warn",
+		"count": 3,
+		"ok": true,
+		"data": {"region": "eu", "amount": 12.5, "tags": ["a"]}
+	}`), &doc)
+
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{`data.region == "eu"`, true},
+		{`data.region != "eu"`, false},
+		{`data.region == "us" || topic == "orders.created"`, true},
+		{`data.region == "eu" && count > 5`, false},
+		{`!(data.region == "us")`, true},
+		{`severity >= "warn"`, true},
+		{`severity >= "error"`, false},
+		{`severity < "ERROR"`, true},
+		{`severity > "debug"`, true},
+		{`message < "world"`, true},
+		{`data.amount >= 12.5 && data.amount < 13`, true},
+		{`count == 3`, true},
+		{`count == "3"`, false},
+		{`count != "3"`, true},
+		{`count < "4"`, false},
+		{`missing == null`, true},
+		{`data.missing.deeper == null`, true},
+		{`missing`, false},
+		{`ok`, true},
+		{`!ok`, false},
+		{`data.tags`, true},
+		{`data.tags == data.tags`, false},
+		{`ok == true && data.region`, true},
+		{`-1 < count`, true},
+		{`(count > 1 || ok) && !(severity == "info")`, true},
+	}
+	for _, tc := range cases {
+		f, err := compileFilter(tc.expr)
+		if err != nil {
+			t.Fatalf("compile %q: %v", tc.expr, err)
+		}
+		if got := f.matches(doc); got != tc.want {
+			t.Errorf("%s = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestFilterCompileErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`data.region ==`,
+		`== "eu"`,
+		`(count > 1`,
+		`count > 1)`,
+		`count > > 1`,
+		`"unterminated`,
+		`data..region`,
+		`region = "eu"`,
+		`count & 1`,
+		`1.2.3 == x`,
+		`a == b == c`,
+		strings.Repeat("!", 100) + "ok",
+		strings.Repeat("a || ", 70) + "a",
+		strings.Repeat("a", maxFilterLength+1),
+	} {
+		_, err := compileFilter(expr)
+		if _, ok := err.(*filterError); !ok {
+			t.Errorf("%q: expected filterError, got %v", expr, err)
+		}
+	}
+}
+
+func TestFilteredSubscriptions(t *testing.T) {
+	hub := newTenantHub(defaultMaxEvents)
+	chatty := &fakeConn{}
+	quiet := &fakeConn{}
+	f, _ := compileFilter(`message == "important"`)
+	hub.addConn(chatty)
+	hub.addConn(quiet, subscription{Pattern: "#", Filter: f})
+
+	hub.addEvent(Event{ID: "e0", TenantID: "t1", Message: "noise"})
+	hub.addEvent(Event{ID: "e1", TenantID: "t1", Message: "important"})
+	if len(chatty.msgs) != 2 {
+		t.Fatalf("unfiltered connection should get both events, got %d", len(chatty.msgs))
+	}
+	if len(quiet.msgs) != 1 || quiet.msgs[0].ID != "e1" {
+		t.Fatalf("filtered connection should only get e1, got %+v", quiet.msgs)
+	}
+
+	// a second subscription without a filter widens what quiet receives
+	hub.subscribe(quiet, subscription{Pattern: "alerts"})
+	hub.addEvent(Event{ID: "e2", TenantID: "t1", Topic: "alerts", Message: "noise"})
+	if len(quiet.msgs) != 2 || quiet.msgs[1].ID != "e2" {
+		t.Fatalf("alerts subscription should deliver e2, got %+v", quiet.msgs)
+	}
+
+	resumed := &fakeConn{}
+	if err := hub.resumeConn(resumed, "missing", subscription{Pattern: "#", Filter: f}); err != nil {
+		t.Fatalf("resumeConn: %v", err)
+	}
+	var ids []string
+	for _, e := range resumed.msgs {
+		ids = append(ids, e.ID)
+	}
+	// the first message is the history_truncated notice
+	if strings.Join(ids, ",") != ",e1" {
+		t.Fatalf("replay should be filtered, got %v", ids)
+	}
+}
+
+// readEvent skips control messages until the next event
+func readEvent(t *testing.T, ws *wsClient) Event {
+	t.Helper()
+	for {
+		var raw map[string]json.RawMessage
+		if err := ws.ReadJSON(&raw, time.Second); err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		if _, ok := raw["op"]; ok {
+			continue
+		}
+		b, _ := json.Marshal(raw)
+		var e Event
+		json.Unmarshal(b, &e)
+		return e
+	}
+}
+
+func TestFiltersEndToEnd(t *testing.T) {
+	srv, _ := setupTestServer()
+	defer srv.Close()
+	client := srv.Client()
+
+	bad := url.QueryEscape(`message ==`)
+	if _, err := dialWS(srv.URL + "/ws?tenant=tenantA&filter=" + bad); err == nil {
+		t.Fatalf("invalid filter should fail the handshake")
+	}
+	if status, _ := getHistory(t, client, srv.URL, "tenantA", "?filter="+bad); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid history filter, got %d", status)
+	}
+
+	filter := url.QueryEscape(`message >= "m" && topic == "alerts"`)
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA&filter=" + filter)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	publish := func(ref, topic, msg string) {
+		ws.WriteJSON(map[string]string{"op": "publish", "ref": ref, "topic": topic, "message": msg})
+	}
+	publish("p1", "alerts", "apple")
+	publish("p2", "chat", "zebra")
+	publish("p3", "alerts", "mango")
+	if ev := readEvent(t, ws); ev.Message != "mango" {
+		t.Fatalf("expected only the mango event, got %+v", ev)
+	}
+	// the ack of p3 follows its event
+	if reply := readReply(t, ws); reply.Ref != "p3" {
+		t.Fatalf("expected ack of p3, got %+v", reply)
+	}
+
+	ws.WriteJSON(map[string]string{"op": "subscribe", "ref": "s1", "topic": "chat", "filter": "message =="})
+	if reply := readReply(t, ws); reply.Op != opError || !strings.HasPrefix(reply.Error, "invalid filter") {
+		t.Fatalf("expected invalid filter error, got %+v", reply)
+	}
+	ws.WriteJSON(map[string]string{"op": "subscribe", "ref": "s2", "topic": "#", "filter": `message == "zebra"`})
+	if reply := readReply(t, ws); reply.Op != opAck {
+		t.Fatalf("unexpected reply: %+v", reply)
+	}
+	publish("p4", "chat", "zebra")
+	if ev := readEvent(t, ws); ev.Message != "zebra" {
+		t.Fatalf("replaced filter should deliver zebra, got %+v", ev)
+	}
+
+	status, h := getHistory(t, client, srv.URL, "tenantA", "?filter="+filter)
+	if status != http.StatusOK || len(h.Events) != 1 || h.Events[0].Message != "mango" {
+		t.Fatalf("expected filtered history, got %d %+v", status, h.Events)
+	}
+}
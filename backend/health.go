@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Component states reported by /readyz
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+	statusDraining    = "draining"
+)
+
+// healthChecker is implemented by event stores that can report whether
+// they are still usable
+type healthChecker interface {
+	check() error
+}
+
+// componentHealth is one component's entry in the readiness report
+type componentHealth struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// healthResponse is the body of /healthz and /readyz
+type healthResponse struct {
+	Status     string            `json:"status"`
+	Components []componentHealth `json:"components,omitempty"`
+}
+
+// serveHealthz handles GET /healthz, which only says the process is up
+// and serving requests
+func serveHealthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, healthResponse{Status: statusOK})
+	}
+}
+
+// serveReadyz handles GET /readyz. The instance is ready once its
+// configuration is loaded and the event store recovered, and stops being
+// ready as soon as a shutdown begins. Each component's status is listed;
+// any that is not ok makes the response 503. Details, which name paths
+// and tenants, are only shown to holders of MetricsToken; a component's
+// status and detail are logged when its status changes, so probes every
+// second do not flood the log while the instance is not ready.
+func serveReadyz(cfg Config, hub *EventHub) http.HandlerFunc {
+	var changes readinessLog
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		resp := healthResponse{Status: statusOK, Components: []componentHealth{
+			// the server is only built from a validated configuration
+			{Name: "config", Status: statusOK, Detail: "listening on " + cfg.Addr},
+			hub.storeHealth(),
+			hub.hubHealth(),
+		}}
+		detailed := cfg.MetricsToken != "" && subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(cfg.MetricsToken)) == 1
+		status := http.StatusOK
+		for i, c := range resp.Components {
+			changes.observe(c)
+			if c.Status != statusOK {
+				resp.Status = statusUnavailable
+				status = http.StatusServiceUnavailable
+			}
+			if !detailed {
+				resp.Components[i].Detail = ""
+			}
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, status, resp)
+	}
+}
+
+// readinessLog remembers the last status of each /readyz component so
+// that only changes are logged. Components start out ok.
+type readinessLog struct {
+	mu   sync.Mutex
+	last map[string]string
+}
+
+func (l *readinessLog) observe(c componentHealth) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev, seen := l.last[c.Name]
+	if !seen {
+		prev = statusOK
+	}
+	if c.Status == prev {
+		return
+	}
+	if l.last == nil {
+		l.last = make(map[string]string)
+	}
+	l.last[c.Name] = c.Status
+	log.Printf("readyz: %s %s: %s", c.Name, c.Status, c.Detail)
+}
+
+// storeHealth reports whether history was recovered and the store is
+// still usable
+func (h *EventHub) storeHealth() componentHealth {
+	c := componentHealth{Name: "store", Status: statusOK}
+	if h.store == nil {
+		c.Detail = "in memory"
+		return c
+	}
+	h.mu.Lock()
+	restored := h.restored
+	h.mu.Unlock()
+	c.Detail = fmt.Sprintf("recovered %d tenants", restored)
+	if hc, ok := h.store.(healthChecker); ok {
+		if err := hc.check(); err != nil {
+			c.Status = statusUnavailable
+			c.Detail = err.Error()
+		}
+	}
+	return c
+}
+
+// hubHealth reports whether the hub takes new publishes and connections
+func (h *EventHub) hubHealth() componentHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.unready || h.shuttingDown {
+		return componentHealth{Name: "hub", Status: statusDraining, Detail: "shutting down"}
+	}
+	return componentHealth{Name: "hub", Status: statusOK, Detail: fmt.Sprintf("%d tenants", len(h.tenants))}
+}
+
+// check reports a closed store or a data directory that has gone away
+func (s *fileStore) check() error {
+	select {
+	case <-s.stop:
+		return errors.New("store closed")
+	default:
+	}
+	fi, err := os.Stat(s.dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.dir)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getHealth(t *testing.T, client *http.Client, url string) (int, healthResponse) {
+	t.Helper()
+	return getHealthAs(t, client, url, "")
+}
+
+// getHealthAs is getHealth presenting token as a bearer token
+func getHealthAs(t *testing.T, client *http.Client, url, token string) (int, healthResponse) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("get %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	var body healthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode %s: %v", url, err)
+	}
+	return resp.StatusCode, body
+}
+
+func componentStatus(body healthResponse, name string) string {
+	for _, c := range body.Components {
+		if c.Name == name {
+			return c.Status
+		}
+	}
+	return ""
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openFileStore(dir, syncAlways, 0)
+	first, _ := openEventHub(defaultConfig(), store)
+	first.postEvent("tenantA", "before restart")
+	store.Close()
+
+	store, _ = openFileStore(dir, syncAlways, 0)
+	cfg := defaultConfig()
+	cfg.FrontendDir = ""
+	cfg.MetricsToken = "secret"
+	hub, _ := openEventHub(cfg, store)
+	srv := httptest.NewServer(newServer(cfg, hub, newAuthenticator(nil)))
+	defer srv.Close()
+	client := srv.Client()
+
+	if status, body := getHealth(t, client, srv.URL+"/healthz"); status != http.StatusOK || body.Status != statusOK {
+		t.Fatalf("healthz: %d %+v", status, body)
+	}
+	status, body := getHealth(t, client, srv.URL+"/readyz")
+	if status != http.StatusOK || body.Status != statusOK || len(body.Components) != 3 {
+		t.Fatalf("readyz: %d %+v", status, body)
+	}
+	for _, c := range body.Components {
+		if c.Detail != "" {
+			t.Fatalf("details must not be shown without the token, got %+v", c)
+		}
+	}
+	_, body = getHealthAs(t, client, srv.URL+"/readyz", "secret")
+	if body.Components[1] != (componentHealth{Name: "store", Status: statusOK, Detail: "recovered 1 tenants"}) {
+		t.Fatalf("unexpected store component %+v", body.Components[1])
+	}
+
+	// not ready ahead of a shutdown, but still serving
+	hub.markUnready()
+	status, body = getHealth(t, client, srv.URL+"/readyz")
+	if status != http.StatusServiceUnavailable || body.Status != statusUnavailable || componentStatus(body, "hub") != statusDraining {
+		t.Fatalf("readyz while draining: %d %+v", status, body)
+	}
+	postEvent(t, client, srv.URL, "tenantA", "still accepted")
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA")
+	if err != nil {
+		t.Fatalf("handshakes should be accepted until the drain starts: %v", err)
+	}
+	defer ws.Close()
+	if status, _ := getHealth(t, client, srv.URL+"/healthz"); status != http.StatusOK {
+		t.Fatalf("liveness should not depend on readiness, got %d", status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	hub.shutdown(ctx)
+	hub.closeStore()
+	status, body = getHealth(t, client, srv.URL+"/readyz")
+	if status != http.StatusServiceUnavailable || componentStatus(body, "store") != statusUnavailable {
+		t.Fatalf("readyz after close: %d %+v", status, body)
+	}
+
+	resp, err := client.Post(srv.URL+"/readyz", "application/json", nil)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestReadyzInMemory(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.FrontendDir = ""
+	cfg.MetricsToken = "secret"
+	srv := httptest.NewServer(newServer(cfg, newEventHub(cfg), newAuthenticator(nil)))
+	defer srv.Close()
+	status, body := getHealthAs(t, srv.Client(), srv.URL+"/readyz", "secret")
+	if status != http.StatusOK || body.Components[1].Detail != "in memory" {
+		t.Fatalf("readyz: %d %+v", status, body)
+	}
+}
+
+func TestReadinessLogChangesOnly(t *testing.T) {
+	var buf bytes.Buffer
+	orig := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(orig)
+
+	var l readinessLog
+	draining := componentHealth{Name: "hub", Status: statusDraining, Detail: "shutting down"}
+	l.observe(componentHealth{Name: "hub", Status: statusOK})
+	for i := 0; i < 10; i++ {
+		l.observe(draining)
+	}
+	l.observe(componentHealth{Name: "hub", Status: statusOK})
+	if n := strings.Count(buf.String(), "readyz: hub"); n != 2 {
+		t.Fatalf("expected one line per change, got %d:\n%s", n, buf.String())
+	}
+}
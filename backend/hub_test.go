@@ -9,6 +9,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 // fakeConn records written messages
@@ -40,7 +41,7 @@ func (e *errConn) Close() error {
 }
 
 func TestTenantIsolation(t *testing.T) {
-	hub := newEventHub()
+	hub := newEventHub(defaultConfig())
 	cA := &fakeConn{}
 	cB := &fakeConn{}
 
@@ -59,7 +60,7 @@ func TestTenantIsolation(t *testing.T) {
 }
 
 func TestFailingConnectionRemoval(t *testing.T) {
-	hub := newTenantHub()
+	hub := newTenantHub(defaultMaxEvents)
 	c := &errConn{}
 	var buf bytes.Buffer
 	orig := log.Writer()
@@ -67,7 +68,7 @@ func TestFailingConnectionRemoval(t *testing.T) {
 	defer log.SetOutput(orig)
 
 	hub.addConn(c)
-	_ = hub.addEvent(Event{TenantID: "t1"})
+	_, _ = hub.addEvent(Event{TenantID: "t1"})
 
 	hub.mu.Lock()
 	_, exists := hub.connections[c]
@@ -84,29 +85,32 @@ func TestFailingConnectionRemoval(t *testing.T) {
 }
 
 func TestEventHistoryLimit(t *testing.T) {
-	hub := newTenantHub()
-	for i := 0; i < maxEvents+10; i++ {
-		_ = hub.addEvent(Event{TenantID: "t1", Message: fmt.Sprintf("%d", i)})
+	hub := newTenantHub(defaultMaxEvents)
+	for i := 0; i < defaultMaxEvents+10; i++ {
+		_, _ = hub.addEvent(Event{TenantID: "t1", Message: fmt.Sprintf("%d", i)})
 	}
 	hub.mu.Lock()
 	count := len(hub.events)
 	first := hub.events[0].Message
 	last := hub.events[len(hub.events)-1].Message
 	hub.mu.Unlock()
-	if count != maxEvents {
-		t.Fatalf("expected %d events, got %d", maxEvents, count)
+	if count != defaultMaxEvents {
+		t.Fatalf("expected %d events, got %d", defaultMaxEvents, count)
 	}
 	if first != "10" {
 		t.Fatalf("expected oldest message to be '10', got %s", first)
 	}
-	if last != fmt.Sprintf("%d", maxEvents+9) {
-		t.Fatalf("expected last message to be %d, got %s", maxEvents+9, last)
+	if last != fmt.Sprintf("%d", defaultMaxEvents+9) {
+		t.Fatalf("expected last message to be %d, got %s", defaultMaxEvents+9, last)
 	}
 }
 
 func TestPostEventSetsElapsed(t *testing.T) {
-	hub := newEventHub()
-	e := hub.postEvent("tenant1", "msg")
+	hub := newEventHub(defaultConfig())
+	e, err := hub.postEvent("tenant1", "msg")
+	if err != nil {
+		t.Fatalf("postEvent: %v", err)
+	}
 	if e.Elapsed == "" {
 		t.Fatalf("expected elapsed to be set")
 	}
@@ -123,10 +127,254 @@ func TestPostEventSetsElapsed(t *testing.T) {
 }
 
 func BenchmarkPostEvent(b *testing.B) {
-	hub := newEventHub()
+	hub := newEventHub(defaultConfig())
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		hub.postEvent("bench", "msg")
 	}
 }
+
+func TestHistoryPaging(t *testing.T) {
+	hub := newTenantHub(defaultMaxEvents)
+	base := time.Date(2025, 7, 31, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		hub.addEvent(Event{
+			ID:        fmt.Sprintf("e%d", i),
+			TenantID:  "t1",
+			Message:   fmt.Sprintf("%d", i),
+			Timestamp: base.Add(time.Duration(i) * time.Second),
+		})
+	}
+	ids := func(events []Event) string {
+		var s []string
+		for _, e := range events {
+			s = append(s, e.ID)
+		}
+		return strings.Join(s, ",")
+	}
+
+	testCases := []struct {
+		name   string
+		query  historyQuery
+		expect string
+		more   bool
+	}{
+		{"latest", historyQuery{Limit: 3}, "e7,e8,e9", true},
+		{"all", historyQuery{Limit: 100}, "e0,e1,e2,e3,e4,e5,e6,e7,e8,e9", false},
+		{"before", historyQuery{Limit: 3, Before: "e7"}, "e4,e5,e6", true},
+		{"before start", historyQuery{Limit: 3, Before: "e2"}, "e0,e1", false},
+		{"after", historyQuery{Limit: 3, After: "e2"}, "e3,e4,e5", true},
+		{"after end", historyQuery{Limit: 3, After: "e8"}, "e9", false},
+		{"between", historyQuery{Limit: 10, After: "e2", Before: "e6"}, "e3,e4,e5", false},
+		{"since", historyQuery{Limit: 10, Since: base.Add(8 * time.Second)}, "e8,e9", false},
+		{"until", historyQuery{Limit: 10, Until: base.Add(2 * time.Second)}, "e0,e1", false},
+		{"range", historyQuery{Limit: 2, Since: base.Add(3 * time.Second), Until: base.Add(7 * time.Second)}, "e5,e6", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			events, more, err := hub.history(tc.query)
+			if err != nil {
+				t.Fatalf("history: %v", err)
+			}
+			if got := ids(events); got != tc.expect {
+				t.Fatalf("expected %s, got %s", tc.expect, got)
+			}
+			if more != tc.more {
+				t.Fatalf("expected has_more=%v, got %v", tc.more, more)
+			}
+		})
+	}
+
+	if _, _, err := hub.history(historyQuery{Limit: 1, After: "missing"}); !errors.Is(err, errCursorNotFound) {
+		t.Fatalf("expected errCursorNotFound, got %v", err)
+	}
+}
+
+func TestResumeConn(t *testing.T) {
+	hub := newTenantHub(defaultMaxEvents)
+	for i := 0; i < 5; i++ {
+		hub.addEvent(Event{ID: fmt.Sprintf("e%d", i), TenantID: "t1"})
+	}
+
+	c := &fakeConn{}
+	if err := hub.resumeConn(c, "e2"); err != nil {
+		t.Fatalf("resumeConn: %v", err)
+	}
+	hub.addEvent(Event{ID: "e5", TenantID: "t1"})
+	var got []string
+	for _, e := range c.msgs {
+		got = append(got, e.ID)
+	}
+	if strings.Join(got, ",") != "e3,e4,e5" {
+		t.Fatalf("expected e3,e4,e5 without gaps or duplicates, got %v", got)
+	}
+}
+
+// rawConn records written values without converting them to events
+type rawConn struct {
+	mu   sync.Mutex
+	msgs []interface{}
+}
+
+func (r *rawConn) WriteJSON(v interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, v)
+	return nil
+}
+
+func (r *rawConn) Close() error { return nil }
+
+func TestResumeConnTruncated(t *testing.T) {
+	hub := newTenantHub(defaultMaxEvents)
+	hub.addEvent(Event{ID: "e0", TenantID: "t1"})
+	hub.addEvent(Event{ID: "e1", TenantID: "t1"})
+
+	c := &rawConn{}
+	if err := hub.resumeConn(c, "evicted"); err != nil {
+		t.Fatalf("resumeConn: %v", err)
+	}
+	if len(c.msgs) != 3 {
+		t.Fatalf("expected truncation notice and 2 events, got %d messages", len(c.msgs))
+	}
+	ctrl, ok := c.msgs[0].(controlMessage)
+	if !ok || ctrl.Op != opHistoryTruncated || ctrl.Since != "evicted" {
+		t.Fatalf("expected history_truncated first, got %+v", c.msgs[0])
+	}
+	if e, ok := c.msgs[1].(Event); !ok || e.ID != "e0" {
+		t.Fatalf("expected replay from oldest stored event, got %+v", c.msgs[1])
+	}
+}
+
+func TestSequenceOrder(t *testing.T) {
+	hub := newEventHub(defaultConfig())
+	conns := make([]*fakeConn, 4)
+	for i := range conns {
+		conns[i] = &fakeConn{}
+		hub.registerConn("t1", conns[i])
+	}
+	var wg sync.WaitGroup
+	for p := 0; p < 8; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				hub.postEvent("t1", fmt.Sprintf("p%d-%d", p, i))
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	events, _, _ := hub.history("t1", historyQuery{Limit: defaultMaxEvents})
+	if len(events) != 400 {
+		t.Fatalf("expected 400 events, got %d", len(events))
+	}
+	for i, e := range events {
+		if e.Seq != uint64(i+1) {
+			t.Fatalf("history out of sequence at %d: seq %d", i, e.Seq)
+		}
+	}
+	for n, c := range conns {
+		if len(c.msgs) != len(events) {
+			t.Fatalf("conn %d got %d events, want %d", n, len(c.msgs), len(events))
+		}
+		for i, e := range c.msgs {
+			if e.ID != events[i].ID || e.Seq != events[i].Seq {
+				t.Fatalf("conn %d saw %s (seq %d) at %d, history has %s", n, e.ID, e.Seq, i, events[i].ID)
+			}
+		}
+	}
+}
+
+func TestResyncConn(t *testing.T) {
+	hub := newTenantHub(defaultMaxEvents)
+	for i := 0; i < defaultMaxEvents+5; i++ {
+		hub.addEvent(Event{ID: fmt.Sprintf("e%d", i), TenantID: "t1"})
+	}
+	c := &rawConn{}
+	hub.addConn(c)
+
+	if err := hub.resyncConn(c, defaultMaxEvents+2); err != nil {
+		t.Fatalf("resyncConn: %v", err)
+	}
+	if len(c.msgs) != 3 || c.msgs[0].(Event).Seq != defaultMaxEvents+3 {
+		t.Fatalf("expected the 3 events after the gap, got %+v", c.msgs)
+	}
+
+	c.msgs = nil
+	if err := hub.resyncConn(c, 2); err != nil {
+		t.Fatalf("resyncConn: %v", err)
+	}
+	ctrl, ok := c.msgs[0].(controlMessage)
+	if !ok || ctrl.Op != opHistoryTruncated || ctrl.SinceSeq != 2 || len(c.msgs) != defaultMaxEvents+1 {
+		t.Fatalf("expected history_truncated and the whole window, got %d messages starting %+v", len(c.msgs), c.msgs[0])
+	}
+
+	// a client ahead of the server, as after a restart without a store,
+	// is told to reset and gets every stored event
+	c.msgs = nil
+	if err := hub.resyncConn(c, 5*defaultMaxEvents); err != nil {
+		t.Fatalf("resyncConn: %v", err)
+	}
+	ctrl, ok = c.msgs[0].(controlMessage)
+	if !ok || ctrl.Op != opSeqReset || ctrl.SinceSeq != 5*defaultMaxEvents || len(c.msgs) != defaultMaxEvents+1 {
+		t.Fatalf("expected seq_reset and the whole window, got %d messages starting %+v", len(c.msgs), c.msgs[0])
+	}
+
+	// an unregistered connection gets nothing
+	other := &rawConn{}
+	if err := hub.resyncConn(other, 0); err != errNotRegistered {
+		t.Fatalf("expected errNotRegistered, got %v", err)
+	}
+	if len(other.msgs) != 0 {
+		t.Fatalf("unregistered connection should not be replayed to, got %d", len(other.msgs))
+	}
+}
+
+func TestPrevSeq(t *testing.T) {
+	hub := newTenantHub(defaultMaxEvents)
+	c := &fakeConn{}
+	hub.addConn(c, subscription{Pattern: "orders"})
+	for _, topic := range []string{"orders", "alerts", "alerts", "orders", "orders"} {
+		hub.addEvent(Event{TenantID: "t1", Topic: topic})
+	}
+	// seq jumps where the subscription skips events, prev_seq does not
+	var got []string
+	for _, e := range c.msgs {
+		got = append(got, fmt.Sprintf("%d<-%d", e.Seq, e.PrevSeq))
+	}
+	if want := "1<-0,4<-1,5<-4"; strings.Join(got, ",") != want {
+		t.Fatalf("expected %s, got %s", want, strings.Join(got, ","))
+	}
+
+	// a resume by seq chains from the client's seq and live events follow
+	// the replay
+	resumed := &fakeConn{}
+	hub.resumeConnSeq(resumed, 1, subscription{Pattern: "orders"})
+	hub.addEvent(Event{TenantID: "t1", Topic: "orders"})
+	got = nil
+	for _, e := range resumed.msgs {
+		got = append(got, fmt.Sprintf("%d<-%d", e.Seq, e.PrevSeq))
+	}
+	if want := "4<-1,5<-4,6<-5"; strings.Join(got, ",") != want {
+		t.Fatalf("expected %s, got %s", want, strings.Join(got, ","))
+	}
+
+	// the stored events do not carry it
+	if e := hub.events[len(hub.events)-1]; e.PrevSeq != 0 {
+		t.Fatalf("stored event has prev_seq %d", e.PrevSeq)
+	}
+}
+
+func TestNumberRestored(t *testing.T) {
+	legacy := []Event{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+	if last := numberRestored(legacy); last != 3 || legacy[0].Seq != 1 {
+		t.Fatalf("legacy log numbered %d..%d", legacy[0].Seq, last)
+	}
+	// after an upgrade the unnumbered tail keeps the numbers it had
+	mixed := []Event{{ID: "b"}, {ID: "c"}, {ID: "d", Seq: 4}, {ID: "e", Seq: 5}}
+	if last := numberRestored(mixed); last != 5 || mixed[0].Seq != 2 || mixed[1].Seq != 3 {
+		t.Fatalf("mixed log numbered %+v", mixed)
+	}
+}
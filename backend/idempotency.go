@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// replayedHeader marks a response answered from a remembered publish
+	replayedHeader           = "Idempotent-Replayed"
+	defaultIdempotencyWindow = 24 * time.Hour
+	maxIdempotencyKeyLength  = 255
+	maxIdempotencyKeys       = 10000 // per tenant; the oldest are forgotten first
+	// maxIdempotencyBytes bounds the events remembered per tenant, as
+	// estimated by publishSize
+	maxIdempotencyBytes = 32 << 20
+)
+
+// Kinds of idempotent publish, one per response shape; a key is only
+// replayed for a request of the same kind
+const (
+	fingerprintEvent  = "event"
+	fingerprintEvents = "events"
+	fingerprintBatch  = "batch"
+)
+
+var (
+	errInvalidIdempotencyKey = &publishError{status: http.StatusBadRequest, msg: "invalid idempotency key"}
+	errIdempotencyConflict   = &publishError{status: http.StatusConflict, msg: "idempotency key reused with a different request"}
+)
+
+// idempotentPublish is a publish made under an idempotency key. done is
+// closed once it has finished; events is its result when it succeeded.
+type idempotentPublish struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	events      []Event
+	size        int
+	done        chan struct{}
+	expires     time.Time
+}
+
+// idempotencyKeys remembers one tenant's publishes by idempotency key so
+// that a retried request returns the stored events instead of posting
+// them again. Only successful publishes are remembered; a failed one
+// releases its key for the retry.
+type idempotencyKeys struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentPublish
+	order   []*idempotentPublish // oldest first
+	bytes   int                  // publishSize of the remembered events
+}
+
+// begin claims key for a publish of the given fingerprint. It returns the
+// remembered publish when the key was already used, waiting for it if it
+// is still in flight, or a new entry owned by the caller, who must pass it
+// to finish.
+func (k *idempotencyKeys) begin(key string, fingerprint [sha256.Size]byte, now time.Time) (p *idempotentPublish, owner bool, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for {
+		k.expire(now)
+		prev, ok := k.entries[key]
+		if !ok {
+			break
+		}
+		if prev.fingerprint != fingerprint {
+			return nil, false, errIdempotencyConflict
+		}
+		select {
+		case <-prev.done:
+			return prev, false, nil
+		default:
+		}
+		k.mu.Unlock()
+		<-prev.done
+		k.mu.Lock()
+	}
+	if k.entries == nil {
+		k.entries = make(map[string]*idempotentPublish)
+	}
+	p = &idempotentPublish{key: key, fingerprint: fingerprint, done: make(chan struct{})}
+	k.entries[key] = p
+	k.order = append(k.order, p)
+	return p, true, nil
+}
+
+// finish records the outcome of a publish started by begin. Successful
+// publishes are remembered until window has passed.
+func (k *idempotencyKeys) finish(p *idempotentPublish, events []Event, err error, window time.Duration, now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err != nil {
+		if k.entries[p.key] == p {
+			delete(k.entries, p.key)
+		}
+		// drop its record too; expire stops at the first remembered
+		// publish, so one left behind it would never be collected
+		if i := slices.Index(k.order, p); i >= 0 {
+			k.order = slices.Delete(k.order, i, i+1)
+		}
+	} else {
+		p.events = events
+		p.size = publishSize(events)
+		p.expires = now.Add(window)
+		k.bytes += p.size
+	}
+	close(p.done)
+}
+
+// expire forgets finished publishes whose window has passed, and the
+// oldest ones while more than maxIdempotencyKeys or maxIdempotencyBytes
+// are remembered. Publishes still in flight are kept in place.
+// The caller must hold k.mu.
+func (k *idempotencyKeys) expire(now time.Time) {
+	var inFlight []*idempotentPublish
+	i := 0
+	for ; i < len(k.order); i++ {
+		p := k.order[i]
+		if k.entries[p.key] != p {
+			continue // already forgotten
+		}
+		select {
+		case <-p.done:
+		default:
+			inFlight = append(inFlight, p)
+			continue
+		}
+		if now.Before(p.expires) && len(k.entries) <= maxIdempotencyKeys && k.bytes <= maxIdempotencyBytes {
+			break
+		}
+		delete(k.entries, p.key)
+		k.bytes -= p.size
+	}
+	n := copy(k.order, inFlight)
+	n += copy(k.order[n:], k.order[i:])
+	clear(k.order[n:])
+	k.order = k.order[:n]
+}
+
+// publishSize estimates the memory held by events
+func publishSize(events []Event) int {
+	n := 0
+	for _, e := range events {
+		n += 128 + len(e.ID) + len(e.TenantID) + len(e.Topic) + len(e.Type) + len(e.Source) +
+			len(e.Subject) + len(e.Message) + len(e.Data) + len(e.Elapsed)
+		for k, v := range e.Metadata {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
+
+// validIdempotencyKey accepts 1-255 bytes of printable ASCII
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// publishFingerprint identifies the content of a publish independently of
+// its encoding, so a retry matches even if the client re-serialized it
+func publishFingerprint(kind string, reqs []eventRequest) [sha256.Size]byte {
+	b, _ := json.Marshal(struct {
+		Kind     string         `json:"kind"`
+		Requests []eventRequest `json:"requests"`
+	}{kind, reqs})
+	return sha256.Sum256(b)
+}
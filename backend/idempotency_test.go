@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	var keys idempotencyKeys
+	now := time.Date(2025, 7, 31, 12, 0, 0, 0, time.UTC)
+	a := publishFingerprint(fingerprintEvent, []eventRequest{{Message: "a"}})
+	b := publishFingerprint(fingerprintEvent, []eventRequest{{Message: "b"}})
+
+	p, owner, err := keys.begin("k1", a, now)
+	if err != nil || !owner {
+		t.Fatalf("first use should own the key, got %v %v", owner, err)
+	}
+	keys.finish(p, []Event{{ID: "e1"}}, nil, time.Minute, now)
+	if p, owner, err := keys.begin("k1", a, now.Add(30*time.Second)); err != nil || owner || p.events[0].ID != "e1" {
+		t.Fatalf("repeat should return the stored events, got %v %v", owner, err)
+	}
+	if _, _, err := keys.begin("k1", b, now); err != errIdempotencyConflict {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	if _, owner, _ := keys.begin("k1", b, now.Add(2*time.Minute)); !owner {
+		t.Fatalf("key should be reusable after the window")
+	}
+
+	// a failed publish releases the key
+	p, _, _ = keys.begin("k2", a, now)
+	keys.finish(p, nil, errStoreFailed, time.Minute, now)
+	if _, owner, _ := keys.begin("k2", a, now); !owner {
+		t.Fatalf("failed publish should not be remembered")
+	}
+}
+
+func TestIdempotencyKeysFailedRetries(t *testing.T) {
+	var keys idempotencyKeys
+	now := time.Date(2025, 7, 31, 12, 0, 0, 0, time.UTC)
+	fp := publishFingerprint(fingerprintEvent, nil)
+
+	// a remembered publish ahead of the retries stops expire early
+	p, _, _ := keys.begin("kept", fp, now)
+	keys.finish(p, []Event{{ID: "e1"}}, nil, time.Hour, now)
+	for i := 0; i < 1000; i++ {
+		p, owner, err := keys.begin("retry", fp, now)
+		if err != nil || !owner {
+			t.Fatalf("retry %d should own the key, got %v %v", i, owner, err)
+		}
+		keys.finish(p, nil, errStoreFailed, time.Hour, now)
+	}
+	if len(keys.order) != 1 || len(keys.entries) != 1 {
+		t.Fatalf("failed retries should not be kept, got %d records for %d keys", len(keys.order), len(keys.entries))
+	}
+}
+
+func TestIdempotencyKeysExpiry(t *testing.T) {
+	var keys idempotencyKeys
+	now := time.Date(2025, 7, 31, 12, 0, 0, 0, time.UTC)
+	fp := publishFingerprint(fingerprintEvent, nil)
+
+	// a publish still in flight does not hold back the expiry of later ones
+	slow, _, _ := keys.begin("slow", fp, now)
+	p, _, _ := keys.begin("k1", fp, now)
+	keys.finish(p, []Event{{ID: "e1"}}, nil, time.Minute, now)
+	if _, owner, _ := keys.begin("k1", fp, now.Add(2*time.Minute)); !owner {
+		t.Fatal("expired key behind an in-flight publish should be forgotten")
+	}
+	if _, ok := keys.entries["slow"]; !ok {
+		t.Fatal("in-flight publish must be kept")
+	}
+	keys.finish(slow, nil, errStoreFailed, time.Minute, now)
+
+	// large publishes are forgotten oldest first once over the byte bound
+	big := strings.Repeat("x", maxIdempotencyBytes/2)
+	for _, key := range []string{"a", "b", "c"} {
+		p, _, _ := keys.begin(key, fp, now)
+		keys.finish(p, []Event{{Message: big}}, nil, time.Hour, now)
+	}
+	keys.begin("d", fp, now)
+	if _, ok := keys.entries["a"]; ok || keys.bytes > maxIdempotencyBytes {
+		t.Fatalf("oldest publish should be forgotten, %d bytes remembered", keys.bytes)
+	}
+	if _, ok := keys.entries["c"]; !ok {
+		t.Fatal("newest publish should be remembered")
+	}
+}
+
+func TestIdempotentPublish(t *testing.T) {
+	srv, hub := setupTestServer()
+	defer srv.Close()
+	client := srv.Client()
+
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	post := func(tenant, key, body string) (int, string, http.Header) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/events", strings.NewReader(body))
+		req.Header.Set("X-Tenant-ID", tenant)
+		if key != "" {
+			req.Header.Set(idempotencyHeader, key)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b), resp.Header
+	}
+
+	status, first, h := post("tenantA", "order-17", `{"message":"hello","data":{"n":1}}`)
+	if status != http.StatusOK || h.Get(replayedHeader) != "" {
+		t.Fatalf("first publish: %d %s", status, first)
+	}
+	// the same request, serialized differently, is a retry
+	status, again, h := post("tenantA", "order-17", `{ "data": {"n": 1}, "message": "hello" }`)
+	if status != http.StatusOK || again != first || h.Get(replayedHeader) != "true" {
+		t.Fatalf("retry should return the original event, got %d %s", status, again)
+	}
+	if status, body, _ := post("tenantA", "order-17", `{"message":"changed"}`); status != http.StatusConflict {
+		t.Fatalf("expected 409 for a different body, got %d %s", status, body)
+	}
+	if status, _, _ := post("tenantA", strings.Repeat("k", maxIdempotencyKeyLength+1), `{"message":"x"}`); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid key, got %d", status)
+	}
+	// keys are per tenant
+	if status, body, h := post("tenantB", "order-17", `{"message":"changed"}`); status != http.StatusOK || h.Get(replayedHeader) != "" {
+		t.Fatalf("another tenant's key should not interfere, got %d %s", status, body)
+	}
+
+	// concurrent retries post once
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, bodies[i], _ = post("tenantA", "burst", `{"message":"once"}`)
+		}(i)
+	}
+	wg.Wait()
+	for _, b := range bodies[1:] {
+		if b != bodies[0] {
+			t.Fatalf("concurrent retries returned different events: %s vs %s", b, bodies[0])
+		}
+	}
+
+	var original Event
+	json.Unmarshal([]byte(first), &original)
+	if ev := readEvent(t, ws); ev.ID != original.ID {
+		t.Fatalf("expected broadcast of %s, got %+v", original.ID, ev)
+	}
+	if ev := readEvent(t, ws); ev.Message != "once" {
+		t.Fatalf("expected the burst event, got %+v", ev)
+	}
+	var extra Event
+	if err := ws.ReadJSON(&extra, 200*time.Millisecond); err == nil {
+		t.Fatalf("retries must not be broadcast again, got %+v", extra)
+	}
+	if events, _, _ := hub.history("tenantA", historyQuery{Limit: 10}); len(events) != 2 {
+		t.Fatalf("expected 2 stored events, got %d", len(events))
+	}
+}
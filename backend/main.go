@@ -1,11 +1,25 @@
 package main
 
 import (
-	"encoding/json"
-	"io"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
-	"path/filepath"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultShutdownDelay keeps serving after readiness fails for long
+	// enough that a readiness probe every second failing three times in a
+	// row sees it before handshakes are refused
+	defaultShutdownDelay = 5 * time.Second
+	// defaultDrainTimeout bounds a graceful shutdown unless configured otherwise
+	defaultDrainTimeout = 10 * time.Second
 )
 
 func init() {
@@ -13,47 +27,152 @@ func init() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.LUTC)
 }
 
-func newServer() http.Handler {
-	hub := newEventHub()
+func newServer(cfg Config, hub *EventHub, auth *authenticator) http.Handler {
 	mux := http.NewServeMux()
+	handle := func(pattern string, h http.Handler) {
+		mux.Handle(pattern, hub.metrics.instrument(pattern, h))
+	}
 
-	frontendDir := filepath.Join("..", "frontend")
-	fs := http.FileServer(http.Dir(frontendDir))
-	mux.Handle("/static/", http.StripPrefix("/static/", fs))
-	mux.Handle("/", fs)
-	mux.HandleFunc("/ws", serveWS(hub))
-	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		tenantID := r.Header.Get("X-Tenant-ID")
-		if tenantID == "" {
-			http.Error(w, "missing tenant header", http.StatusBadRequest)
-			return
-		}
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
-			return
-		}
-		var req struct {
-			Message string `json:"message"`
+	if cfg.FrontendDir != "" {
+		fs := http.FileServer(http.Dir(cfg.FrontendDir))
+		handle("/static/", http.StripPrefix("/static/", fs))
+		handle("/", fs)
+	}
+	handle("/ws", serveWS(hub, auth, cfg.Conn))
+	handle("/ws-tickets", serveTickets(auth))
+	handle("/events", serveEvents(hub, auth))
+	handle("/events/batch", serveBatch(hub, auth))
+	handle("/events/stream", serveSSE(hub, auth, cfg.Conn))
+	handle("/schemas", serveSchemas(hub, auth))
+	handle("/schemas/", serveSchemas(hub, auth))
+	handle("/metrics", serveMetrics(hub, cfg.MetricsToken))
+	handle("/healthz", serveHealthz())
+	handle("/readyz", serveReadyz(cfg, hub))
+	return mux
+}
+
+// openHub persists history under cfg.DataDir when it is set and keeps it
+// in memory otherwise
+func openHub(cfg Config) (*EventHub, error) {
+	if cfg.DataDir == "" {
+		return newEventHub(cfg), nil
+	}
+	store, err := openFileStore(cfg.DataDir, cfg.Fsync, defaultSyncGap)
+	if err != nil {
+		return nil, err
+	}
+	store.retain = cfg.MaxEvents
+	log.Printf("storing events in %s", cfg.DataDir)
+	return openEventHub(cfg, store)
+}
+
+// mintToken implements the "token" subcommand, which prints a tenant token
+// signed with EVENTFEED_TOKEN_SECRET
+func mintToken(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	tenant := fs.String("tenant", "", "tenant ID to issue the token for")
+	scope := fs.String("scope", scopePublish+" "+scopeRead, "space-separated scopes")
+	ttl := fs.Duration("ttl", time.Hour, "token lifetime")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	secret := os.Getenv("EVENTFEED_TOKEN_SECRET")
+	if secret == "" || *tenant == "" {
+		return errors.New("EVENTFEED_TOKEN_SECRET and -tenant are required")
+	}
+	if len(*tenant) > maxTenantLength {
+		return fmt.Errorf("-tenant must not exceed %d bytes", maxTenantLength)
+	}
+	now := time.Now()
+	token, err := newAuthenticator([]byte(secret)).signToken(tokenClaims{
+		Tenant:    *tenant,
+		Scope:     *scope,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(*ttl).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if err := mintToken(os.Args[2:]); err != nil {
+			log.Fatal(err)
 		}
-		if err := json.Unmarshal(body, &req); err != nil {
-			log.Printf("tenant %s: json parse error: %v", tenantID, err)
-			http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+	cfg, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	hub, err := openHub(cfg)
+	if err != nil {
+		log.Fatalf("open event store: %v", err)
+	}
+	auth := newAuthenticator([]byte(cfg.TokenSecret))
+	if cfg.TLSClientCA != "" {
+		auth.trustClientCerts(cfg.TLSClientTenants)
+	}
+	tlsConfig, certs, err := newTLSConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{Addr: cfg.Addr, Handler: newServer(cfg, hub, auth), TLSConfig: tlsConfig}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if certs != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go certs.watch(ctx, certPollInterval, hup)
+	}
+	served := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			log.Printf("listening on %s (https)", cfg.Addr)
+			served <- srv.ListenAndServeTLS("", "")
 			return
 		}
-		e := hub.postEvent(tenantID, req.Message)
-		log.Printf("tenant %s: event posted: %s (took %s)", tenantID, req.Message, e.Elapsed)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(e)
-	})
-	return mux
+		log.Printf("listening on %s", cfg.Addr)
+		served <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-served:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process
+	hub.markUnready()
+	if cfg.ShutdownDelay > 0 {
+		log.Printf("shutting down: not ready, serving for %s more", cfg.ShutdownDelay)
+		time.Sleep(cfg.ShutdownDelay)
+	}
+	log.Printf("shutting down, draining for up to %s", cfg.DrainTimeout)
+	if err := shutdown(srv, hub, cfg.DrainTimeout); err != nil {
+		log.Fatalf("shutdown: %v", err)
+	}
+	log.Println("shut down")
 }
 
-func main() {
-	log.Println("listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", newServer()))
+// shutdown stops srv and hub within timeout: publishes in flight finish,
+// every connection is closed with 1001 going away, open requests complete
+// and the event store is flushed. The store is closed even when the
+// deadline passes.
+func shutdown(srv *http.Server, hub *EventHub, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := hub.shutdown(ctx)
+	if serr := srv.Shutdown(ctx); err == nil {
+		err = serr
+	}
+	if cerr := hub.closeStore(); err == nil {
+		err = cerr
+	}
+	return err
 }
@@ -9,7 +9,7 @@ import (
 )
 
 func TestMainHTTPServer(t *testing.T) {
-	srv := httptest.NewServer(newServer())
+	srv := httptest.NewServer(newServer(defaultConfig(), newEventHub(defaultConfig()), newAuthenticator(nil)))
 	defer srv.Close()
 	client := srv.Client()
 
@@ -61,11 +61,11 @@ func TestMainHTTPServer(t *testing.T) {
 }
 
 func TestEventsMethodNotAllowed(t *testing.T) {
-	srv := httptest.NewServer(newServer())
+	srv := httptest.NewServer(newServer(defaultConfig(), newEventHub(defaultConfig()), newAuthenticator(nil)))
 	defer srv.Close()
 	client := srv.Client()
 
-	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/events", nil)
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/events", nil)
 	resp, err := client.Do(req)
 	if err != nil {
 		t.Fatalf("request: %v", err)
@@ -77,7 +77,7 @@ func TestEventsMethodNotAllowed(t *testing.T) {
 }
 
 func TestEventsBadJSON(t *testing.T) {
-	srv := httptest.NewServer(newServer())
+	srv := httptest.NewServer(newServer(defaultConfig(), newEventHub(defaultConfig()), newAuthenticator(nil)))
 	defer srv.Close()
 	client := srv.Client()
 
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// otherTenantsLabel collects the tenants beyond the labelled ones
+	otherTenantsLabel  = "_other"
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Histogram buckets in seconds
+var (
+	fanoutBuckets  = []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+	requestBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+// histogram counts observations into cumulative buckets as Prometheus
+// expects them
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative; the last is +Inf
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// write renders the histogram's series; labels, if any, are rendered
+// before le
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum := h.sum
+	h.mu.Unlock()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, n := range counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.buckets) {
+			le = formatFloat(h.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, le, cumulative)
+	}
+	braces := ""
+	if labels != "" {
+		braces = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces, cumulative)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// requestKey labels an HTTP request duration
+type requestKey struct {
+	route  string
+	status int
+}
+
+// metrics holds the hub-wide telemetry; per-tenant counters live on each
+// TenantHub. Only the first maxTenants tenants are labelled by ID so a
+// flood of tenants cannot blow up the number of series.
+type metrics struct {
+	fanout     *histogram
+	maxTenants int
+	labelled   int
+	mu         sync.Mutex
+	requests   map[requestKey]*histogram
+}
+
+func newMetrics(maxTenants int) *metrics {
+	return &metrics{
+		fanout:     newHistogram(fanoutBuckets),
+		maxTenants: maxTenants,
+		requests:   make(map[requestKey]*histogram),
+	}
+}
+
+// tenantLabel returns the label for a new tenant. The caller must hold
+// the hub lock, which orders tenant creation.
+func (m *metrics) tenantLabel(id string) string {
+	if m.labelled >= m.maxTenants {
+		return otherTenantsLabel
+	}
+	m.labelled++
+	return id
+}
+
+func (m *metrics) observeRequest(route string, status int, d time.Duration) {
+	key := requestKey{route, status}
+	m.mu.Lock()
+	h, ok := m.requests[key]
+	if !ok {
+		h = newHistogram(requestBuckets)
+		m.requests[key] = h
+	}
+	m.mu.Unlock()
+	h.observe(d)
+}
+
+// instrument records the duration and status of requests to route.
+// Upgraded WebSocket handshakes count as 101 and end with the handshake;
+// event streams are observed when they close.
+func (m *metrics) instrument(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		status := rec.status
+		switch {
+		case rec.hijacked:
+			status = http.StatusSwitchingProtocols
+		case status == 0:
+			status = http.StatusOK
+		}
+		m.observeRequest(route, status, time.Since(start))
+	})
+}
+
+// statusRecorder captures the status a handler writes while passing
+// flushes and hijacks through
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	c, rw, err := hj.Hijack()
+	if err == nil {
+		s.hijacked = true
+	}
+	return c, rw, err
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// tenantStats are one label's per-tenant values at scrape time
+type tenantStats struct {
+	connections, history                        int
+	posted, dropped, writeFailures, rateLimited uint64
+}
+
+// serveMetrics handles GET /metrics in the Prometheus text format. With a
+// token configured scrapers must present it as a bearer token.
+func serveMetrics(hub *EventHub, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", metricsContentType)
+		hub.writeMetrics(w)
+	}
+}
+
+// writeMetrics renders every metric in the Prometheus text format
+func (h *EventHub) writeMetrics(out io.Writer) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	h.mu.Lock()
+	tenants := make([]*TenantHub, 0, len(h.tenants))
+	for _, t := range h.tenants {
+		tenants = append(tenants, t)
+	}
+	h.mu.Unlock()
+	stats := make(map[string]*tenantStats)
+	for _, t := range tenants {
+		s := stats[t.metricLabel]
+		if s == nil {
+			s = &tenantStats{}
+			stats[t.metricLabel] = s
+		}
+		t.mu.Lock()
+		s.connections += len(t.connections)
+		s.history += len(t.events)
+		t.mu.Unlock()
+		s.posted += t.posted.Load()
+		s.dropped += t.dropped.Load()
+		s.writeFailures += t.writeFailures.Load()
+		s.rateLimited += t.rateLimited.Load()
+	}
+	labels := make([]string, 0, len(stats))
+	for l := range stats {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	metric(w, "eventfeed_tenants", "gauge", "Tenants known to the hub.")
+	fmt.Fprintf(w, "eventfeed_tenants %d\n", len(tenants))
+	perTenant := []struct {
+		name, typ, help string
+		value           func(*tenantStats) uint64
+	}{
+		{"eventfeed_connections", "gauge", "Open WebSocket and SSE connections.", func(s *tenantStats) uint64 { return uint64(s.connections) }},
+		{"eventfeed_history_events", "gauge", "Events held in history.", func(s *tenantStats) uint64 { return uint64(s.history) }},
+		{"eventfeed_events_posted_total", "counter", "Events posted.", func(s *tenantStats) uint64 { return s.posted }},
+		{"eventfeed_events_dropped_total", "counter", "Messages discarded from full or closed send queues.", func(s *tenantStats) uint64 { return s.dropped }},
+		{"eventfeed_write_failures_total", "counter", "Deliveries that failed and dropped the connection.", func(s *tenantStats) uint64 { return s.writeFailures }},
+		{"eventfeed_publishes_rate_limited_total", "counter", "Publishes refused by the rate limit.", func(s *tenantStats) uint64 { return s.rateLimited }},
+	}
+	// say in the help how tenants are labelled, since by default none are
+	labelling := fmt.Sprintf(` The first %d tenants are labelled by ID, later ones are summed under tenant="%s".`, h.metrics.maxTenants, otherTenantsLabel)
+	if h.metrics.maxTenants == 0 {
+		labelling = fmt.Sprintf(` All tenants are summed under tenant="%s"; set metrics_tenants (EVENTFEED_METRICS_TENANTS) and metrics_token to label them by ID.`, otherTenantsLabel)
+	}
+	for _, m := range perTenant {
+		metric(w, m.name, m.typ, m.help+labelling)
+		for _, l := range labels {
+			fmt.Fprintf(w, "%s{tenant=\"%s\"} %d\n", m.name, escapeLabel(l), m.value(stats[l]))
+		}
+	}
+
+	metric(w, "eventfeed_fanout_duration_seconds", "histogram", "Time to store and queue a publish to its subscribers.")
+	h.metrics.fanout.write(w, "eventfeed_fanout_duration_seconds", "")
+
+	h.metrics.mu.Lock()
+	keys := make([]requestKey, 0, len(h.metrics.requests))
+	for k := range h.metrics.requests {
+		keys = append(keys, k)
+	}
+	h.metrics.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].status < keys[j].status
+	})
+	metric(w, "eventfeed_http_request_duration_seconds", "histogram", "HTTP request durations by route and status.")
+	for _, k := range keys {
+		h.metrics.mu.Lock()
+		hist := h.metrics.requests[k]
+		h.metrics.mu.Unlock()
+		hist.write(w, "eventfeed_http_request_duration_seconds", fmt.Sprintf(`route="%s",status="%d"`, escapeLabel(k.route), k.status))
+	}
+}
+
+func metric(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
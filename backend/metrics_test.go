@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogram([]float64{0.001, 0.01})
+	h.observe(500 * time.Microsecond)
+	h.observe(time.Millisecond)
+	h.observe(5 * time.Millisecond)
+	h.observe(time.Second)
+	var b strings.Builder
+	h.write(&b, "x", `route="/a"`)
+	want := `x_bucket{route="/a",le="0.001"} 2
+x_bucket{route="/a",le="0.01"} 3
+x_bucket{route="/a",le="+Inf"} 4
+x_sum{route="/a"} 1.0065
+x_count{route="/a"} 4
+`
+	if b.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestQueueCountsDrops(t *testing.T) {
+	var drops atomic.Uint64
+	q := newSendQueue(1, dropNewest)
+	q.drops = &drops
+	for i := 0; i < 3; i++ {
+		q.push(queuedFrame{payload: []byte("x")}, true)
+	}
+	q.close(nil, true)
+	if drops.Load() != 3 || q.droppedCount() != 3 {
+		t.Fatalf("expected 3 drops, got %d (queue %d)", drops.Load(), q.droppedCount())
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.FrontendDir = ""
+	cfg.MetricsTenants = 1
+	cfg.MetricsToken = "scrape-me"
+	hub := newEventHub(cfg)
+	srv := httptest.NewServer(newServer(cfg, hub, newAuthenticator(nil)))
+	defer srv.Close()
+	client := srv.Client()
+
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	for _, tenant := range []string{"tenantA", "tenantA", "tenantB", "tenantC"} {
+		postEvent(t, client, srv.URL, tenant, "hello")
+	}
+
+	scrape := func(token string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("scrape: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusOK && resp.Header.Get("Content-Type") != metricsContentType {
+			t.Fatalf("unexpected content type %q", resp.Header.Get("Content-Type"))
+		}
+		return resp.StatusCode, string(b)
+	}
+	if status, _ := scrape("wrong"); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the metrics token, got %d", status)
+	}
+	status, body := scrape("scrape-me")
+	if status != http.StatusOK {
+		t.Fatalf("scrape: %d %s", status, body)
+	}
+	for _, line := range []string{
+		"# TYPE eventfeed_tenants gauge",
+		"eventfeed_tenants 3",
+		`eventfeed_connections{tenant="tenantA"} 1`,
+		`eventfeed_history_events{tenant="tenantA"} 2`,
+		`eventfeed_events_posted_total{tenant="tenantA"} 2`,
+		// tenants beyond metrics_tenants share one label
+		`eventfeed_events_posted_total{tenant="_other"} 2`,
+		`eventfeed_events_dropped_total{tenant="tenantA"} 0`,
+		`eventfeed_write_failures_total{tenant="_other"} 0`,
+		"eventfeed_fanout_duration_seconds_count 4",
+		`eventfeed_http_request_duration_seconds_count{route="/events",status="200"} 4`,
+		`eventfeed_http_request_duration_seconds_count{route="/metrics",status="401"} 1`,
+		`eventfeed_http_request_duration_seconds_count{route="/ws",status="101"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "tenantB") || strings.Contains(body, "tenantC") {
+		t.Fatalf("tenants beyond the label limit should not be named:\n%s", body)
+	}
+}
+
+func TestMetricsHideTenantsByDefault(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.FrontendDir = ""
+	hub := newEventHub(cfg)
+	srv := httptest.NewServer(newServer(cfg, hub, newAuthenticator(nil)))
+	defer srv.Close()
+	postEvent(t, srv.Client(), srv.URL, "tenantA", "hello")
+
+	resp, err := srv.Client().Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(b), `eventfeed_events_posted_total{tenant="_other"} 1`+"\n") {
+		t.Fatalf("expected the aggregate series in\n%s", b)
+	}
+	if strings.Contains(string(b), "tenantA") {
+		t.Fatalf("tenant IDs should not be exposed without opting in:\n%s", b)
+	}
+	if !strings.Contains(string(b), "# HELP eventfeed_events_posted_total Events posted. All tenants are summed under tenant=\"_other\"; set metrics_tenants") {
+		t.Fatalf("help should say how to label tenants:\n%s", b)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Control operations sent to subscribers alongside events. Control messages
+// always carry an "op" field, which events never do, so clients can tell
+// the two apart.
+const (
+	opHistoryTruncated = "history_truncated"
+	opSeqReset         = "seq_reset"
+	opAck              = "ack"
+	opError            = "error"
+)
+
+// Operations a WebSocket client may request
+const (
+	opPublish     = "publish"
+	opSubscribe   = "subscribe"
+	opUnsubscribe = "unsubscribe"
+	opResync      = "resync"
+)
+
+// controlMessage is a non-event message delivered to a subscriber. Since
+// or SinceSeq echo the resume point of a history_truncated or seq_reset
+// notice.
+type controlMessage struct {
+	Op       string `json:"op"`
+	Since    string `json:"since,omitempty"`
+	SinceSeq uint64 `json:"since_seq,omitempty"`
+}
+
+// clientRequest is the envelope of a message sent by a WebSocket client.
+// Ref is chosen by the client and echoed in the reply. Topic is the
+// pattern of a subscribe or unsubscribe request and Filter an optional
+// filter expression for a subscribe. Seq is the last sequence number a
+// resync request has seen.
+type clientRequest struct {
+	Op     string `json:"op"`
+	Ref    string `json:"ref,omitempty"`
+	Topic  string `json:"topic,omitempty"`
+	Filter string `json:"filter,omitempty"`
+	Seq    uint64 `json:"seq,omitempty"`
+}
+
+// replyMessage answers a clientRequest with either the resulting event or
+// an error. RetryAfter is set in seconds when the tenant is rate limited
+// and Violations when the event does not match its schema.
+type replyMessage struct {
+	Op         string            `json:"op"`
+	Ref        string            `json:"ref,omitempty"`
+	Event      *Event            `json:"event,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	RetryAfter int               `json:"retry_after,omitempty"`
+	Violations []schemaViolation `json:"violations,omitempty"`
+}
+
+// handleClientMessage serves one request read from a WebSocket. Publishes
+// are checked against the connection's claims and then go through the same
+// validation as POST /events, always for the connection's own tenant.
+// Subscriptions change which of the tenant's events c receives from now
+// on; they do not replay history. Subscribing again to a pattern replaces
+// its filter. A resync replays the stored events after a sequence number
+// and is acknowledged once the replay is queued; a connection takes one
+// resync at a time. A closeError is returned when the connection must be
+// failed: for a published event over the size limit of POST /events, and
+// with 1011 for a subscribe or resync on a connection the hub no longer
+// delivers to, which would otherwise be acknowledged and never served.
+func handleClientMessage(hub *EventHub, claims tokenClaims, c Conn, opcode byte, msg []byte) error {
+	if opcode != opText {
+		c.WriteJSON(replyMessage{Op: opError, Error: "binary messages are not supported"})
+		return nil
+	}
+	var req clientRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		c.WriteJSON(replyMessage{Op: opError, Error: "bad json"})
+		return nil
+	}
+	switch req.Op {
+	case opPublish:
+		if !claims.hasScope(scopePublish) {
+			c.WriteJSON(replyMessage{Op: opError, Ref: req.Ref, Error: errInsufficientScope.Error()})
+			return nil
+		}
+		if len(msg) > maxPublishBody {
+			return &closeError{code: closeMessageTooBig, reason: fmt.Sprintf("event larger than %d bytes", maxPublishBody)}
+		}
+		e, err := publish(hub, claims.Tenant, msg)
+		if err != nil {
+			c.WriteJSON(publishErrorReply(req.Ref, err))
+			return nil
+		}
+		c.WriteJSON(replyMessage{Op: opAck, Ref: req.Ref, Event: &e})
+	case opSubscribe:
+		if !validPattern(req.Topic) {
+			c.WriteJSON(replyMessage{Op: opError, Ref: req.Ref, Error: errInvalidTopic.Error()})
+			return nil
+		}
+		sub := subscription{Pattern: req.Topic}
+		if req.Filter != "" {
+			f, err := compileFilter(req.Filter)
+			if err != nil {
+				c.WriteJSON(replyMessage{Op: opError, Ref: req.Ref, Error: err.Error()})
+				return nil
+			}
+			sub.Filter = f
+		}
+		err := hub.subscribe(claims.Tenant, c, sub)
+		if errors.Is(err, errNotRegistered) {
+			return &closeError{code: closeInternalError, reason: err.Error()}
+		}
+		if err != nil {
+			c.WriteJSON(replyMessage{Op: opError, Ref: req.Ref, Error: err.Error()})
+			return nil
+		}
+		c.WriteJSON(replyMessage{Op: opAck, Ref: req.Ref})
+	case opUnsubscribe:
+		hub.unsubscribe(claims.Tenant, c, req.Topic)
+		c.WriteJSON(replyMessage{Op: opAck, Ref: req.Ref})
+	case opResync:
+		err := hub.resyncConn(claims.Tenant, c, req.Seq)
+		if errors.Is(err, errNotRegistered) {
+			return &closeError{code: closeInternalError, reason: err.Error()}
+		}
+		if errors.Is(err, errResyncPending) {
+			c.WriteJSON(replyMessage{Op: opError, Ref: req.Ref, Error: err.Error()})
+			return nil
+		}
+		if err != nil {
+			log.Printf("tenant %s: resync failed: %v", claims.Tenant, err)
+			c.Close()
+			return nil
+		}
+		c.WriteJSON(replyMessage{Op: opAck, Ref: req.Ref})
+	default:
+		log.Printf("tenant %s: unknown op %q", claims.Tenant, req.Op)
+		c.WriteJSON(replyMessage{Op: opError, Ref: req.Ref, Error: "unknown op"})
+	}
+	return nil
+}
+
+func publishErrorReply(ref string, err error) replyMessage {
+	reply := replyMessage{Op: opError, Ref: ref, Error: "internal error"}
+	var pe *publishError
+	if errors.As(err, &pe) {
+		reply.Error = pe.msg
+		reply.Violations = pe.violations
+		if pe.retryAfter > 0 {
+			reply.RetryAfter = waitSeconds(pe.retryAfter)
+		}
+	}
+	return reply
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// WriteJSON sends v to the server as a masked text frame
+func (w *wsClient) WriteJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	writeClientFrame(w.c, true, opText, b, true)
+	return nil
+}
+
+// readReply skips events until the next control message
+func readReply(t *testing.T, ws *wsClient) replyMessage {
+	t.Helper()
+	for {
+		var raw map[string]json.RawMessage
+		if err := ws.ReadJSON(&raw, time.Second); err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		if _, ok := raw["op"]; !ok {
+			continue
+		}
+		b, _ := json.Marshal(raw)
+		var reply replyMessage
+		json.Unmarshal(b, &reply)
+		return reply
+	}
+}
+
+func TestWebsocketPublish(t *testing.T) {
+	srv, hub := setupTestServer()
+	defer srv.Close()
+
+	wsA, err := dialWS(srv.URL + "/ws?tenant=tenantA")
+	if err != nil {
+		t.Fatalf("dial tenantA: %v", err)
+	}
+	defer wsA.Close()
+	wsB, err := dialWS(srv.URL + "/ws?tenant=tenantB")
+	if err != nil {
+		t.Fatalf("dial tenantB: %v", err)
+	}
+	defer wsB.Close()
+
+	wsA.WriteJSON(map[string]string{"op": "publish", "ref": "r1", "message": "hello"})
+	var ev Event
+	if err := wsA.ReadJSON(&ev, time.Second); err != nil || ev.Message != "hello" || ev.TenantID != "tenantA" {
+		t.Fatalf("publisher should receive its event: %+v (%v)", ev, err)
+	}
+	reply := readReply(t, wsA)
+	if reply.Op != opAck || reply.Ref != "r1" || reply.Event == nil || reply.Event.ID != ev.ID {
+		t.Fatalf("unexpected ack: %+v", reply)
+	}
+	if err := wsB.ReadJSON(&ev, 200*time.Millisecond); err == nil {
+		t.Fatalf("tenantB should not receive tenantA event")
+	}
+	events, _, _ := hub.history("tenantA", historyQuery{Limit: 10})
+	if len(events) != 1 || events[0].Message != "hello" {
+		t.Fatalf("event not stored: %+v", events)
+	}
+
+	cases := []struct {
+		name string
+		req  interface{}
+		want replyMessage
+	}{
+		{"bad message", map[string]interface{}{"op": "publish", "ref": "r2", "message": 42}, replyMessage{Op: opError, Ref: "r2", Error: "bad json"}},
+		{"unknown op", map[string]string{"op": "frobnicate", "ref": "r3"}, replyMessage{Op: opError, Ref: "r3", Error: "unknown op"}},
+		{"not an envelope", []int{1}, replyMessage{Op: opError, Error: "bad json"}},
+	}
+	for _, tc := range cases {
+		wsA.WriteJSON(tc.req)
+		if reply := readReply(t, wsA); !reflect.DeepEqual(reply, tc.want) {
+			t.Fatalf("%s: got %+v, want %+v", tc.name, reply, tc.want)
+		}
+	}
+}
+
+func TestWebsocketPublishRateLimited(t *testing.T) {
+	srv, hub := setupTestServer()
+	defer srv.Close()
+	hub.setRateLimits(rateLimits{Default: rateLimit{Rate: 0.1, Burst: 1}})
+
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	ws.WriteJSON(map[string]string{"op": "publish", "ref": "1", "message": "a"})
+	if reply := readReply(t, ws); reply.Op != opAck {
+		t.Fatalf("first publish should be acked: %+v", reply)
+	}
+	ws.WriteJSON(map[string]string{"op": "publish", "ref": "2", "message": "b"})
+	reply := readReply(t, ws)
+	if reply.Op != opError || reply.Ref != "2" || reply.Error != "rate limit exceeded" || reply.RetryAfter < 1 {
+		t.Fatalf("expected rate limit error, got %+v", reply)
+	}
+}
+
+func TestWebsocketPublishScope(t *testing.T) {
+	srv := httptest.NewServer(newServer(defaultConfig(), newEventHub(defaultConfig()), newAuthenticator(testSecret)))
+	defer srv.Close()
+	client := srv.Client()
+
+	readOnly := mustToken(t, "tenantA", scopeRead, time.Hour)
+	ws, err := dialWS(srv.URL + "/ws?ticket=" + issueTicket(t, client, srv.URL, readOnly))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	ws.WriteJSON(map[string]string{"op": "publish", "ref": "1", "message": "a"})
+	if reply := readReply(t, ws); reply.Op != opError || reply.Error != "insufficient scope" {
+		t.Fatalf("read-only ticket must not publish: %+v", reply)
+	}
+
+	both := mustToken(t, "tenantA", scopePublish+" "+scopeRead, time.Hour)
+	ws2, err := dialWS(srv.URL + "/ws?ticket=" + issueTicket(t, client, srv.URL, both))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws2.Close()
+	ws2.WriteJSON(map[string]string{"op": "publish", "ref": "2", "message": "a"})
+	if reply := readReply(t, ws2); reply.Op != opAck || reply.Event.TenantID != "tenantA" {
+		t.Fatalf("publish-scoped ticket should publish: %+v", reply)
+	}
+}
+
+func TestWebsocketResync(t *testing.T) {
+	srv, hub := setupTestServer()
+	defer srv.Close()
+	for i := 0; i < 5; i++ {
+		hub.postEvent("tenantA", fmt.Sprintf("m%d", i+1))
+	}
+
+	if _, err := dialWS(srv.URL + "/ws?tenant=tenantA&since_seq=x"); err == nil {
+		t.Fatalf("invalid since_seq should fail the handshake")
+	}
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA&since_seq=3")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	for _, want := range []uint64{4, 5} {
+		if ev := readEvent(t, ws); ev.Seq != want {
+			t.Fatalf("expected resume at seq %d, got %+v", want, ev)
+		}
+	}
+
+	ws.WriteJSON(map[string]interface{}{"op": "resync", "ref": "r1", "seq": 2})
+	for _, want := range []uint64{3, 4, 5} {
+		if ev := readEvent(t, ws); ev.Seq != want {
+			t.Fatalf("expected resync replay of seq %d, got %+v", want, ev)
+		}
+	}
+	if reply := readReply(t, ws); reply.Op != opAck || reply.Ref != "r1" {
+		t.Fatalf("expected resync ack, got %+v", reply)
+	}
+
+	// resuming past the server's numbering restarts from the oldest event
+	ahead, err := dialWS(srv.URL + "/ws?tenant=tenantA&since_seq=500")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ahead.Close()
+	if reply := readReply(t, ahead); reply.Op != opSeqReset {
+		t.Fatalf("expected seq_reset, got %+v", reply)
+	}
+	if ev := readEvent(t, ahead); ev.Seq != 1 {
+		t.Fatalf("expected replay from seq 1, got %+v", ev)
+	}
+
+	stream := dialSSE(t, srv.URL+"/events/stream?tenant=tenantA&since_seq=4", nil)
+	defer stream.Close()
+	if m := stream.next(t); !strings.Contains(m.data, `"seq":5`) {
+		t.Fatalf("expected sse resume at seq 5, got %+v", m)
+	}
+}
+
+func TestWebsocketPublishSizeLimit(t *testing.T) {
+	hub := newEventHub(defaultConfig())
+	opts := defaultConnOptions()
+	opts.MaxMessageSize = 2 * maxPublishBody
+	srv := httptest.NewServer(serveWS(hub, newAuthenticator(nil), opts))
+	defer srv.Close()
+
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	// fits the message limit but not the limit on a published event
+	ws.WriteJSON(map[string]string{"op": "publish", "ref": "1", "message": strings.Repeat("x", maxPublishBody)})
+	ws.c.SetReadDeadline(time.Now().Add(time.Second))
+	opcode, payload, err := readFrame(ws.r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if code, _, _ := parseClose(payload); opcode != opClose || code != closeMessageTooBig {
+		t.Fatalf("expected close 1009, got opcode %d %q", opcode, payload)
+	}
+	if events, _, _ := hub.history("tenantA", historyQuery{}); len(events) != 0 {
+		t.Fatalf("oversized event should not be stored, got %d", len(events))
+	}
+}
+
+func TestClientMessageUnregisteredConn(t *testing.T) {
+	hub := newEventHub(defaultConfig())
+	hub.postEvent("t1", "hello")
+	claims := tokenClaims{Tenant: "t1", Scope: scopeRead}
+	c := &rawConn{}
+
+	// a connection the hub dropped must not be acked as if it were served
+	for _, msg := range []string{
+		`{"op":"subscribe","ref":"1","topic":"orders"}`,
+		`{"op":"resync","ref":"2","seq":0}`,
+	} {
+		err := handleClientMessage(hub, claims, c, opText, []byte(msg))
+		ce, ok := err.(*closeError)
+		if !ok || ce.code != closeInternalError {
+			t.Fatalf("%s: expected close with 1011, got %v", msg, err)
+		}
+	}
+	if len(c.msgs) != 0 {
+		t.Fatalf("unregistered connection got replies %+v", c.msgs)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// overflowPolicy decides what happens when a connection's send queue is full
+type overflowPolicy int
+
+const (
+	// disconnect closes the connection; the client can resume with after
+	disconnect overflowPolicy = iota
+	// dropOldest discards the oldest queued message to make room
+	dropOldest
+	// dropNewest discards the message being sent
+	dropNewest
+)
+
+func (p overflowPolicy) String() string {
+	switch p {
+	case dropOldest:
+		return "drop-oldest"
+	case dropNewest:
+		return "drop-newest"
+	}
+	return "disconnect"
+}
+
+func parseOverflowPolicy(s string) (overflowPolicy, error) {
+	switch s {
+	case "", "disconnect":
+		return disconnect, nil
+	case "drop-oldest":
+		return dropOldest, nil
+	case "drop-newest":
+		return dropNewest, nil
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q", s)
+}
+
+var errSlowConsumer = errors.New("send queue full")
+
+// queuedFrame is a message waiting for a connection's writer
+type queuedFrame struct {
+	opcode  byte
+	payload []byte
+	// resync marks a frame of a resync replay
+	resync bool
+	// bounded marks a live message counted against the queue limit
+	bounded bool
+}
+
+// sendQueue buffers outbound messages between publishers and the single
+// goroutine writing to a connection, so publishing never waits on socket
+// I/O. Live messages and resync replays are each bounded by limit; the
+// history replayed on connect and control frames are not, and never count
+// towards the live bound.
+type sendQueue struct {
+	mu      sync.Mutex
+	items   []queuedFrame
+	limit   int
+	policy  overflowPolicy
+	ready   chan struct{}
+	closed  bool
+	final   *queuedFrame
+	dropped int
+	// bounded counts the queued live messages subject to limit
+	bounded int
+	// resyncing counts frames of a resync replay not yet written
+	resyncing int
+	// drops, when set, also counts dropped messages, for metrics
+	drops *atomic.Uint64
+}
+
+func newSendQueue(limit int, policy overflowPolicy) *sendQueue {
+	return &sendQueue{limit: limit, policy: policy, ready: make(chan struct{}, 1)}
+}
+
+// push queues f. When bounded and the queue is full the overflow policy
+// applies; under disconnect errSlowConsumer is returned and f is dropped.
+// Only bounded messages are ever dropped.
+func (q *sendQueue) push(f queuedFrame, bounded bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errConnClosed
+	}
+	if bounded && q.limit > 0 && q.bounded >= q.limit {
+		switch q.policy {
+		case dropOldest:
+			q.dropOldestBounded()
+		case dropNewest:
+			q.drop(1)
+			return nil
+		default:
+			return errSlowConsumer
+		}
+	}
+	if bounded {
+		f.bounded = true
+		q.bounded++
+	}
+	q.items = append(q.items, f)
+	q.signal()
+	return nil
+}
+
+// dropOldestBounded discards the oldest queued live message. The caller
+// must hold q.mu.
+func (q *sendQueue) dropOldestBounded() {
+	for i := range q.items {
+		if q.items[i].bounded {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			q.bounded--
+			q.drop(1)
+			return
+		}
+	}
+}
+
+// pushResync queues f as part of a resync replay. The unwritten frames of
+// a replay are bounded by limit on their own and are never dropped by the
+// overflow policy: errSlowConsumer is returned instead.
+func (q *sendQueue) pushResync(f queuedFrame) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errConnClosed
+	}
+	if q.limit > 0 && q.resyncing >= q.limit {
+		return errSlowConsumer
+	}
+	f.resync = true
+	q.items = append(q.items, f)
+	q.resyncing++
+	q.signal()
+	return nil
+}
+
+// resyncPending reports whether frames of a resync are still unwritten
+func (q *sendQueue) resyncPending() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.resyncing > 0
+}
+
+// resyncWritten is called by the writer for each resync frame it sent
+func (q *sendQueue) resyncWritten() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.resyncing > 0 {
+		q.resyncing--
+	}
+}
+
+// pushPong queues a pong answering a ping. A pong still waiting in the
+// queue is replaced instead, since only the latest ping needs an answer,
+// so a ping flood cannot grow the queue.
+func (q *sendQueue) pushPong(payload []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errConnClosed
+	}
+	for i := range q.items {
+		if q.items[i].opcode == opPong {
+			q.items[i].payload = payload
+			return nil
+		}
+	}
+	q.items = append(q.items, queuedFrame{opcode: opPong, payload: payload})
+	q.signal()
+	return nil
+}
+
+// close stops accepting messages. The writer sends final, if any, after
+// the frames still queued, or instead of them when discard is set.
+// Only the first call has an effect.
+func (q *sendQueue) close(final *queuedFrame, discard bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.final = final
+	if discard {
+		q.drop(len(q.items))
+		q.items = nil
+		q.bounded = 0
+		q.resyncing = 0
+	}
+	q.signal()
+}
+
+// drain removes the queued frames for the writer. done reports that the
+// queue is closed and the returned frames are the last ones.
+func (q *sendQueue) drain() (frames []queuedFrame, done bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	frames, q.items = q.items, nil
+	q.bounded = 0
+	if q.closed {
+		if q.final != nil {
+			frames = append(frames, *q.final)
+			q.final = nil
+		}
+		return frames, true
+	}
+	return frames, false
+}
+
+// drop counts n discarded messages. The caller must hold q.mu.
+func (q *sendQueue) drop(n int) {
+	q.dropped += n
+	if q.drops != nil {
+		q.drops.Add(uint64(n))
+	}
+}
+
+// droppedCount returns how many messages were discarded by the policy
+func (q *sendQueue) droppedCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func frameText(frames []queuedFrame) string {
+	s := ""
+	for _, f := range frames {
+		s += string(f.payload)
+	}
+	return s
+}
+
+func TestSendQueuePolicies(t *testing.T) {
+	testCases := []struct {
+		policy overflowPolicy
+		expect string
+		err    error
+	}{
+		{dropOldest, "bcd", nil},
+		{dropNewest, "abc", nil},
+		{disconnect, "abc", errSlowConsumer},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			q := newSendQueue(3, tc.policy)
+			var err error
+			for _, m := range []string{"a", "b", "c", "d"} {
+				err = q.push(queuedFrame{opcode: opText, payload: []byte(m)}, true)
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			frames, done := q.drain()
+			if got := frameText(frames); got != tc.expect || done {
+				t.Fatalf("expected %q, got %q (done=%v)", tc.expect, got, done)
+			}
+			if tc.err == nil && q.droppedCount() != 1 {
+				t.Fatalf("expected 1 dropped, got %d", q.droppedCount())
+			}
+		})
+	}
+}
+
+func TestSendQueueBacklogAndClose(t *testing.T) {
+	q := newSendQueue(1, disconnect)
+	for _, m := range []string{"a", "b", "c"} {
+		if err := q.push(queuedFrame{payload: []byte(m)}, false); err != nil {
+			t.Fatalf("unbounded push: %v", err)
+		}
+	}
+	q.close(&queuedFrame{opcode: opClose, payload: []byte("z")}, false)
+	if err := q.push(queuedFrame{payload: []byte("x")}, false); !errors.Is(err, errConnClosed) {
+		t.Fatalf("expected errConnClosed after close, got %v", err)
+	}
+	frames, done := q.drain()
+	if got := frameText(frames); got != "abcz" || !done {
+		t.Fatalf("expected queued frames then final, got %q (done=%v)", got, done)
+	}
+
+	q = newSendQueue(5, disconnect)
+	q.push(queuedFrame{payload: []byte("a")}, true)
+	q.close(&queuedFrame{opcode: opClose, payload: []byte("z")}, true)
+	if frames, _ := q.drain(); frameText(frames) != "z" || q.droppedCount() != 1 {
+		t.Fatalf("discarding close should send only the final frame, got %q", frameText(frames))
+	}
+}
+
+func TestSendQueueCoalescesPongs(t *testing.T) {
+	q := newSendQueue(1, disconnect)
+	q.push(queuedFrame{opcode: opText, payload: []byte("a")}, true)
+	for _, p := range []string{"1", "2", "3"} {
+		q.pushPong([]byte(p))
+	}
+	frames, _ := q.drain()
+	if len(frames) != 2 || frames[1].opcode != opPong || string(frames[1].payload) != "3" {
+		t.Fatalf("expected one pong answering the latest ping, got %+v", frames)
+	}
+}
+
+func TestSendQueueBoundsOnlyLiveMessages(t *testing.T) {
+	for _, policy := range []overflowPolicy{dropOldest, disconnect} {
+		t.Run(policy.String(), func(t *testing.T) {
+			q := newSendQueue(2, policy)
+			q.push(queuedFrame{payload: []byte("a")}, false)
+			q.pushResync(queuedFrame{payload: []byte("b")})
+			q.pushResync(queuedFrame{payload: []byte("c")})
+			for _, m := range []string{"x", "y"} {
+				if err := q.push(queuedFrame{payload: []byte(m)}, true); err != nil {
+					t.Fatalf("live push below the bound: %v", err)
+				}
+			}
+			err := q.push(queuedFrame{payload: []byte("z")}, true)
+			expect := "abcyz"
+			if policy == disconnect {
+				if !errors.Is(err, errSlowConsumer) {
+					t.Fatalf("expected errSlowConsumer, got %v", err)
+				}
+				expect = "abcxy"
+			}
+			if frames, _ := q.drain(); frameText(frames) != expect {
+				t.Fatalf("expected %q, got %q", expect, frameText(frames))
+			}
+			if !q.resyncPending() {
+				t.Fatal("a dropped live message must not count as a written resync frame")
+			}
+		})
+	}
+}
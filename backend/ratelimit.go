@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit is a token bucket refilled at Rate events per second holding
+// at most Burst events. A zero Rate disables limiting.
+type rateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l rateLimit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// rateLimits holds the default publish limit and per-tenant overrides
+type rateLimits struct {
+	Default rateLimit
+	Tenants map[string]rateLimit
+}
+
+func (l rateLimits) forTenant(id string) rateLimit {
+	if t, ok := l.Tenants[id]; ok {
+		return t
+	}
+	return l.Default
+}
+
+// parseRateLimit reads a limit written as "rate:burst" or just "rate"
+func parseRateLimit(s string) (rateLimit, error) {
+	rate, burst, hasBurst := strings.Cut(strings.TrimSpace(s), ":")
+	var l rateLimit
+	var err error
+	if l.Rate, err = strconv.ParseFloat(rate, 64); err != nil || l.Rate < 0 {
+		return l, fmt.Errorf("invalid rate limit %q", s)
+	}
+	if hasBurst {
+		if l.Burst, err = strconv.Atoi(burst); err != nil || l.Burst < 0 {
+			return l, fmt.Errorf("invalid burst in rate limit %q", s)
+		}
+	}
+	return l, nil
+}
+
+// parseTenantRateLimits reads comma-separated "tenant=rate:burst" overrides
+func parseTenantRateLimits(s string) (map[string]rateLimit, error) {
+	limits := make(map[string]rateLimit)
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		id, spec, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(id) == "" {
+			return nil, fmt.Errorf("invalid tenant rate limit %q", entry)
+		}
+		l, err := parseRateLimit(spec)
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.TrimSpace(id)] = l
+	}
+	return limits, nil
+}
+
+// tokenBucket tracks one tenant's remaining publish allowance
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens if available. Otherwise it leaves the bucket
+// untouched and returns how long until n tokens will be available.
+func (b *tokenBucket) take(l rateLimit, n int, now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	capacity := l.capacity()
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed*l.Rate)
+	}
+	b.last = now
+	need := float64(n)
+	if b.tokens >= need {
+		b.tokens -= need
+		return true, 0
+	}
+	wait := (need - b.tokens) / l.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// retryAfterSeconds formats a wait for the Retry-After header, rounding up
+// to whole seconds
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(waitSeconds(d))
+}
+
+// waitSeconds rounds a wait up to whole seconds, at least one
+func waitSeconds(d time.Duration) int {
+	secs := int(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limit := rateLimit{Rate: 2, Burst: 3}
+	now := time.Date(2025, 7, 31, 12, 0, 0, 0, time.UTC)
+	var b tokenBucket
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.take(limit, 1, now); !ok {
+			t.Fatalf("burst event %d should be allowed", i)
+		}
+	}
+	ok, wait := b.take(limit, 1, now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected rejection with 500ms wait, got %v %v", ok, wait)
+	}
+	if ok, _ := b.take(limit, 1, now.Add(500*time.Millisecond)); !ok {
+		t.Fatalf("bucket should refill at the configured rate")
+	}
+	if ok, _ := b.take(limit, 3, now.Add(time.Hour)); !ok {
+		t.Fatalf("bucket should refill up to its burst")
+	}
+	if ok, _ := b.take(limit, 1, now.Add(time.Hour)); ok {
+		t.Fatalf("bucket should not exceed its burst")
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	l, err := parseRateLimit("10:20")
+	if err != nil || l.Rate != 10 || l.Burst != 20 {
+		t.Fatalf("unexpected limit %+v (%v)", l, err)
+	}
+	if l, err := parseRateLimit("0.5"); err != nil || l.Rate != 0.5 || l.capacity() != 1 {
+		t.Fatalf("unexpected limit %+v (%v)", l, err)
+	}
+	for _, bad := range []string{"", "fast", "1:x", "-1"} {
+		if _, err := parseRateLimit(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+	tenants, err := parseTenantRateLimits("tenantA=50:100, tenantB=1")
+	if err != nil || tenants["tenantA"].Burst != 100 || tenants["tenantB"].Rate != 1 {
+		t.Fatalf("unexpected overrides %+v (%v)", tenants, err)
+	}
+	if _, err := parseTenantRateLimits("tenantA"); err == nil {
+		t.Fatalf("expected error for missing limit")
+	}
+}
+
+func TestPublishRateLimit(t *testing.T) {
+	hub := newEventHub(defaultConfig())
+	hub.setRateLimits(rateLimits{
+		Default: rateLimit{Rate: 0.1, Burst: 2},
+		Tenants: map[string]rateLimit{"vip": {Rate: 1000, Burst: 1000}},
+	})
+	srv := httptest.NewServer(newServer(defaultConfig(), hub, newAuthenticator(nil)))
+	defer srv.Close()
+	client := srv.Client()
+
+	post := func(tenant string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/events", bytes.NewBufferString(`{"message":"x"}`))
+		req.Header.Set("X-Tenant-ID", tenant)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := post("noisy"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("burst publish %d: expected 200, got %d", i, resp.StatusCode)
+		}
+	}
+	resp := post("noisy")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", resp.StatusCode)
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || secs < 1 || secs > 10 {
+		t.Fatalf("unexpected Retry-After %q", resp.Header.Get("Retry-After"))
+	}
+	post("noisy")
+
+	if resp := post("quiet"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("other tenants must not be limited, got %d", resp.StatusCode)
+	}
+	for i := 0; i < 5; i++ {
+		if resp := post("vip"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("override should allow vip, got %d", resp.StatusCode)
+		}
+	}
+
+	// a batch beyond the burst can never pass, so it is not worth retrying
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/events/batch", bytes.NewBufferString("{\"message\":\"a\"}\n{\"message\":\"b\"}\n{\"message\":\"c\"}\n"))
+	req.Header.Set("X-Tenant-ID", "batcher")
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("post batch: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || resp.Header.Get("Retry-After") != "" ||
+		!strings.Contains(string(body), "exceeds the rate limit burst of 2") {
+		t.Fatalf("expected 413 without Retry-After for a batch over the burst, got %d %q %s", resp.StatusCode, resp.Header.Get("Retry-After"), body)
+	}
+
+	counts := hub.rateLimitRejections()
+	if counts["noisy"] != 2 || len(counts) != 1 {
+		t.Fatalf("unexpected rejection counts %v", counts)
+	}
+	events, _, _ := hub.history("noisy", historyQuery{Limit: 10})
+	if len(events) != 2 {
+		t.Fatalf("rejected publishes must not be stored, got %d events", len(events))
+	}
+}
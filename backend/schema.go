@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Event schemas. A tenant registers a JSON Schema per event type and the
+// data of every event of that type is validated against it on publish.
+// The supported subset is type, enum and const, the object keywords
+// properties, required and additionalProperties, the array keywords items,
+// minItems and maxItems, the string keywords minLength, maxLength and
+// pattern, and minimum, maximum, exclusiveMinimum and exclusiveMaximum.
+// Any other keyword is rejected when the schema is registered, so a schema
+// never looks stricter than it is.
+const (
+	maxSchemaSize  = 64 << 10
+	maxSchemaDepth = 32
+	maxSchemas     = 256 // per tenant
+	maxViolations  = 50
+)
+
+// schemaAnnotations are keywords accepted but not enforced
+var schemaAnnotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+}
+
+var schemaTypeNames = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+var (
+	errTooManySchemas = fmt.Errorf("more than %d schemas", maxSchemas)
+	errSchemaNotFound = errors.New("schema not found")
+)
+
+// schema is a compiled schema. A false boolean schema rejects everything
+// and a true one compiles to an empty schema. Length and item bounds are
+// -1 when absent. raw is the compacted document of a registered schema.
+type schema struct {
+	raw        json.RawMessage
+	reject     bool
+	types      []string
+	enum       []interface{}
+	hasConst   bool
+	constValue interface{}
+
+	properties map[string]*schema
+	required   []string
+	additional *schema
+	items      *schema
+	minItems   int
+	maxItems   int
+
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+}
+
+// schemaError reports a schema that does not compile
+type schemaError struct {
+	at  string
+	msg string
+}
+
+func (e *schemaError) Error() string {
+	if e.at == "" {
+		return "invalid schema: " + e.msg
+	}
+	return "invalid schema at " + e.at + ": " + e.msg
+}
+
+// schemaViolation is one way an event failed its schema. Pointer is the
+// JSON pointer of the offending value within the event.
+type schemaViolation struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// compileSchema parses a schema document. Errors are *schemaError.
+func compileSchema(raw []byte) (*schema, error) {
+	if len(raw) > maxSchemaSize {
+		return nil, &schemaError{msg: fmt.Sprintf("larger than %d bytes", maxSchemaSize)}
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		return nil, &schemaError{msg: "bad json"}
+	}
+	s, err := parseSchema(compact.Bytes(), "", 0)
+	if err != nil {
+		return nil, err
+	}
+	s.raw = compact.Bytes()
+	return s, nil
+}
+
+// parseSchema compiles the schema at pointer at, depth levels down
+func parseSchema(raw json.RawMessage, at string, depth int) (*schema, error) {
+	if depth > maxSchemaDepth {
+		return nil, &schemaError{at, fmt.Sprintf("nested deeper than %d levels", maxSchemaDepth)}
+	}
+	s := &schema{minItems: -1, maxItems: -1, minLength: -1, maxLength: -1}
+	switch string(bytes.TrimSpace(raw)) {
+	case "true":
+		return s, nil
+	case "false":
+		s.reject = true
+		return s, nil
+	}
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &keywords); err != nil || keywords == nil {
+		return nil, &schemaError{at, "a schema must be an object or a boolean"}
+	}
+	names := make([]string, 0, len(keywords))
+	for name := range keywords {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := s.parseKeyword(name, keywords[name], at, depth); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *schema) parseKeyword(name string, raw json.RawMessage, at string, depth int) error {
+	bad := func(format string, args ...interface{}) error {
+		return &schemaError{at, name + " " + fmt.Sprintf(format, args...)}
+	}
+	count := func(dst *int) error {
+		var f float64
+		if err := json.Unmarshal(raw, &f); err != nil || f < 0 || f != math.Trunc(f) || f > math.MaxInt32 {
+			return bad("must be a non-negative integer")
+		}
+		*dst = int(f)
+		return nil
+	}
+	number := func(dst **float64) error {
+		var f float64
+		if err := json.Unmarshal(raw, &f); err != nil {
+			return bad("must be a number")
+		}
+		*dst = &f
+		return nil
+	}
+	switch name {
+	case "type":
+		var one string
+		if json.Unmarshal(raw, &one) == nil {
+			s.types = []string{one}
+		} else if err := json.Unmarshal(raw, &s.types); err != nil || len(s.types) == 0 {
+			return bad("must be a type name or a list of them")
+		}
+		for _, t := range s.types {
+			if !schemaTypeNames[t] {
+				return bad("names unknown type %q", t)
+			}
+		}
+	case "enum":
+		if err := json.Unmarshal(raw, &s.enum); err != nil || len(s.enum) == 0 {
+			return bad("must be a non-empty array")
+		}
+	case "const":
+		s.hasConst = true
+		json.Unmarshal(raw, &s.constValue)
+	case "properties":
+		var props map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &props); err != nil || props == nil {
+			return bad("must be an object")
+		}
+		s.properties = make(map[string]*schema, len(props))
+		for prop, sub := range props {
+			p, err := parseSchema(sub, at+"/properties/"+escapePointer(prop), depth+1)
+			if err != nil {
+				return err
+			}
+			s.properties[prop] = p
+		}
+	case "required":
+		if err := json.Unmarshal(raw, &s.required); err != nil {
+			return bad("must be an array of strings")
+		}
+	case "additionalProperties":
+		p, err := parseSchema(raw, at+"/additionalProperties", depth+1)
+		if err != nil {
+			return err
+		}
+		s.additional = p
+	case "items":
+		p, err := parseSchema(raw, at+"/items", depth+1)
+		if err != nil {
+			return err
+		}
+		s.items = p
+	case "minItems":
+		return count(&s.minItems)
+	case "maxItems":
+		return count(&s.maxItems)
+	case "minLength":
+		return count(&s.minLength)
+	case "maxLength":
+		return count(&s.maxLength)
+	case "pattern":
+		var src string
+		if err := json.Unmarshal(raw, &src); err != nil {
+			return bad("must be a string")
+		}
+		re, err := regexp.Compile(src)
+		if err != nil {
+			return bad("is not a valid regular expression")
+		}
+		s.pattern = re
+	case "minimum":
+		return number(&s.minimum)
+	case "maximum":
+		return number(&s.maximum)
+	case "exclusiveMinimum":
+		return number(&s.exclusiveMinimum)
+	case "exclusiveMaximum":
+		return number(&s.exclusiveMaximum)
+	default:
+		if !schemaAnnotations[name] {
+			return &schemaError{at, fmt.Sprintf("unsupported keyword %q", name)}
+		}
+	}
+	return nil
+}
+
+// validateData checks an event's data against s. Missing data is
+// validated as null.
+func (s *schema) validateData(data json.RawMessage) []schemaViolation {
+	var v interface{}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &v); err != nil {
+			return []schemaViolation{{Pointer: "/data", Message: "is not valid JSON"}}
+		}
+	}
+	var out []schemaViolation
+	s.validate(v, "/data", &out)
+	return out
+}
+
+// validate appends the ways v at pointer at breaks s to out, up to
+// maxViolations
+func (s *schema) validate(v interface{}, at string, out *[]schemaViolation) {
+	report := func(format string, args ...interface{}) {
+		if len(*out) < maxViolations {
+			*out = append(*out, schemaViolation{Pointer: at, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+	if s.reject {
+		report("is not allowed")
+		return
+	}
+	if len(s.types) > 0 && !s.matchesType(v) {
+		report("must be %s, not %s", strings.Join(s.types, " or "), jsonType(v))
+		return
+	}
+	if s.enum != nil && !containsValue(s.enum, v) {
+		report("must be one of the allowed values")
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constValue, v) {
+		report("must equal %s", jsonText(s.constValue))
+	}
+	switch x := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(x)
+		if s.minLength >= 0 && n < s.minLength {
+			report("must be at least %d characters", s.minLength)
+		}
+		if s.maxLength >= 0 && n > s.maxLength {
+			report("must be at most %d characters", s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(x) {
+			report("must match %q", s.pattern.String())
+		}
+	case float64:
+		if s.minimum != nil && x < *s.minimum {
+			report("must be >= %s", formatNumber(*s.minimum))
+		}
+		if s.maximum != nil && x > *s.maximum {
+			report("must be <= %s", formatNumber(*s.maximum))
+		}
+		if s.exclusiveMinimum != nil && x <= *s.exclusiveMinimum {
+			report("must be > %s", formatNumber(*s.exclusiveMinimum))
+		}
+		if s.exclusiveMaximum != nil && x >= *s.exclusiveMaximum {
+			report("must be < %s", formatNumber(*s.exclusiveMaximum))
+		}
+	case []interface{}:
+		if s.minItems >= 0 && len(x) < s.minItems {
+			report("must have at least %d items", s.minItems)
+		}
+		if s.maxItems >= 0 && len(x) > s.maxItems {
+			report("must have at most %d items", s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range x {
+				s.items.validate(item, at+"/"+strconv.Itoa(i), out)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := x[name]; !ok && len(*out) < maxViolations {
+				*out = append(*out, schemaViolation{Pointer: at + "/" + escapePointer(name), Message: "is required"})
+			}
+		}
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p, ok := s.properties[k]; ok {
+				p.validate(x[k], at+"/"+escapePointer(k), out)
+			} else if s.additional != nil {
+				s.additional.validate(x[k], at+"/"+escapePointer(k), out)
+			}
+		}
+	}
+}
+
+func (s *schema) matchesType(v interface{}) bool {
+	actual := jsonType(v)
+	for _, t := range s.types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType names the schema type of a decoded JSON value; whole numbers
+// are integers
+func jsonType(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if x == math.Trunc(x) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func containsValue(values []interface{}, v interface{}) bool {
+	for _, candidate := range values {
+		if reflect.DeepEqual(candidate, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonText(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func formatNumber(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// escapePointer escapes a name for use as a JSON pointer token
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+// schemaList is the body returned by GET /schemas
+type schemaList struct {
+	Types []string `json:"types"`
+}
+
+// serveSchemas manages a tenant's event schemas. GET /schemas lists the
+// types with a schema; PUT, GET and DELETE on /schemas/{type} register,
+// fetch and remove the schema of one type.
+func serveSchemas(hub *EventHub, auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		typ := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/schemas"), "/")
+		if typ == "" {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", "GET")
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			tenantID, err := auth.authenticate(r, scopeRead)
+			if err != nil {
+				writeAuthError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, schemaList{Types: hub.schemaTypes(tenantID)})
+			return
+		}
+		if len(typ) > maxAttributeLength {
+			http.Error(w, "invalid type", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			tenantID, err := auth.authenticate(r, scopeRead)
+			if err != nil {
+				writeAuthError(w, err)
+				return
+			}
+			s := hub.schemaFor(tenantID, typ)
+			if s == nil {
+				http.Error(w, errSchemaNotFound.Error(), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/schema+json")
+			w.Write(s.raw)
+		case http.MethodPut:
+			tenantID, err := auth.authenticate(r, scopeSchemas)
+			if err != nil {
+				writeAuthError(w, err)
+				return
+			}
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSchemaSize))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			s, err := compileSchema(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := hub.setSchema(tenantID, typ, s); errors.Is(err, errTooManySchemas) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				log.Printf("tenant %s: failed to store schema for %s: %v", tenantID, typ, err)
+				http.Error(w, "failed to store schema", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("tenant %s: registered schema for %s", tenantID, typ)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			tenantID, err := auth.authenticate(r, scopeSchemas)
+			if err != nil {
+				writeAuthError(w, err)
+				return
+			}
+			if err := hub.deleteSchema(tenantID, typ); errors.Is(err, errSchemaNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				log.Printf("tenant %s: failed to remove schema for %s: %v", tenantID, typ, err)
+				http.Error(w, "failed to remove schema", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("tenant %s: removed schema for %s", tenantID, typ)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
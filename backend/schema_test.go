@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const orderSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"required": ["id", "total", "items"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "string", "pattern": "^ord-[0-9]+$"},
+		"total": {"type": "number", "minimum": 0, "exclusiveMaximum": 10000},
+		"currency": {"enum": ["EUR", "USD"]},
+		"note": {"type": ["string", "null"], "maxLength": 5},
+		"items": {
+			"type": "array",
+			"minItems": 1,
+			"items": {
+				"type": "object",
+				"required": ["sku"],
+				"properties": {
+					"sku": {"type": "string", "minLength": 2},
+					"qty": {"type": "integer", "minimum": 1}
+				}
+			}
+		}
+	}
+}`
+
+func mustCompileSchema(t *testing.T, src string) *schema {
+	t.Helper()
+	s, err := compileSchema([]byte(src))
+	if err != nil {
+		t.Fatalf("compile schema: %v", err)
+	}
+	return s
+}
+
+func TestSchemaValidate(t *testing.T) {
+	s, err := compileSchema([]byte(orderSchema))
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	cases := []struct {
+		data string
+		want []string
+	}{
+		{`{"id":"ord-1","total":19.5,"currency":"EUR","note":null,"items":[{"sku":"a1","qty":2}]}`, nil},
+		{`{"id":"ord-1","total":0,"items":[{"sku":"a1"}],"note":"short"}`, nil},
+		{``, []string{"/data"}},
+		{`{"total":1,"items":[]}`, []string{"/data/id", "/data/items"}},
+		{`{"id":"x","total":10000,"items":[{"qty":1.5}],"extra/field":1}`,
+			[]string{"/data/extra~1field", "/data/id", "/data/items/0/sku", "/data/items/0/qty", "/data/total"}},
+		{`{"id":"ord-2","total":-1,"currency":"GBP","note":"too long","items":[{"sku":"a","qty":0}]}`,
+			[]string{"/data/currency", "/data/items/0/qty", "/data/items/0/sku", "/data/note", "/data/total"}},
+	}
+	for _, tc := range cases {
+		var got []string
+		for _, v := range s.validateData(json.RawMessage(tc.data)) {
+			got = append(got, v.Pointer)
+		}
+		if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("%s: got violations at %v, want %v", tc.data, got, tc.want)
+		}
+	}
+
+	v := s.validateData(json.RawMessage(`{"id":"ord-1","total":"12","items":[{"sku":"a1"}]}`))
+	if len(v) != 1 || v[0].Message != "must be number, not string" {
+		t.Fatalf("unexpected violation %+v", v)
+	}
+}
+
+func TestCompileSchemaErrors(t *testing.T) {
+	deep := strings.Repeat(`{"items":`, maxSchemaDepth+2) + `true` + strings.Repeat(`}`, maxSchemaDepth+2)
+	for _, src := range []string{
+		``,
+		`null`,
+		`[]`,
+		`{"type":"decimal"}`,
+		`{"type":[]}`,
+		`{"enum":[]}`,
+		`{"minLength":-1}`,
+		`{"maxItems":1.5}`,
+		`{"minimum":"0"}`,
+		`{"pattern":"("}`,
+		`{"required":"id"}`,
+		`{"properties":{"a":{"format":"email"}}}`,
+		`{"oneOf":[true]}`,
+		`{"items":[true]}`,
+		deep,
+	} {
+		_, err := compileSchema([]byte(src))
+		if _, ok := err.(*schemaError); !ok {
+			t.Errorf("%q: expected schemaError, got %v", src, err)
+		}
+	}
+	if _, err := compileSchema([]byte(`{"properties":{"a":{"format":"email"}}}`)); !strings.Contains(err.Error(), "/properties/a") {
+		t.Errorf("error should name the keyword's location, got %v", err)
+	}
+}
+
+func TestSchemasEndToEnd(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openFileStore(dir, syncAlways, 0)
+	hub, _ := openEventHub(defaultConfig(), store)
+	srv := httptest.NewServer(newServer(defaultConfig(), hub, newAuthenticator(nil)))
+	defer srv.Close()
+	client := srv.Client()
+
+	do := func(method, path, contentType, body string) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("X-Tenant-ID", "tenantA")
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if status, body := do(http.MethodPut, "/schemas/order.created", "", `{"type":"object","oneOf":[]}`); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unsupported keyword, got %d: %s", status, body)
+	}
+	if status, body := do(http.MethodPut, "/schemas/order.created", "", orderSchema); status != http.StatusNoContent {
+		t.Fatalf("register: %d %s", status, body)
+	}
+	if status, body := do(http.MethodGet, "/schemas", "", ""); status != http.StatusOK || body != `{"types":["order.created"]}`+"\n" {
+		t.Fatalf("list: %d %s", status, body)
+	}
+	if status, body := do(http.MethodGet, "/schemas/order.created", "", ""); status != http.StatusOK || !strings.Contains(body, `"minItems":1`) {
+		t.Fatalf("get: %d %s", status, body)
+	}
+
+	status, body := do(http.MethodPost, "/events", "", `{"type":"order.created","data":{"id":"ord-1","total":-5,"items":[]}}`)
+	var rejected violationsResponse
+	if status != http.StatusUnprocessableEntity || json.Unmarshal([]byte(body), &rejected) != nil {
+		t.Fatalf("expected 422, got %d: %s", status, body)
+	}
+	if len(rejected.Violations) != 2 || rejected.Violations[0].Pointer != "/data/items" || rejected.Violations[1].Pointer != "/data/total" {
+		t.Fatalf("unexpected violations %+v", rejected.Violations)
+	}
+	if status, body := do(http.MethodPost, "/events", "", `{"type":"order.created","data":{"id":"ord-1","total":5,"items":[{"sku":"a1"}]}}`); status != http.StatusOK {
+		t.Fatalf("valid event: %d %s", status, body)
+	}
+	if status, body := do(http.MethodPost, "/events", "", `{"type":"order.shipped","message":"no schema"}`); status != http.StatusOK {
+		t.Fatalf("type without schema: %d %s", status, body)
+	}
+	status, body = do(http.MethodPost, "/events", ceBatchType, `[
+		{"specversion":"1.0","id":"1","source":"/shop","type":"order.shipped"},
+		{"specversion":"1.0","id":"2","source":"/shop","type":"order.created","data":{"id":"ord-2","total":1}}
+	]`)
+	if status != http.StatusUnprocessableEntity || !strings.Contains(body, "event 1:") || !strings.Contains(body, `"/data/items"`) {
+		t.Fatalf("expected batch rejected at event 1, got %d: %s", status, body)
+	}
+
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	ws.WriteJSON(map[string]interface{}{"op": "publish", "ref": "p1", "type": "order.created", "data": map[string]interface{}{"id": "bad"}})
+	reply := readReply(t, ws)
+	if reply.Op != opError || reply.Ref != "p1" || len(reply.Violations) != 3 {
+		t.Fatalf("expected schema error reply, got %+v", reply)
+	}
+
+	events, _, _ := hub.history("tenantA", historyQuery{Limit: 10})
+	if len(events) != 2 {
+		t.Fatalf("only the valid events should be stored, got %d", len(events))
+	}
+
+	// schemas survive a restart with the event store
+	store.Close()
+	store, _ = openFileStore(dir, syncAlways, 0)
+	defer store.Close()
+	hub, _ = openEventHub(defaultConfig(), store)
+	if types := hub.schemaTypes("tenantA"); len(types) != 1 || types[0] != "order.created" {
+		t.Fatalf("schemas not restored: %v", types)
+	}
+	if err := hub.deleteSchema("tenantA", "order.created"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := hub.deleteSchema("tenantA", "order.created"); err != errSchemaNotFound {
+		t.Fatalf("expected errSchemaNotFound, got %v", err)
+	}
+	hub, _ = openEventHub(defaultConfig(), store)
+	if types := hub.schemaTypes("tenantA"); len(types) != 0 {
+		t.Fatalf("deleted schema restored: %v", types)
+	}
+}
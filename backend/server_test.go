@@ -19,35 +19,16 @@ import (
 )
 
 func setupTestServer() (*httptest.Server, *EventHub) {
-	hub := newEventHub()
+	hub := newEventHub(defaultConfig())
+	auth := newAuthenticator(nil)
+	opts := defaultConnOptions()
+	opts.SSEKeepAlive = 50 * time.Millisecond
 	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", serveWS(hub))
-	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		tenantID := r.Header.Get("X-Tenant-ID")
-		if tenantID == "" {
-			http.Error(w, "missing tenant header", http.StatusBadRequest)
-			return
-		}
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
-			return
-		}
-		var req struct {
-			Message string `json:"message"`
-		}
-		if err := json.Unmarshal(body, &req); err != nil {
-			http.Error(w, "bad json", http.StatusBadRequest)
-			return
-		}
-		e := hub.postEvent(tenantID, req.Message)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(e)
-	})
+	mux.HandleFunc("/ws", serveWS(hub, auth, opts))
+	mux.HandleFunc("/events", serveEvents(hub, auth))
+	mux.HandleFunc("/events/batch", serveBatch(hub, auth))
+	mux.HandleFunc("/events/stream", serveSSE(hub, auth, opts))
+	mux.HandleFunc("/schemas/", serveSchemas(hub, auth))
 	srv := httptest.NewServer(mux)
 	return srv, hub
 }
@@ -228,8 +209,8 @@ func TestWebsocketTenantIsolation(t *testing.T) {
 	}
 }
 func TestServeWSValidation(t *testing.T) {
-	hub := newEventHub()
-	srv := httptest.NewServer(serveWS(hub))
+	hub := newEventHub(defaultConfig())
+	srv := httptest.NewServer(serveWS(hub, newAuthenticator(nil), defaultConnOptions()))
 	defer srv.Close()
 	client := srv.Client()
 
@@ -306,3 +287,132 @@ func TestServeWSValidation(t *testing.T) {
 		})
 	}
 }
+
+func getHistory(t *testing.T, client *http.Client, url, tenant, query string) (int, historyResponse) {
+	req, err := http.NewRequest(http.MethodGet, url+"/events"+query, nil)
+	if err != nil {
+		t.Fatalf("getHistory: %v", err)
+	}
+	req.Header.Set("X-Tenant-ID", tenant)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("getHistory: %v", err)
+	}
+	defer resp.Body.Close()
+	var h historyResponse
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+	}
+	return resp.StatusCode, h
+}
+
+func TestEventsHistoryEndpoint(t *testing.T) {
+	srv, _ := setupTestServer()
+	defer srv.Close()
+	client := srv.Client()
+
+	var posted []Event
+	for i := 0; i < 5; i++ {
+		posted = append(posted, postEvent(t, client, srv.URL, "tenantA", fmt.Sprintf("a%d", i)))
+	}
+	postEvent(t, client, srv.URL, "tenantB", "b0")
+
+	status, h := getHistory(t, client, srv.URL, "tenantA", "")
+	if status != http.StatusOK || len(h.Events) != 5 || h.HasMore {
+		t.Fatalf("unexpected history %d %+v", status, h)
+	}
+	for _, e := range h.Events {
+		if e.TenantID != "tenantA" {
+			t.Fatalf("history leaked event %+v", e)
+		}
+	}
+
+	status, h = getHistory(t, client, srv.URL, "tenantA", "?limit=2")
+	if status != http.StatusOK || len(h.Events) != 2 || !h.HasMore || h.Events[1].ID != posted[4].ID {
+		t.Fatalf("unexpected latest page %+v", h)
+	}
+	status, h = getHistory(t, client, srv.URL, "tenantA", "?limit=2&before="+h.Events[0].ID)
+	if status != http.StatusOK || len(h.Events) != 2 || h.Events[0].ID != posted[1].ID {
+		t.Fatalf("unexpected previous page %+v", h)
+	}
+	status, h = getHistory(t, client, srv.URL, "tenantA", "?after="+posted[3].ID)
+	if status != http.StatusOK || len(h.Events) != 1 || h.Events[0].ID != posted[4].ID {
+		t.Fatalf("unexpected after page %+v", h)
+	}
+
+	status, h = getHistory(t, client, srv.URL, "tenantC", "")
+	if status != http.StatusOK || len(h.Events) != 0 {
+		t.Fatalf("unexpected empty history %d %+v", status, h)
+	}
+
+	errorCases := []struct {
+		name   string
+		tenant string
+		query  string
+		status int
+	}{
+		{"missing tenant", "", "", http.StatusBadRequest},
+		{"bad limit", "tenantA", "?limit=0", http.StatusBadRequest},
+		{"limit too large", "tenantA", "?limit=100000", http.StatusBadRequest},
+		{"bad since", "tenantA", "?since=yesterday", http.StatusBadRequest},
+		{"unknown cursor", "tenantA", "?after=nope", http.StatusNotFound},
+		{"foreign cursor", "tenantB", "?after=" + posted[0].ID, http.StatusNotFound},
+	}
+	for _, tc := range errorCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if status, _ := getHistory(t, client, srv.URL, tc.tenant, tc.query); status != tc.status {
+				t.Fatalf("expected %d, got %d", tc.status, status)
+			}
+		})
+	}
+}
+
+func TestWebsocketResume(t *testing.T) {
+	srv, _ := setupTestServer()
+	defer srv.Close()
+	client := srv.Client()
+
+	e1 := postEvent(t, client, srv.URL, "tenantA", "m1")
+	e2 := postEvent(t, client, srv.URL, "tenantA", "m2")
+	e3 := postEvent(t, client, srv.URL, "tenantA", "m3")
+
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA&after=" + e1.ID)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	e4 := postEvent(t, client, srv.URL, "tenantA", "m4")
+
+	for _, want := range []Event{e2, e3, e4} {
+		var ev Event
+		if err := ws.ReadJSON(&ev, time.Second); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if ev.ID != want.ID {
+			t.Fatalf("expected %s (%s), got %s (%s)", want.ID, want.Message, ev.ID, ev.Message)
+		}
+	}
+	var ev Event
+	if err := ws.ReadJSON(&ev, 200*time.Millisecond); err == nil {
+		t.Fatalf("unexpected duplicate event %+v", ev)
+	}
+
+	// since is still accepted as the older name of after
+	truncated, err := dialWS(srv.URL + "/ws?tenant=tenantA&since=unknown")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer truncated.Close()
+	var ctrl controlMessage
+	if err := truncated.ReadJSON(&ctrl, time.Second); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if ctrl.Op != opHistoryTruncated || ctrl.Since != "unknown" {
+		t.Fatalf("expected history_truncated, got %+v", ctrl)
+	}
+	if err := truncated.ReadJSON(&ev, time.Second); err != nil || ev.ID != e1.ID {
+		t.Fatalf("expected replay from %s, got %+v (%v)", e1.ID, ev, err)
+	}
+}
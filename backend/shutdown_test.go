@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	srv, hub := setupTestServer()
+	defer srv.Close()
+	client := srv.Client()
+
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	stream := dialSSE(t, srv.URL+"/events/stream?tenant=tenantA", nil)
+	defer stream.Close()
+	// the first keep-alive proves the subscription is registered
+	for m := range stream.msgs {
+		if m.comment == "keep-alive" {
+			break
+		}
+	}
+	posted := postEvent(t, client, srv.URL, "tenantA", "before shutdown")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := hub.shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	// queued events are delivered before the going away close frame
+	var got Event
+	if err := ws.ReadJSON(&got, time.Second); err != nil || got.ID != posted.ID {
+		t.Fatalf("expected %s before close, got %+v (%v)", posted.ID, got, err)
+	}
+	ws.c.SetReadDeadline(time.Now().Add(time.Second))
+	opcode, payload, err := readFrame(ws.r)
+	if err != nil || opcode != opClose {
+		t.Fatalf("expected close frame, got opcode %d (%v)", opcode, err)
+	}
+	if code := binary.BigEndian.Uint16(payload); code != closeGoingAway {
+		t.Fatalf("expected close code %d, got %d", closeGoingAway, code)
+	}
+
+	// the stream ends once it has sent what was queued
+	if m := stream.next(t); m.id != posted.ID {
+		t.Fatalf("expected %s before the stream ended, got %+v", posted.ID, m)
+	}
+	timeout := time.After(time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-stream.msgs:
+		case <-timeout:
+			t.Fatal("stream still open after shutdown")
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/events?tenant=tenantA", strings.NewReader(`{"message":"late"}`))
+	late, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	late.Body.Close()
+	if late.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for publish during shutdown, got %d", late.StatusCode)
+	}
+	if _, err := dialWS(srv.URL + "/ws?tenant=tenantA"); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected handshake refused with 503, got %v", err)
+	}
+	refused, err := client.Get(srv.URL + "/events/stream?tenant=tenantA")
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	refused.Body.Close()
+	if refused.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for stream during shutdown, got %d", refused.StatusCode)
+	}
+}
+
+// blockingStore signals appending and then holds each append until
+// release is closed
+type blockingStore struct {
+	failingStore
+	appending chan struct{}
+	release   chan struct{}
+}
+
+func (s *blockingStore) Append(...Event) error {
+	select {
+	case s.appending <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return nil
+}
+
+func TestShutdownWaitsForPublishes(t *testing.T) {
+	store := &blockingStore{appending: make(chan struct{}, 1), release: make(chan struct{})}
+	hub, _ := openEventHub(defaultConfig(), store)
+	c := &fakeConn{}
+	hub.registerConn("t1", c)
+
+	published := make(chan error, 1)
+	go func() {
+		_, err := postChecked(hub, "t1", []eventRequest{{Message: "in flight"}})
+		published <- err
+	}()
+	<-store.appending
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- hub.shutdown(context.Background()) }()
+	select {
+	case err := <-stopped:
+		t.Fatalf("shutdown returned with a publish in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := postChecked(hub, "t1", []eventRequest{{Message: "late"}}); err != errShuttingDown {
+		t.Fatalf("expected errShuttingDown, got %v", err)
+	}
+
+	close(store.release)
+	if err := <-published; err != nil {
+		t.Fatalf("in-flight publish failed: %v", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if len(c.msgs) != 1 || c.msgs[0].Message != "in flight" {
+		t.Fatalf("in-flight event should be delivered before shutdown, got %+v", c.msgs)
+	}
+
+	// connections arriving after shutdown are turned away
+	late := &fakeConn{}
+	hub.registerConn("t2", late)
+	hub.postEvent("t2", "unseen")
+	if len(late.msgs) != 0 {
+		t.Fatalf("connection registered after shutdown got %+v", late.msgs)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	store := &blockingStore{appending: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(store.release)
+	hub, _ := openEventHub(defaultConfig(), store)
+	go postChecked(hub, "t1", []eventRequest{{Message: "stuck"}})
+	<-store.appending
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := hub.shutdown(ctx); err == nil {
+		t.Fatalf("expected shutdown to give up at the deadline")
+	}
+}
+
+func TestFailedAttachHangsUp(t *testing.T) {
+	srv, hub := setupTestServer()
+	defer srv.Close()
+	postEvent(t, srv.Client(), srv.URL, "tenantA", "before")
+	// the tenant starts closing after the handshake was accepted
+	tenant := hub.tenants["tenantA"]
+	tenant.mu.Lock()
+	tenant.closing = true
+	tenant.mu.Unlock()
+
+	ws, err := dialWS(srv.URL + "/ws?tenant=tenantA&since_seq=0")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	ws.c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	opcode, _, err := readFrame(ws.r)
+	if err != nil || opcode != opClose {
+		t.Fatalf("expected close frame, got opcode %d (%v)", opcode, err)
+	}
+	// without a reply the server still hangs up once closeTimeout passes
+	if _, _, err := readFrame(ws.r); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the server to close the socket, got %v", err)
+	}
+}
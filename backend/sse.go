@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const sseKeepAliveInterval = 15 * time.Second
+
+var errConnClosed = errors.New("connection closed")
+
+// sseConn adapts a text/event-stream response to the Conn interface.
+// Messages are queued and written by the handler goroutine.
+type sseConn struct {
+	queue *sendQueue
+	// cloudEvents sends events in the CloudEvents JSON format
+	cloudEvents bool
+}
+
+func newSSEConn(opts connOptions, cloudEvents bool) *sseConn {
+	return &sseConn{queue: newSendQueue(opts.QueueSize, opts.Overflow), cloudEvents: cloudEvents}
+}
+
+// WriteJSON queues v as one event. A slow consumer whose queue is full is
+// handled by the overflow policy; disconnecting ends the stream.
+func (s *sseConn) WriteJSON(v interface{}) error {
+	frame, err := formatSSE(v, s.cloudEvents)
+	if err != nil {
+		return err
+	}
+	err = s.queue.push(queuedFrame{payload: frame}, true)
+	if errors.Is(err, errSlowConsumer) {
+		s.queue.close(nil, true)
+	}
+	return err
+}
+
+// writeBacklog queues replayed history regardless of the queue bound
+func (s *sseConn) writeBacklog(v interface{}) error {
+	frame, err := formatSSE(v, s.cloudEvents)
+	if err != nil {
+		return err
+	}
+	return s.queue.push(queuedFrame{payload: frame}, false)
+}
+
+// Close ends the stream once the queued events have been written
+func (s *sseConn) Close() error {
+	s.queue.close(nil, false)
+	return nil
+}
+
+// formatSSE renders v as an event, optionally in the CloudEvents format.
+// Events carry their ID so EventSource reports it back in Last-Event-ID;
+// control messages are named by op.
+func formatSSE(v interface{}, cloudEvents bool) ([]byte, error) {
+	data, err := json.Marshal(encodeOutput(v, cloudEvents))
+	if err != nil {
+		return nil, err
+	}
+	var id, name string
+	switch m := v.(type) {
+	case Event:
+		id, name = m.ID, "message"
+	case controlMessage:
+		name = m.Op
+	default:
+		name = "message"
+	}
+	frame := "event: " + name + "\ndata: " + string(data) + "\n\n"
+	if id != "" {
+		frame = "id: " + id + "\n" + frame
+	}
+	return []byte(frame), nil
+}
+
+// serveSSE streams tenant events as Server-Sent Events for clients that
+// cannot upgrade to WebSocket
+func serveSSE(hub *EventHub, auth *authenticator, opts connOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		subs, err := subscriptionsFrom(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cloudEvents, err := outputFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, _, err := resumeSeqFrom(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !hub.accepting() {
+			http.Error(w, errShuttingDown.msg, http.StatusServiceUnavailable)
+			return
+		}
+		// browsers' EventSource cannot set headers either, so tickets work here too
+		var claims tokenClaims
+		if r.URL.Query().Get("ticket") != "" {
+			claims, err = auth.authenticateTicket(r, scopeRead)
+		} else {
+			claims, err = auth.claims(r, scopeRead)
+		}
+		tenantID := claims.Tenant
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		if _, ok := w.(http.Flusher); !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		// every write gets a deadline, as WebSocket frames do, so a
+		// stalled peer cannot keep the stream open; a slow consumer that
+		// was disconnected would otherwise never see its queue close
+		rc := http.NewResponseController(w)
+		deadline := func() {
+			if opts.WriteTimeout > 0 {
+				rc.SetWriteDeadline(time.Now().Add(opts.WriteTimeout))
+			}
+		}
+		flush := func() error {
+			deadline()
+			return rc.Flush()
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if err := flush(); err != nil {
+			return
+		}
+
+		conn := newSSEConn(opts, cloudEvents)
+		conn.queue.drops = hub.dropCounter(tenantID)
+		if err := attachConn(hub, tenantID, conn, r, subs); err != nil {
+			log.Printf("tenant %s: replay failed: %v", tenantID, err)
+			return
+		}
+		log.Printf("tenant %s: event stream established", tenantID)
+		defer func() {
+			hub.unregisterConn(tenantID, conn)
+			if n := conn.queue.droppedCount(); n > 0 {
+				log.Printf("tenant %s: event stream closed (%d messages dropped)", tenantID, n)
+				return
+			}
+			log.Printf("tenant %s: event stream closed", tenantID)
+		}()
+
+		ticker := time.NewTicker(opts.SSEKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-conn.queue.ready:
+				frames, done := conn.queue.drain()
+				for _, f := range frames {
+					deadline()
+					if _, err := w.Write(f.payload); err != nil {
+						return
+					}
+				}
+				if err := flush(); err != nil {
+					return
+				}
+				if done {
+					return
+				}
+			case <-ticker.C:
+				deadline()
+				if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				if err := flush(); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseMessage is one dispatched Server-Sent Event; comment holds the text of
+// a comment line received instead
+type sseMessage struct {
+	id, event, data, comment string
+}
+
+type sseClient struct {
+	resp   *http.Response
+	cancel context.CancelFunc
+	msgs   chan sseMessage
+}
+
+func dialSSE(t *testing.T, url string, header http.Header) *sseClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("dial sse: %v", err)
+	}
+	c := &sseClient{resp: resp, cancel: cancel, msgs: make(chan sseMessage, 16)}
+	go func() {
+		defer close(c.msgs)
+		var m sseMessage
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case line == "":
+				if m != (sseMessage{}) {
+					c.msgs <- m
+				}
+				m = sseMessage{}
+			case strings.HasPrefix(line, ":"):
+				m.comment = strings.TrimSpace(line[1:])
+			case strings.HasPrefix(line, "id: "):
+				m.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				m.event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				m.data = line[6:]
+			}
+		}
+	}()
+	return c
+}
+
+// next returns the next message, skipping keep-alive comments
+func (c *sseClient) next(t *testing.T) sseMessage {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case m, ok := <-c.msgs:
+			if !ok {
+				t.Fatalf("stream closed")
+			}
+			if m.comment != "" {
+				continue
+			}
+			return m
+		case <-timeout:
+			t.Fatalf("timed out waiting for event")
+		}
+	}
+}
+
+func (c *sseClient) Close() {
+	c.cancel()
+	c.resp.Body.Close()
+}
+
+func TestSSEStream(t *testing.T) {
+	srv, _ := setupTestServer()
+	defer srv.Close()
+	client := srv.Client()
+
+	resp, err := client.Get(srv.URL + "/events/stream")
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 without tenant, got %d", resp.StatusCode)
+	}
+
+	streamA := dialSSE(t, srv.URL+"/events/stream?tenant=tenantA", nil)
+	defer streamA.Close()
+	if ct := streamA.resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	streamB := dialSSE(t, srv.URL+"/events/stream", http.Header{"X-Tenant-Id": {"tenantB"}})
+	defer streamB.Close()
+
+	// the first keep-alive proves the subscription is registered
+	for m := range streamA.msgs {
+		if m.comment == "keep-alive" {
+			break
+		}
+	}
+
+	posted := postEvent(t, client, srv.URL, "tenantA", "hello")
+	m := streamA.next(t)
+	if m.id != posted.ID || m.event != "message" {
+		t.Fatalf("unexpected sse message %+v", m)
+	}
+	var ev Event
+	if err := json.Unmarshal([]byte(m.data), &ev); err != nil {
+		t.Fatalf("decode data: %v", err)
+	}
+	if ev.Message != "hello" || ev.TenantID != "tenantA" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	postEvent(t, client, srv.URL, "tenantB", "other")
+	if m := streamB.next(t); !strings.Contains(m.data, `"other"`) {
+		t.Fatalf("tenantB got %+v", m)
+	}
+	select {
+	case m := <-streamA.msgs:
+		if m.comment == "" {
+			t.Fatalf("tenantA received foreign event %+v", m)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSSEResume(t *testing.T) {
+	srv, _ := setupTestServer()
+	defer srv.Close()
+	client := srv.Client()
+
+	e1 := postEvent(t, client, srv.URL, "tenantA", "m1")
+	e2 := postEvent(t, client, srv.URL, "tenantA", "m2")
+
+	stream := dialSSE(t, srv.URL+"/events/stream?tenant=tenantA", http.Header{"Last-Event-Id": {e1.ID}})
+	defer stream.Close()
+	if m := stream.next(t); m.id != e2.ID {
+		t.Fatalf("expected replay of %s, got %+v", e2.ID, m)
+	}
+
+	truncated := dialSSE(t, srv.URL+"/events/stream?tenant=tenantA", http.Header{"Last-Event-Id": {"gone"}})
+	defer truncated.Close()
+	if m := truncated.next(t); m.event != opHistoryTruncated || m.id != "" {
+		t.Fatalf("expected history_truncated, got %+v", m)
+	}
+	if m := truncated.next(t); m.id != e1.ID {
+		t.Fatalf("expected replay of %s, got %+v", e1.ID, m)
+	}
+}
+
+func TestSSEWriteDeadlineDropsStalledPeer(t *testing.T) {
+	hub := newEventHub(defaultConfig())
+	opts := defaultConnOptions()
+	opts.QueueSize = 2
+	opts.WriteTimeout = 50 * time.Millisecond
+	handlerDone := make(chan struct{})
+	sse := serveSSE(hub, newAuthenticator(nil), opts)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handlerDone)
+		sse(w, r)
+	}))
+	defer srv.Close()
+
+	// the client sends its request and then never reads
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	c.(*net.TCPConn).SetReadBuffer(4096)
+	fmt.Fprintf(c, "GET /events/stream?tenant=t1 HTTP/1.1\r\nHost: test\r\n\r\n")
+
+	registered := func() bool {
+		hub.mu.Lock()
+		th := hub.tenants["t1"]
+		hub.mu.Unlock()
+		if th == nil {
+			return false
+		}
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		return len(th.connections) > 0
+	}
+	for deadline := time.Now().Add(time.Second); !registered(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("stream was not registered")
+		}
+	}
+
+	big := strings.Repeat("x", 256<<10)
+	timeout := time.After(5 * time.Second)
+	for {
+		hub.postEvent("t1", big)
+		select {
+		case <-handlerDone:
+			if registered() {
+				t.Fatal("stalled stream should be unregistered")
+			}
+			return
+		case <-timeout:
+			t.Fatal("stalled stream was not closed after the write deadline")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventStore persists tenant events so history survives restarts.
+// Implementations must keep each tenant's events in append order.
+type EventStore interface {
+	// Append durably records events, which belong to one tenant, in that
+	// tenant's log: either all of them or none
+	Append(events ...Event) error
+	// Load returns up to limit of the newest stored events, oldest first
+	Load(tenantID string, limit int) ([]Event, error)
+	// Tenants lists the tenants that have a log
+	Tenants() ([]string, error)
+	// Close flushes and releases all logs
+	Close() error
+}
+
+// schemaStore is implemented by stores that also keep the schemas
+// registered by tenants
+type schemaStore interface {
+	// SaveSchemas replaces the stored schemas of a tenant, by event type
+	SaveSchemas(tenantID string, schemas map[string]json.RawMessage) error
+	// LoadSchemas returns the stored schemas of every tenant
+	LoadSchemas() (map[string]map[string]json.RawMessage, error)
+}
+
+// syncPolicy controls when the file store calls fsync
+type syncPolicy int
+
+const (
+	syncAlways   syncPolicy = iota // after every append
+	syncInterval                   // periodically in the background
+	syncNever                      // leave flushing to the OS
+)
+
+func parseSyncPolicy(s string) (syncPolicy, error) {
+	switch s {
+	case "", "always":
+		return syncAlways, nil
+	case "interval":
+		return syncInterval, nil
+	case "never":
+		return syncNever, nil
+	}
+	return 0, fmt.Errorf("unknown fsync policy %q", s)
+}
+
+const (
+	logSuffix      = ".log"
+	schemaSuffix   = ".schemas"
+	recordHeader   = 8 // payload length + CRC-32C
+	defaultSyncGap = time.Second
+	// maxRecordSize bounds a record by the largest batch the API accepts.
+	// Records are encoded without HTML escaping, so a byte of the body
+	// grows to at most 3, when invalid UTF-8 becomes U+FFFD, plus the
+	// fields the server adds to each event.
+	maxRecordSize = 3*maxBatchBody + maxBatchEvents*recordEventOverhead
+	// recordEventOverhead bounds the JSON of the fields set by the server
+	recordEventOverhead = 1 << 10
+	// defaultMaxOpenLogs bounds the log files held open at once; the least
+	// recently used is closed to open another
+	defaultMaxOpenLogs = 256
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// fileStore keeps one append-only log file per tenant in dir. Each record
+// is a 4-byte big-endian payload length, a 4-byte CRC-32C of the payload
+// and the JSON-encoded event, or a JSON array of the events of a batch so
+// that a crash stores all of them or none. A torn or corrupt record at the
+// end of a log, as left by a crash mid-append, is cut off when the log is
+// opened; one followed by valid records is reported as an error instead.
+type fileStore struct {
+	dir    string
+	policy syncPolicy
+	// retain, when set, is the history window: a log growing past twice
+	// as many events is compacted to the newest retain on append
+	retain int
+	// maxOpen bounds len(logs); clock orders their use
+	maxOpen int
+	clock   uint64
+	mu      sync.Mutex
+	logs    map[string]*tenantLog
+	stop    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+// tenantLog is a tenant's log file. f is nil until the first caller to
+// take mu has opened it; closed is set once the log has been closed to
+// make room for another, or failed to open, and is no longer in logs.
+type tenantLog struct {
+	mu     sync.Mutex
+	f      *os.File
+	closed bool
+	dirty  bool
+	// stored counts the events in the log
+	stored int
+	// used is the store's clock at the last lookup of the log
+	used uint64
+}
+
+// openFileStore creates dir if needed and starts background syncing when
+// the policy asks for it
+func openFileStore(dir string, policy syncPolicy, interval time.Duration) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &fileStore{
+		dir:     dir,
+		policy:  policy,
+		maxOpen: defaultMaxOpenLogs,
+		logs:    make(map[string]*tenantLog),
+		stop:    make(chan struct{}),
+	}
+	if policy == syncInterval {
+		if interval <= 0 {
+			interval = defaultSyncGap
+		}
+		s.wg.Add(1)
+		go s.syncLoop(interval)
+	}
+	return s, nil
+}
+
+func (s *fileStore) path(tenantID string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(tenantID))+logSuffix)
+}
+
+// Append writes events as a single record to their tenant's log. A failed
+// write or sync is cut off again so no partial batch stays in the log.
+func (s *fileStore) Append(events ...Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	tenantID := events[0].TenantID
+	for _, e := range events {
+		if e.TenantID != tenantID {
+			return errors.New("append of events for several tenants")
+		}
+	}
+	buf, err := encodeRecord(events...)
+	if err != nil {
+		return err
+	}
+	l, _, err := s.acquire(tenantID, nil)
+	if err != nil {
+		return err
+	}
+	defer l.mu.Unlock()
+	off, err := l.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(buf); err != nil {
+		l.cut(off)
+		return err
+	}
+	if s.policy == syncAlways {
+		// the caller numbers its next events as if these were never
+		// stored, so they must not reappear after a restart either
+		if err := l.f.Sync(); err != nil {
+			l.cut(off)
+			return err
+		}
+	} else {
+		l.dirty = true
+	}
+	l.stored += len(events)
+	if s.retain > 0 && l.stored > 2*s.retain {
+		// the events are stored either way; a failed compaction is retried
+		// on the next append
+		kept, _, err := s.newest(tenantID, s.retain)
+		if err == nil {
+			err = s.compact(tenantID, l, kept)
+		}
+		if err != nil {
+			log.Printf("tenant %s: log compaction failed: %v", tenantID, err)
+		}
+	}
+	return nil
+}
+
+// cut truncates the log back to off after a failed append. The caller
+// must hold l.mu.
+func (l *tenantLog) cut(off int64) {
+	if err := l.f.Truncate(off); err == nil {
+		l.f.Seek(off, io.SeekStart)
+	}
+}
+
+// Load reads the tenant's log, repairing a torn tail, and returns its
+// newest events. Logs holding more than twice limit are compacted. A log
+// opened by Load, as on startup, is only read once.
+func (s *fileStore) Load(tenantID string, limit int) ([]Event, error) {
+	w := eventWindow{limit: limit}
+	l, opened, err := s.acquire(tenantID, w.add)
+	if err != nil {
+		return nil, err
+	}
+	defer l.mu.Unlock()
+	if !opened {
+		if _, err := scanLog(s.path(tenantID), w.add); err != nil {
+			return nil, err
+		}
+	}
+	events := w.newest()
+	if limit > 0 && w.total > 2*limit {
+		if err := s.compact(tenantID, l, events); err != nil {
+			log.Printf("tenant %s: log compaction failed: %v", tenantID, err)
+		}
+	}
+	return events, nil
+}
+
+// newest reads up to limit of the tenant's newest events and counts the
+// records in its log. The caller must hold the log's lock.
+func (s *fileStore) newest(tenantID string, limit int) ([]Event, int, error) {
+	w := eventWindow{limit: limit}
+	if _, err := scanLog(s.path(tenantID), w.add); err != nil {
+		return nil, 0, err
+	}
+	return w.newest(), w.total, nil
+}
+
+// eventWindow keeps the newest limit events passed to add, or all of them
+// when limit is zero, and counts them all
+type eventWindow struct {
+	limit  int
+	total  int
+	events []Event
+}
+
+func (w *eventWindow) add(e Event) {
+	w.total++
+	w.events = append(w.events, e)
+	if w.limit > 0 && len(w.events) > 2*w.limit {
+		w.events = append(w.events[:0], w.events[len(w.events)-w.limit:]...)
+	}
+}
+
+func (w *eventWindow) newest() []Event {
+	if w.limit > 0 && len(w.events) > w.limit {
+		return w.events[len(w.events)-w.limit:]
+	}
+	return w.events
+}
+
+// Tenants lists tenants by decoding the log file names in dir
+func (s *fileStore) Tenants() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, logSuffix) {
+			continue
+		}
+		id, err := hex.DecodeString(strings.TrimSuffix(name, logSuffix))
+		if err != nil {
+			continue
+		}
+		tenants = append(tenants, string(id))
+	}
+	return tenants, nil
+}
+
+// SaveSchemas atomically replaces the tenant's schema file, a JSON object
+// keyed by event type; an empty set removes the file
+func (s *fileStore) SaveSchemas(tenantID string, schemas map[string]json.RawMessage) error {
+	path := filepath.Join(s.dir, hex.EncodeToString([]byte(tenantID))+schemaSuffix)
+	if len(schemas) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(schemas)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".schemas-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSchemas reads every tenant's schema file
+func (s *fileStore) LoadSchemas() (map[string]map[string]json.RawMessage, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]map[string]json.RawMessage)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, schemaSuffix) {
+			continue
+		}
+		id, err := hex.DecodeString(strings.TrimSuffix(name, schemaSuffix))
+		if err != nil {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var schemas map[string]json.RawMessage
+		if err := json.Unmarshal(b, &schemas); err != nil {
+			return nil, fmt.Errorf("tenant %s: corrupt schema file: %w", id, err)
+		}
+		all[string(id)] = schemas
+	}
+	return all, nil
+}
+
+// Close syncs and closes every open log
+func (s *fileStore) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for id, l := range s.logs {
+		l.mu.Lock()
+		if err := l.close(); err != nil {
+			errs = append(errs, err)
+		}
+		l.mu.Unlock()
+		delete(s.logs, id)
+	}
+	return errors.Join(errs...)
+}
+
+// close syncs and closes the log file, if it was opened. The caller must
+// hold l.mu.
+func (l *tenantLog) close() error {
+	l.closed = true
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	l.dirty = false
+	return err
+}
+
+// acquire returns the tenant's log with its lock held. The store lock only
+// guards the lookup; the log is opened under its own lock, so a large log
+// being read does not hold up other tenants. When acquire opens the log it
+// passes the events to fn, if set, and reports so.
+func (s *fileStore) acquire(tenantID string, fn func(Event)) (*tenantLog, bool, error) {
+	for {
+		s.mu.Lock()
+		s.clock++
+		l, ok := s.logs[tenantID]
+		if !ok {
+			s.evict()
+			l = &tenantLog{}
+			s.logs[tenantID] = l
+		}
+		l.used = s.clock
+		s.mu.Unlock()
+
+		l.mu.Lock()
+		if l.closed {
+			// evicted or failed to open before we got it; look again
+			l.mu.Unlock()
+			continue
+		}
+		if l.f != nil {
+			return l, false, nil
+		}
+		err := s.open(tenantID, l, fn)
+		if err == nil {
+			return l, true, nil
+		}
+		l.closed = true
+		l.mu.Unlock()
+		s.mu.Lock()
+		if s.logs[tenantID] == l {
+			delete(s.logs, tenantID)
+		}
+		s.mu.Unlock()
+		return nil, false, err
+	}
+}
+
+// open opens the tenant's log for append after truncating any torn record
+// at its end, passing its events to fn. A log corrupted anywhere else is
+// not opened. The caller must hold l.mu.
+func (s *fileStore) open(tenantID string, l *tenantLog, fn func(Event)) error {
+	path := s.path(tenantID)
+	stored := 0
+	good, err := scanLog(path, func(e Event) {
+		stored++
+		if fn != nil {
+			fn(e)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > good {
+		log.Printf("tenant %s: truncating torn log tail (%d bytes)", tenantID, info.Size()-good)
+		if err := f.Truncate(good); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.stored = stored
+	return nil
+}
+
+// evict closes the least recently used logs until there is room to open
+// another. Logs in use are skipped, so the bound may be exceeded briefly
+// rather than waiting on them. The caller must hold s.mu.
+func (s *fileStore) evict() {
+	if len(s.logs) < s.maxOpen {
+		return
+	}
+	ids := make([]string, 0, len(s.logs))
+	for id := range s.logs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return s.logs[ids[i]].used < s.logs[ids[j]].used })
+	for _, id := range ids {
+		if len(s.logs) < s.maxOpen {
+			return
+		}
+		l := s.logs[id]
+		if !l.mu.TryLock() {
+			continue
+		}
+		if err := l.close(); err != nil {
+			log.Printf("tenant %s: closing idle log failed: %v", id, err)
+		}
+		l.mu.Unlock()
+		delete(s.logs, id)
+	}
+}
+
+// compact atomically replaces the tenant's log with one holding only
+// events. The caller must hold l.mu.
+func (s *fileStore) compact(tenantID string, l *tenantLog, events []Event) error {
+	path := s.path(tenantID)
+	tmp, err := os.CreateTemp(s.dir, ".compact-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, e := range events {
+		rec, err := encodeRecord(e)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(rec)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		tmp.Close()
+		return err
+	}
+	l.f.Close()
+	l.f = tmp
+	l.stored = len(events)
+	if _, err := l.f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if d, err := os.Open(s.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func (s *fileStore) syncLoop(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			logs := make([]*tenantLog, 0, len(s.logs))
+			for _, l := range s.logs {
+				logs = append(logs, l)
+			}
+			s.mu.Unlock()
+			for _, l := range logs {
+				l.mu.Lock()
+				if l.dirty && l.f != nil {
+					if err := l.f.Sync(); err != nil {
+						log.Printf("log sync failed: %v", err)
+					}
+					l.dirty = false
+				}
+				l.mu.Unlock()
+			}
+		}
+	}
+}
+
+// encodeRecord frames events as a length- and checksum-prefixed log
+// record holding one event or, for several, an array of them
+func encodeRecord(events ...Event) ([]byte, error) {
+	var v interface{} = events
+	if len(events) == 1 {
+		v = events[0]
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	payload := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	if len(payload) > maxRecordSize {
+		return nil, fmt.Errorf("record of %d bytes exceeds the limit", len(payload))
+	}
+	rec := make([]byte, recordHeader+len(payload))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.Checksum(payload, crcTable))
+	copy(rec[recordHeader:], payload)
+	return rec, nil
+}
+
+// errBadRecord marks a record that is cut short or fails its checksum
+var errBadRecord = errors.New("bad record")
+
+// scanLog reads records from path, calling fn for each event of the
+// valid ones, and returns the offset just past the last valid record. A
+// bad record is only tolerated at the end of the file, where a crash
+// mid-append leaves it. The scan goes on past it by the length in its
+// header, in the same single pass, and a valid record found after it
+// means the log is corrupt: an error is returned rather than losing the
+// events that follow. A missing file is an empty log.
+func scanLog(path string, fn func(Event)) (int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var good, off int64
+	bad := false
+	for {
+		events, n, err := readRecord(r)
+		if err == io.EOF {
+			return good, nil
+		}
+		if errors.Is(err, errBadRecord) {
+			if n == 0 {
+				// cut short: nothing can follow it
+				return good, nil
+			}
+			bad = true
+			off += n
+			continue
+		}
+		if err != nil {
+			return good, err
+		}
+		if bad {
+			return good, fmt.Errorf("%s: corrupt record at offset %d followed by valid records from offset %d", path, good, off)
+		}
+		if fn != nil {
+			for _, e := range events {
+				fn(e)
+			}
+		}
+		good += n
+		off = good
+	}
+}
+
+// readRecord reads the next record from r and returns its events and
+// size. It returns io.EOF at the clean end of the log and errBadRecord for
+// a record that is truncated or corrupt, with the size of a corrupt one
+// whose length fits in the log and zero for one cut short.
+func readRecord(r io.Reader) ([]Event, int64, error) {
+	var hdr [recordHeader]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, errBadRecord
+		}
+		return nil, 0, err
+	}
+	n := binary.BigEndian.Uint32(hdr[0:4])
+	if n > maxRecordSize {
+		return nil, 0, errBadRecord
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, errBadRecord
+		}
+		return nil, 0, err
+	}
+	size := int64(recordHeader) + int64(n)
+	events, ok := decodeRecord(hdr[:], payload)
+	if !ok {
+		return nil, size, errBadRecord
+	}
+	return events, size, nil
+}
+
+// decodeRecord checks payload against the checksum in hdr and decodes its
+// event or batch of events
+func decodeRecord(hdr, payload []byte) ([]Event, bool) {
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, false
+	}
+	if len(payload) > 0 && payload[0] == '[' {
+		var events []Event
+		if err := json.Unmarshal(payload, &events); err != nil || len(events) == 0 {
+			return nil, false
+		}
+		return events, true
+	}
+	var e Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, false
+	}
+	return []Event{e}, true
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openFileStore(dir, syncAlways, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := store.Append(Event{ID: fmt.Sprintf("a%d", i), TenantID: "tenant/A"}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	if err := store.Append(Event{ID: "b0", TenantID: "tenantB"}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	store, err = openFileStore(dir, syncAlways, 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	tenants, err := store.Tenants()
+	if err != nil {
+		t.Fatalf("tenants: %v", err)
+	}
+	sort.Strings(tenants)
+	if len(tenants) != 2 || tenants[0] != "tenant/A" || tenants[1] != "tenantB" {
+		t.Fatalf("unexpected tenants %v", tenants)
+	}
+	events, err := store.Load("tenant/A", 2)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(events) != 2 || events[0].ID != "a1" || events[1].ID != "a2" {
+		t.Fatalf("expected newest two events, got %+v", events)
+	}
+}
+
+func TestFileStoreClosesIdleLogs(t *testing.T) {
+	store, err := openFileStore(t.TempDir(), syncNever, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	store.maxOpen = 2
+	for i := 0; i < 10; i++ {
+		tenant := fmt.Sprintf("t%d", i%3)
+		if err := store.Append(Event{ID: fmt.Sprintf("e%d", i), TenantID: tenant}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+		if len(store.logs) > store.maxOpen {
+			t.Fatalf("%d logs open, want at most %d", len(store.logs), store.maxOpen)
+		}
+	}
+	// a log closed in between is reopened and appended to in place
+	events, err := store.Load("t0", 0)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	var ids []string
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	if strings.Join(ids, ",") != "e0,e3,e6,e9" {
+		t.Fatalf("unexpected events %v", ids)
+	}
+}
+
+func TestFileStoreTenantsDoNotWaitOnEachOther(t *testing.T) {
+	store, _ := openFileStore(t.TempDir(), syncNever, 0)
+	defer store.Close()
+
+	// while one tenant's log is busy, as when a large one is being read,
+	// another tenant can still append
+	busy, _, err := store.acquire("big", nil)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer busy.mu.Unlock()
+	done := make(chan error, 1)
+	go func() { done <- store.Append(Event{ID: "e0", TenantID: "small"}) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("append waited on another tenant's log")
+	}
+}
+
+func TestFileStoreTornTail(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openFileStore(dir, syncNever, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	store.Append(Event{ID: "e0", TenantID: "t1"})
+	store.Append(Event{ID: "e1", TenantID: "t1"})
+	store.Close()
+
+	// simulate a crash part way through writing a third record
+	rec, _ := encodeRecord(Event{ID: "e2", TenantID: "t1"})
+	f, err := os.OpenFile(store.path("t1"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	f.Write(rec[:len(rec)-3])
+	f.Close()
+
+	store, err = openFileStore(dir, syncAlways, 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	events, err := store.Load("t1", 10)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(events) != 2 || events[1].ID != "e1" {
+		t.Fatalf("expected torn record to be dropped, got %+v", events)
+	}
+	if err := store.Append(Event{ID: "e3", TenantID: "t1"}); err != nil {
+		t.Fatalf("append after repair: %v", err)
+	}
+	store.Close()
+
+	store, _ = openFileStore(dir, syncAlways, 0)
+	defer store.Close()
+	events, _ = store.Load("t1", 10)
+	if len(events) != 3 || events[2].ID != "e3" {
+		t.Fatalf("expected appends after repair to be readable, got %+v", events)
+	}
+}
+
+func TestFileStoreTornBatch(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openFileStore(dir, syncAlways, 0)
+	batch := func(prefix string) []Event {
+		var events []Event
+		for i := 0; i < 3; i++ {
+			events = append(events, Event{ID: fmt.Sprintf("%s%d", prefix, i), TenantID: "t1"})
+		}
+		return events
+	}
+	store.Append(batch("a")...)
+	store.Close()
+	info, _ := os.Stat(store.path("t1"))
+
+	// a crash after the first two events of the second batch reached disk
+	rec, _ := encodeRecord(batch("b")...)
+	whole, _ := encodeRecord(batch("b")[:2]...)
+	f, _ := os.OpenFile(store.path("t1"), os.O_WRONLY|os.O_APPEND, 0)
+	f.Write(rec[:len(whole)])
+	f.Close()
+
+	store, _ = openFileStore(dir, syncAlways, 0)
+	defer store.Close()
+	events, err := store.Load("t1", 10)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(events) != 3 || events[2].ID != "a2" {
+		t.Fatalf("expected none of the torn batch, got %+v", events)
+	}
+	if after, _ := os.Stat(store.path("t1")); after.Size() != info.Size() {
+		t.Fatalf("expected the torn batch to be cut off, log is %d bytes, was %d", after.Size(), info.Size())
+	}
+}
+
+func TestFileStoreCorruptMiddle(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openFileStore(dir, syncAlways, 0)
+	for i := 0; i < 3; i++ {
+		store.Append(Event{ID: fmt.Sprintf("e%d", i), TenantID: "t1"})
+	}
+	store.Close()
+
+	// flip a byte inside the first record's payload
+	b, _ := os.ReadFile(store.path("t1"))
+	b[recordHeader+2] ^= 0xff
+	os.WriteFile(store.path("t1"), b, 0o644)
+
+	store, _ = openFileStore(dir, syncAlways, 0)
+	defer store.Close()
+	if _, err := store.Load("t1", 10); err == nil || !strings.Contains(err.Error(), "corrupt record at offset 0") {
+		t.Fatalf("expected corruption to be reported, got %v", err)
+	}
+	if err := store.Append(Event{ID: "e3", TenantID: "t1"}); err == nil {
+		t.Fatalf("appending to a corrupt log should fail")
+	}
+	if after, _ := os.ReadFile(store.path("t1")); len(after) != len(b) {
+		t.Fatalf("corrupt log was modified: %d bytes, was %d", len(after), len(b))
+	}
+}
+
+func TestFileStoreCompactsOnAppend(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openFileStore(dir, syncNever, 0)
+	store.retain = 5
+	for i := 0; i < 11; i++ {
+		store.Append(Event{ID: fmt.Sprintf("e%d", i), TenantID: "t1"})
+	}
+	store.Close()
+
+	// the eleventh append passed twice the window and kept the last five
+	records := 0
+	if _, err := scanLog(store.path("t1"), func(Event) { records++ }); err != nil || records != 5 {
+		t.Fatalf("expected 5 records after compaction, got %d (%v)", records, err)
+	}
+	store, _ = openFileStore(dir, syncAlways, 0)
+	defer store.Close()
+	events, _ := store.Load("t1", 100)
+	if len(events) != 5 || events[0].ID != "e6" || events[4].ID != "e10" {
+		t.Fatalf("unexpected events after compaction %+v", events)
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openFileStore(dir, syncNever, 0)
+	for i := 0; i < 25; i++ {
+		store.Append(Event{ID: fmt.Sprintf("e%d", i), TenantID: "t1"})
+	}
+	store.Close()
+	before, _ := os.Stat(store.path("t1"))
+
+	store, _ = openFileStore(dir, syncAlways, 0)
+	events, err := store.Load("t1", 5)
+	if err != nil || len(events) != 5 || events[0].ID != "e20" {
+		t.Fatalf("unexpected load result %+v (%v)", events, err)
+	}
+	store.Append(Event{ID: "e25", TenantID: "t1"})
+	store.Close()
+	after, _ := os.Stat(store.path("t1"))
+	if after.Size() >= before.Size() {
+		t.Fatalf("expected compaction to shrink log from %d bytes, got %d", before.Size(), after.Size())
+	}
+
+	store, _ = openFileStore(dir, syncAlways, 0)
+	defer store.Close()
+	events, _ = store.Load("t1", 100)
+	if len(events) != 6 || events[0].ID != "e20" || events[5].ID != "e25" {
+		t.Fatalf("unexpected events after compaction %+v", events)
+	}
+}
+
+func TestOpenEventHubRestoresHistory(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openFileStore(dir, syncAlways, 0)
+	hub, err := openEventHub(defaultConfig(), store)
+	if err != nil {
+		t.Fatalf("openEventHub: %v", err)
+	}
+	posted, _ := hub.postEvent("tenantA", "persisted")
+	store.Close()
+
+	store, _ = openFileStore(dir, syncAlways, 0)
+	defer store.Close()
+	hub, err = openEventHub(defaultConfig(), store)
+	if err != nil {
+		t.Fatalf("reopen hub: %v", err)
+	}
+	events, _, err := hub.history("tenantA", historyQuery{Limit: 10})
+	if err != nil || len(events) != 1 || events[0].ID != posted.ID || events[0].Message != "persisted" {
+		t.Fatalf("history not restored: %+v (%v)", events, err)
+	}
+
+	c := &fakeConn{}
+	hub.resumeConn("tenantA", c, posted.ID)
+	hub.postEvent("tenantA", "after restart")
+	if len(c.msgs) != 1 || c.msgs[0].Message != "after restart" {
+		t.Fatalf("expected resume across restart, got %+v", c.msgs)
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Append(...Event) error             { return errors.New("disk full") }
+func (failingStore) Load(string, int) ([]Event, error) { return nil, nil }
+func (failingStore) Tenants() ([]string, error)        { return nil, nil }
+func (failingStore) Close() error                      { return nil }
+
+func TestStoreFailureSkipsBroadcast(t *testing.T) {
+	hub, _ := openEventHub(defaultConfig(), failingStore{})
+	c := &fakeConn{}
+	hub.registerConn("t1", c)
+	if _, err := hub.postEvent("t1", "lost"); err == nil {
+		t.Fatalf("expected store error")
+	}
+	if len(c.msgs) != 0 {
+		t.Fatalf("event should not be broadcast when it cannot be stored")
+	}
+	if events, _, _ := hub.history("t1", historyQuery{Limit: 10}); len(events) != 0 {
+		t.Fatalf("event should not enter history when it cannot be stored")
+	}
+}
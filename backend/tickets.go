@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// ticketTTL is how long a WebSocket ticket stays redeemable
+	ticketTTL = 30 * time.Second
+	// maxTicketsPerTenant bounds the unredeemed tickets of one tenant
+	maxTicketsPerTenant = 100
+)
+
+var (
+	errInvalidTicket  = &authError{http.StatusUnauthorized, "invalid ticket"}
+	errTooManyTickets = &authError{http.StatusTooManyRequests, "too many outstanding tickets"}
+)
+
+// wsTicket is an outstanding single-use connection ticket
+type wsTicket struct {
+	claims  tokenClaims
+	expires time.Time
+}
+
+// issuedTicket records when a ticket was issued for sweeping
+type issuedTicket struct {
+	id      string
+	expires time.Time
+}
+
+// ticketStore issues short-lived single-use tickets that let browsers,
+// which cannot set headers on a WebSocket handshake, connect without
+// putting a long-lived token in the URL. Tickets are swept in issue
+// order, so each issue only looks at the ones that have expired.
+type ticketStore struct {
+	mu        sync.Mutex
+	tickets   map[string]wsTicket
+	issued    []issuedTicket
+	perTenant map[string]int
+	ttl       time.Duration
+	now       func() time.Time
+}
+
+func newTicketStore(ttl time.Duration) *ticketStore {
+	return &ticketStore{
+		tickets:   make(map[string]wsTicket),
+		perTenant: make(map[string]int),
+		ttl:       ttl,
+		now:       time.Now,
+	}
+}
+
+// issue returns a new ticket carrying claims and its expiry, which is
+// never later than that of the token it was exchanged for. A tenant with
+// maxTicketsPerTenant unredeemed tickets gets errTooManyTickets.
+func (s *ticketStore) issue(claims tokenClaims) (string, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.sweep(now)
+	if s.perTenant[claims.Tenant] >= maxTicketsPerTenant {
+		return "", time.Time{}, errTooManyTickets
+	}
+	id := generateID()
+	expires := now.Add(s.ttl)
+	if claims.ExpiresAt != 0 {
+		if exp := time.Unix(claims.ExpiresAt, 0); exp.Before(expires) {
+			expires = exp
+		}
+	}
+	s.tickets[id] = wsTicket{claims: claims, expires: expires}
+	s.issued = append(s.issued, issuedTicket{id, expires})
+	s.perTenant[claims.Tenant]++
+	return id, expires, nil
+}
+
+// sweep forgets the expired tickets at the front of the issue order. A
+// ticket cut short by its token's expiry may outlive it by up to the ttl
+// until the tickets issued before it expire. The caller must hold s.mu.
+func (s *ticketStore) sweep(now time.Time) {
+	for len(s.issued) > 0 && now.After(s.issued[0].expires) {
+		s.remove(s.issued[0].id)
+		s.issued = s.issued[1:]
+	}
+}
+
+// remove forgets a ticket if it is still outstanding. The caller must
+// hold s.mu.
+func (s *ticketStore) remove(id string) {
+	t, ok := s.tickets[id]
+	if !ok {
+		return
+	}
+	delete(s.tickets, id)
+	if s.perTenant[t.claims.Tenant]--; s.perTenant[t.claims.Tenant] == 0 {
+		delete(s.perTenant, t.claims.Tenant)
+	}
+}
+
+// redeem consumes the ticket, so a second attempt with it fails
+func (s *ticketStore) redeem(id string) (tokenClaims, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tickets[id]
+	if !ok {
+		return tokenClaims{}, errInvalidTicket
+	}
+	s.remove(id)
+	if s.now().After(t.expires) {
+		return tokenClaims{}, errInvalidTicket
+	}
+	return t.claims, nil
+}
+
+// serveTickets handles POST /ws-tickets, exchanging an authenticated
+// request for a ticket to present as ?ticket= on the WebSocket handshake
+func serveTickets(auth *authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		claims, err := auth.claims(r, scopeRead)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		ticket, expires, err := auth.tickets.issue(claims)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, struct {
+			Ticket    string    `json:"ticket"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}{ticket, expires.UTC()})
+	}
+}
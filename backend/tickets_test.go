@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func issueTicket(t *testing.T, client *http.Client, url, token string) string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url+"/ws-tickets", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("issue ticket: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("issue ticket: unexpected status %d", resp.StatusCode)
+	}
+	var body struct {
+		Ticket    string    `json:"ticket"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if body.Ticket == "" || body.ExpiresAt.IsZero() {
+		t.Fatalf("invalid ticket response %+v", body)
+	}
+	return body.Ticket
+}
+
+func TestTicketStore(t *testing.T) {
+	now := time.Date(2025, 7, 31, 12, 0, 0, 0, time.UTC)
+	store := newTicketStore(ticketTTL)
+	store.now = func() time.Time { return now }
+
+	ticket, expires, _ := store.issue(tokenClaims{Tenant: "tenantA", Scope: scopeRead})
+	if !expires.Equal(now.Add(ticketTTL)) {
+		t.Fatalf("unexpected expiry %v", expires)
+	}
+	claims, err := store.redeem(ticket)
+	if err != nil || claims.Tenant != "tenantA" {
+		t.Fatalf("redeem: %+v (%v)", claims, err)
+	}
+	if _, err := store.redeem(ticket); !errors.Is(err, errInvalidTicket) {
+		t.Fatalf("replayed ticket should be rejected, got %v", err)
+	}
+
+	expired, _, _ := store.issue(tokenClaims{Tenant: "tenantA"})
+	now = now.Add(ticketTTL + time.Second)
+	if _, err := store.redeem(expired); !errors.Is(err, errInvalidTicket) {
+		t.Fatalf("expired ticket should be rejected, got %v", err)
+	}
+
+	store.issue(tokenClaims{Tenant: "tenantA"})
+	now = now.Add(ticketTTL + time.Second)
+	store.issue(tokenClaims{Tenant: "tenantA"})
+	if len(store.tickets) != 1 || len(store.issued) != 1 {
+		t.Fatalf("expired tickets should be swept, %d left", len(store.tickets))
+	}
+
+	// a ticket never outlives the token it was exchanged for
+	_, expires, _ = store.issue(tokenClaims{Tenant: "tenantA", ExpiresAt: now.Add(10 * time.Second).Unix()})
+	if !expires.Equal(now.Add(10 * time.Second)) {
+		t.Fatalf("expiry should be capped at the token's, got %v", expires)
+	}
+}
+
+func TestTicketStoreTenantCap(t *testing.T) {
+	now := time.Date(2025, 7, 31, 12, 0, 0, 0, time.UTC)
+	store := newTicketStore(ticketTTL)
+	store.now = func() time.Time { return now }
+
+	var first string
+	for i := 0; i < maxTicketsPerTenant; i++ {
+		id, _, err := store.issue(tokenClaims{Tenant: "tenantA"})
+		if err != nil {
+			t.Fatalf("issue %d: %v", i, err)
+		}
+		if i == 0 {
+			first = id
+		}
+	}
+	if _, _, err := store.issue(tokenClaims{Tenant: "tenantA"}); !errors.Is(err, errTooManyTickets) {
+		t.Fatalf("expected errTooManyTickets, got %v", err)
+	}
+	if _, _, err := store.issue(tokenClaims{Tenant: "tenantB"}); err != nil {
+		t.Fatalf("other tenants are not limited: %v", err)
+	}
+	store.redeem(first)
+	if _, _, err := store.issue(tokenClaims{Tenant: "tenantA"}); err != nil {
+		t.Fatalf("a redeemed ticket should free its slot: %v", err)
+	}
+	now = now.Add(ticketTTL + time.Second)
+	if _, _, err := store.issue(tokenClaims{Tenant: "tenantA"}); err != nil || store.perTenant["tenantA"] != 1 {
+		t.Fatalf("expired tickets should free their slots: %v (%d)", err, store.perTenant["tenantA"])
+	}
+}
+
+func TestTicketEndpoint(t *testing.T) {
+	srv := httptest.NewServer(newServer(defaultConfig(), newEventHub(defaultConfig()), newAuthenticator(testSecret)))
+	defer srv.Close()
+	client := srv.Client()
+
+	resp, err := client.Post(srv.URL+"/ws-tickets", "", nil)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", resp.StatusCode)
+	}
+
+	publishOnly := mustToken(t, "tenantA", scopePublish, time.Hour)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/ws-tickets", nil)
+	req.Header.Set("Authorization", "Bearer "+publishOnly)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 without read scope, got %d", resp.StatusCode)
+	}
+
+	ticket := issueTicket(t, client, srv.URL, mustToken(t, "tenantA", scopeRead, time.Hour))
+	if _, err := dialWS(srv.URL + "/ws?ticket=" + ticket + "&tenant=tenantB"); err == nil {
+		t.Fatalf("ticket for tenantA must not open tenantB")
+	}
+
+	ticket = issueTicket(t, client, srv.URL, mustToken(t, "tenantA", scopeRead, time.Hour))
+	ws, err := dialWS(srv.URL + "/ws?ticket=" + ticket)
+	if err != nil {
+		t.Fatalf("dial with ticket: %v", err)
+	}
+	ws.Close()
+	if _, err := dialWS(srv.URL + "/ws?ticket=" + ticket); err == nil {
+		t.Fatalf("reused ticket should be rejected")
+	}
+}
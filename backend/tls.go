@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certPollInterval is how often the certificate files are checked for
+// changes
+const certPollInterval = 10 * time.Second
+
+// devCertValidity bounds the generated development certificate
+const devCertValidity = 24 * time.Hour
+
+// certReloader serves the certificate in certFile and keyFile and picks up
+// replacements without a restart. A certificate that fails to load is
+// logged and the previous one kept, so a half-finished renewal cannot take
+// the server down.
+type certReloader struct {
+	certFile, keyFile string
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+	modTime           time.Time // newer of the two files' at the last load
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the certificate files unconditionally
+func (c *certReloader) reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+	return nil
+}
+
+// reloadIfChanged reloads the certificate when either file has been
+// modified since the last load
+func (c *certReloader) reloadIfChanged() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	changed := !modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	return c.reload()
+}
+
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// watch reloads the certificate when its files change, checking every
+// interval, and whenever hup receives a signal, until ctx is done
+func (c *certReloader) watch(ctx context.Context, interval time.Duration, hup <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err = c.reloadIfChanged()
+		case <-hup:
+			if err = c.reload(); err == nil {
+				log.Printf("reloaded certificate %s", c.certFile)
+			}
+		}
+		if err != nil {
+			log.Printf("keeping previous certificate: %v", err)
+		}
+	}
+}
+
+// devCertificate generates a self-signed certificate for localhost that
+// lives only in memory
+func devCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "eventfeed development"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(devCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// newTLSConfig returns the TLS configuration cfg asks for, or nil to serve
+// plain HTTP. The reloader is set when the certificate comes from files.
+func newTLSConfig(cfg Config) (*tls.Config, *certReloader, error) {
+	var tc *tls.Config
+	var reloader *certReloader
+	switch {
+	case cfg.DevTLS:
+		cert, err := devCertificate()
+		if err != nil {
+			return nil, nil, fmt.Errorf("generate development certificate: %w", err)
+		}
+		log.Printf("warning: serving a self-signed development certificate, SHA-256 fingerprint %x", sha256.Sum256(cert.Certificate[0]))
+		tc = &tls.Config{Certificates: []tls.Certificate{cert}}
+	case cfg.TLSCert != "":
+		var err error
+		if reloader, err = newCertReloader(cfg.TLSCert, cfg.TLSKey); err != nil {
+			return nil, nil, fmt.Errorf("load certificate: %w", err)
+		}
+		tc = &tls.Config{GetCertificate: reloader.getCertificate}
+	default:
+		return nil, nil, nil
+	}
+	tc.MinVersion = tls.VersionTLS12
+	if cfg.TLSClientCA != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("%s: no certificates found", cfg.TLSClientCA)
+		}
+		tc.ClientCAs = pool
+		// tokens keep working for clients without a certificate
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc, reloader, nil
+}
+
+// parseClientTenants parses "name=tenant,..." pairs mapping client
+// certificate common names to tenants
+func parseClientTenants(s string) (map[string]string, error) {
+	tenants := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, tenant, ok := strings.Cut(entry, "=")
+		name, tenant = strings.TrimSpace(name), strings.TrimSpace(tenant)
+		if !ok || name == "" || tenant == "" {
+			return nil, fmt.Errorf("invalid client tenant mapping %q", entry)
+		}
+		tenants[name] = tenant
+	}
+	return tenants, nil
+}
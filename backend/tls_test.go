@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate issued by issueCert with its key in PEM form
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// issueCert issues a certificate for cn signed by parent, or self-signed
+// when parent is nil
+func issueCert(t *testing.T, cn string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	pair, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatalf("key pair: %v", err)
+	}
+	return pair
+}
+
+// writeFiles writes the certificate and key and stamps them with modTime
+func (c *testCert) writeFiles(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	t.Helper()
+	for name, data := range map[string][]byte{certFile: c.certPEM, keyFile: c.keyPEM} {
+		if err := os.WriteFile(name, data, 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		os.Chtimes(name, modTime, modTime)
+	}
+}
+
+func servedCN(t *testing.T, r *certReloader) string {
+	t.Helper()
+	cert, _ := r.getCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse served certificate: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	base := time.Now().Add(-time.Hour)
+	issueCert(t, "one", nil, false).writeFiles(t, certFile, keyFile, base)
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cn := servedCN(t, r); cn != "one" {
+		t.Fatalf("expected one, got %s", cn)
+	}
+	if err := r.reloadIfChanged(); err != nil || servedCN(t, r) != "one" {
+		t.Fatalf("unchanged files should not reload: %v", err)
+	}
+
+	issueCert(t, "two", nil, false).writeFiles(t, certFile, keyFile, base.Add(time.Minute))
+	if err := r.reloadIfChanged(); err != nil || servedCN(t, r) != "two" {
+		t.Fatalf("changed files should reload, got %s (%v)", servedCN(t, r), err)
+	}
+
+	// a renewal caught halfway keeps the previous certificate
+	os.WriteFile(keyFile, []byte("garbage"), 0o600)
+	os.Chtimes(keyFile, base.Add(2*time.Minute), base.Add(2*time.Minute))
+	if err := r.reloadIfChanged(); err == nil {
+		t.Fatalf("expected an error loading a broken key")
+	}
+	if cn := servedCN(t, r); cn != "two" {
+		t.Fatalf("broken reload should keep two, got %s", cn)
+	}
+
+	// SIGHUP reloads even when the modification time did not move
+	issueCert(t, "three", nil, false).writeFiles(t, certFile, keyFile, base.Add(2*time.Minute))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hup := make(chan os.Signal, 1)
+	go r.watch(ctx, time.Hour, hup)
+	hup <- os.Interrupt
+	deadline := time.Now().Add(time.Second)
+	for servedCN(t, r) != "three" {
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate not reloaded on signal")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, "test ca", nil, true)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, ca.certPEM, 0o600)
+
+	cfg, err := loadConfig([]string{"-insecure-no-auth", "-dev-tls", "-frontend-dir", "", "-tls-client-ca", caFile, "-tls-client-tenants", "svc-a=tenantA,svc-b=tenantB"}, envMap(nil))
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	tc, reloader, err := newTLSConfig(cfg)
+	if err != nil || tc == nil || reloader != nil {
+		t.Fatalf("dev tls config: %v", err)
+	}
+	auth := newAuthenticator(testSecret)
+	auth.trustClientCerts(cfg.TLSClientTenants)
+	srv := httptest.NewUnstartedServer(newServer(cfg, newEventHub(cfg), auth))
+	srv.TLS = tc
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tc.Certificates[0].Leaf)
+	client := func(cert *testCert) *http.Client {
+		conf := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			conf.Certificates = []tls.Certificate{cert.tlsCertificate(t)}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+	}
+	post := func(c *http.Client, tenant string) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/events", strings.NewReader(`{"message":"over mtls"}`))
+		if tenant != "" {
+			req.Header.Set("X-Tenant-ID", tenant)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	svcA := client(issueCert(t, "svc-a", ca, false))
+	if status := post(svcA, ""); status != http.StatusOK {
+		t.Fatalf("mapped client certificate should publish, got %d", status)
+	}
+	if status := post(svcA, "tenantA"); status != http.StatusOK {
+		t.Fatalf("naming the mapped tenant should be allowed, got %d", status)
+	}
+	if status := post(svcA, "tenantB"); status != http.StatusForbidden {
+		t.Fatalf("expected 403 for another tenant, got %d", status)
+	}
+	if status := post(client(issueCert(t, "svc-c", ca, false)), ""); status != http.StatusForbidden {
+		t.Fatalf("expected 403 for an unmapped certificate, got %d", status)
+	}
+	if status := post(client(nil), "tenantA"); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without certificate or token, got %d", status)
+	}
+	// a certificate from another CA is not offered, leaving the client unauthenticated
+	if status := post(client(issueCert(t, "svc-a", nil, false)), ""); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an untrusted certificate, got %d", status)
+	}
+}
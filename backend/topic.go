@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Topics are dot-separated words such as "orders.created". Subscriptions
+// are patterns in which "*" matches exactly one word and "#" matches zero
+// or more, so "orders.*" matches "orders.created" and "orders.#" also
+// matches "orders" and "orders.eu.created". Events without a topic have no
+// words and are only matched by patterns like "#".
+const (
+	maxTopicLength      = 255
+	maxSubscriptions    = 64
+	defaultSubscription = "#"
+)
+
+var (
+	errInvalidTopic         = errors.New("invalid topic")
+	errTooManySubscriptions = errors.New("too many subscriptions")
+)
+
+// validTopic reports whether s can be published to. The empty topic is
+// valid and means the event has none.
+func validTopic(s string) bool {
+	if s == "" {
+		return true
+	}
+	if len(s) > maxTopicLength {
+		return false
+	}
+	for _, w := range strings.Split(s, ".") {
+		if w == "" || strings.ContainsAny(w, "*#") {
+			return false
+		}
+	}
+	return true
+}
+
+// validPattern reports whether s can be subscribed to. Wildcards must make
+// up a whole word.
+func validPattern(s string) bool {
+	if s == "" || len(s) > maxTopicLength {
+		return false
+	}
+	for _, w := range strings.Split(s, ".") {
+		if w == "*" || w == "#" {
+			continue
+		}
+		if w == "" || strings.ContainsAny(w, "*#") {
+			return false
+		}
+	}
+	return true
+}
+
+// topicMatches reports whether topic is matched by pattern
+func topicMatches(pattern, topic string) bool {
+	if pattern == "#" {
+		return true
+	}
+	return matchWords(topicWords(pattern), topicWords(topic))
+}
+
+func topicWords(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ".")
+}
+
+// matchWords matches word by word, tracking which pattern prefixes match
+// the topic read so far so that patterns with many "#" stay linear in
+// the topic length
+func matchWords(pattern, topic []string) bool {
+	// cur[i] reports whether pattern[:i] matches the topic words consumed
+	cur := make([]bool, len(pattern)+1)
+	cur[0] = true
+	for i, w := range pattern {
+		cur[i+1] = cur[i] && w == "#"
+	}
+	next := make([]bool, len(pattern)+1)
+	for _, t := range topic {
+		next[0] = false
+		for i, w := range pattern {
+			switch w {
+			case "#":
+				next[i+1] = next[i] || cur[i+1] || cur[i]
+			case "*":
+				next[i+1] = cur[i]
+			default:
+				next[i+1] = cur[i] && w == t
+			}
+		}
+		cur, next = next, cur
+	}
+	return cur[len(pattern)]
+}
+
+// subscriptionsFrom returns the subscriptions requested by the topic and
+// filter query parameters of a subscribe request, or nil for the default.
+// A filter applies to every requested pattern.
+func subscriptionsFrom(r *http.Request) ([]subscription, error) {
+	q := r.URL.Query()
+	patterns := q["topic"]
+	if len(patterns) > maxSubscriptions {
+		return nil, errTooManySubscriptions
+	}
+	for _, p := range patterns {
+		if !validPattern(p) {
+			return nil, errInvalidTopic
+		}
+	}
+	var f *filter
+	if src := q.Get("filter"); src != "" {
+		var err error
+		if f, err = compileFilter(src); err != nil {
+			return nil, err
+		}
+		if len(patterns) == 0 {
+			patterns = []string{defaultSubscription}
+		}
+	}
+	subs := make([]subscription, len(patterns))
+	for i, p := range patterns {
+		subs[i] = subscription{Pattern: p, Filter: f}
+	}
+	return subs, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"#", "", true},
+		{"#", "orders.created", true},
+		{"orders", "orders", true},
+		{"orders", "orders.created", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.eu.created", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.eu.created", true},
+		{"orders.#", "chat.message", false},
+		{"orders.#", "", false},
+		{"*.created", "orders.created", true},
+		{"*.created", "created", false},
+		{"#.created", "created", true},
+		{"#.created", "orders.eu.created", true},
+		{"#.created", "orders.eu.deleted", false},
+		{"orders.#.created", "orders.created", true},
+		{"orders.#.created", "orders.eu.de.created", true},
+		{"*.#.*", "a", false},
+		{"*.#.*", "a.b", true},
+		{"#.#", "a.b.c", true},
+	}
+	for _, tc := range cases {
+		if got := topicMatches(tc.pattern, tc.topic); got != tc.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tc.pattern, tc.topic, got, tc.want)
+		}
+	}
+}
+
+func TestTopicValidation(t *testing.T) {
+	for _, s := range []string{"", "orders", "orders.created", "a.b-c_d.e"} {
+		if !validTopic(s) {
+			t.Errorf("topic %q should be valid", s)
+		}
+	}
+	for _, s := range []string{"orders.*", "#", "orders..created", ".orders", "orders.", "or*ders", strings.Repeat("a", maxTopicLength+1)} {
+		if validTopic(s) {
+			t.Errorf("topic %q should be invalid", s)
+		}
+	}
+	for _, s := range []string{"#", "*", "orders.*", "orders.#", "*.created", "orders"} {
+		if !validPattern(s) {
+			t.Errorf("pattern %q should be valid", s)
+		}
+	}
+	for _, s := range []string{"", "orders.", "orders..*", "ord#", "orders.**"} {
+		if validPattern(s) {
+			t.Errorf("pattern %q should be invalid", s)
+		}
+	}
+}
+
+func TestTopicSubscriptions(t *testing.T) {
+	hub := newTenantHub(defaultMaxEvents)
+	all, orders, alerts := &fakeConn{}, &fakeConn{}, &fakeConn{}
+	hub.addConn(all)
+	hub.addConn(orders, subscription{Pattern: "orders.#"})
+	hub.addConn(alerts, subscription{Pattern: "alerts.*"}, subscription{Pattern: "orders.cancelled"})
+
+	for _, topic := range []string{"orders.created", "orders.cancelled", "alerts.disk", "chat", ""} {
+		hub.addEvent(Event{ID: topic, TenantID: "t1", Topic: topic})
+	}
+	expect := func(c *fakeConn, want string) {
+		t.Helper()
+		var got []string
+		for _, e := range c.msgs {
+			got = append(got, e.Topic)
+		}
+		if strings.Join(got, ",") != want {
+			t.Fatalf("expected %q, got %q", want, strings.Join(got, ","))
+		}
+		c.msgs = nil
+	}
+	expect(all, "orders.created,orders.cancelled,alerts.disk,chat,")
+	expect(orders, "orders.created,orders.cancelled")
+	expect(alerts, "orders.cancelled,alerts.disk")
+
+	hub.unsubscribe(orders, "orders.#")
+	hub.subscribe(orders, subscription{Pattern: "chat"})
+	hub.subscribe(orders, subscription{Pattern: "chat"})
+	hub.addEvent(Event{TenantID: "t1", Topic: "orders.created"})
+	hub.addEvent(Event{TenantID: "t1", Topic: "chat"})
+	expect(orders, "chat")
+
+	hub.removeConn(orders)
+	if len(hub.subscribers["chat"]) != 0 {
+		t.Fatalf("removed connection should leave no subscriptions")
+	}
+	if err := hub.subscribe(orders, subscription{Pattern: "chat"}); err != errNotRegistered || len(hub.subscribers["chat"]) != 0 {
+		t.Fatalf("subscribe after removal should be refused, got %v", err)
+	}
+
+	for i := 1; i < maxSubscriptions; i++ {
+		if err := hub.subscribe(all, subscription{Pattern: fmt.Sprintf("t%d", i)}); err != nil {
+			t.Fatalf("subscribe %d: %v", i, err)
+		}
+	}
+	if err := hub.subscribe(all, subscription{Pattern: "one.more"}); err != errTooManySubscriptions {
+		t.Fatalf("expected errTooManySubscriptions, got %v", err)
+	}
+}
+
+func TestResumeConnTopics(t *testing.T) {
+	hub := newTenantHub(defaultMaxEvents)
+	hub.addEvent(Event{ID: "e0", TenantID: "t1", Topic: "orders.created"})
+	hub.addEvent(Event{ID: "e1", TenantID: "t1", Topic: "chat"})
+	hub.addEvent(Event{ID: "e2", TenantID: "t1", Topic: "orders.paid"})
+
+	c := &fakeConn{}
+	if err := hub.resumeConn(c, "e0", subscription{Pattern: "orders.*"}); err != nil {
+		t.Fatalf("resumeConn: %v", err)
+	}
+	hub.addEvent(Event{ID: "e3", TenantID: "t1", Topic: "chat"})
+	hub.addEvent(Event{ID: "e4", TenantID: "t1", Topic: "orders.shipped"})
+	var got []string
+	for _, e := range c.msgs {
+		got = append(got, e.ID)
+	}
+	if strings.Join(got, ",") != "e2,e4" {
+		t.Fatalf("expected e2,e4, got %v", got)
+	}
+}
+
+func TestTopicsEndToEnd(t *testing.T) {
+	srv, _ := setupTestServer()
+	defer srv.Close()
+	client := srv.Client()
+
+	if _, err := dialWS(srv.URL + "/ws?tenant=tenantA&topic=orders..x"); err == nil {
+		t.Fatalf("invalid topic pattern should fail the handshake")
+	}
+	orders, err := dialWS(srv.URL + "/ws?tenant=tenantA&topic=orders.*")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer orders.Close()
+
+	publish := func(topic, msg string) int {
+		body := fmt.Sprintf(`{"topic":%q,"message":%q}`, topic, msg)
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/events", strings.NewReader(body))
+		req.Header.Set("X-Tenant-ID", "tenantA")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := publish("orders.#", "x"); status != http.StatusBadRequest {
+		t.Fatalf("publishing to a wildcard should fail, got %d", status)
+	}
+	publish("chat", "hi")
+	publish("orders.created", "o1")
+	var ev Event
+	if err := orders.ReadJSON(&ev, time.Second); err != nil || ev.Topic != "orders.created" || ev.Message != "o1" {
+		t.Fatalf("expected orders.created event, got %+v (%v)", ev, err)
+	}
+
+	orders.WriteJSON(map[string]string{"op": "subscribe", "ref": "s1", "topic": "chat"})
+	if reply := readReply(t, orders); reply.Op != opAck || reply.Ref != "s1" {
+		t.Fatalf("unexpected subscribe reply: %+v", reply)
+	}
+	orders.WriteJSON(map[string]string{"op": "unsubscribe", "ref": "u1", "topic": "orders.*"})
+	if reply := readReply(t, orders); reply.Op != opAck || reply.Ref != "u1" {
+		t.Fatalf("unexpected unsubscribe reply: %+v", reply)
+	}
+	orders.WriteJSON(map[string]string{"op": "subscribe", "ref": "s2", "topic": "bad..topic"})
+	if reply := readReply(t, orders); reply.Op != opError || reply.Error != "invalid topic" {
+		t.Fatalf("expected invalid topic error, got %+v", reply)
+	}
+	publish("orders.paid", "o2")
+	publish("chat", "hello")
+	if err := orders.ReadJSON(&ev, time.Second); err != nil || ev.Topic != "chat" || ev.Message != "hello" {
+		t.Fatalf("expected only the chat event, got %+v (%v)", ev, err)
+	}
+
+	status, h := getHistory(t, client, srv.URL, "tenantA", "?topic=orders.%23")
+	if status != http.StatusOK || len(h.Events) != 2 || h.Events[0].Message != "o1" || h.Events[1].Message != "o2" {
+		t.Fatalf("expected the two orders events, got %d %+v", status, h.Events)
+	}
+	if status, _ := getHistory(t, client, srv.URL, "tenantA", "?topic=orders.x%23"); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid topic, got %d", status)
+	}
+}
@@ -1,44 +1,270 @@
 package main
 
 import (
+	"bufio"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const magicKey = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
-// wsConn implements minimal WebSocket connection for server->client messages
+// Frame opcodes
+const (
+	opContinuation = 0
+	opText         = 1
+	opBinary       = 2
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// rsv1 marks a compressed message in its first frame header
+const rsv1 = 0x40
+
+// Close status codes
+const (
+	closeNormal          = 1000
+	closeGoingAway       = 1001
+	closeProtocolError   = 1002
+	closeNoStatus        = 1005
+	closeInvalidPayload  = 1007
+	closePolicyViolation = 1008
+	closeMessageTooBig   = 1009
+	closeInternalError   = 1011
+	closeTryAgainLater   = 1013
+)
+
+// closeTimeout bounds sending a final close frame and then waiting for the
+// peer to answer it
+const closeTimeout = time.Second
+
+// connOptions tunes delivery to subscriber connections
+type connOptions struct {
+	// QueueSize bounds the live messages queued per connection
+	QueueSize int
+	// Overflow is applied when a connection's queue is full
+	Overflow overflowPolicy
+	// SlowCloseCode is sent when disconnecting a slow consumer, either
+	// 1008 (policy violation) or 1013 (try again later)
+	SlowCloseCode int
+	// SSEKeepAlive is the interval between SSE keep-alive comments
+	SSEKeepAlive time.Duration
+	// PingInterval is the interval between WebSocket pings; zero disables
+	// heartbeats and the idle timeout
+	PingInterval time.Duration
+	// PongTimeout is how long past the next ping a peer may stay silent
+	// before the connection is considered dead
+	PongTimeout time.Duration
+	// WriteTimeout bounds each WebSocket frame and SSE write; zero disables
+	// the deadline
+	WriteTimeout time.Duration
+	// MaxMessageSize caps a reassembled client message in bytes
+	MaxMessageSize int
+	// Compression enables negotiating permessage-deflate
+	Compression bool
+	// CompressionThreshold is the smallest message in bytes worth compressing
+	CompressionThreshold int
+	// CompressionContextTakeover keeps the compression context across
+	// messages unless the client asks otherwise. It compresses better but
+	// holds a compressor per connection.
+	CompressionContextTakeover bool
+}
+
+func defaultConnOptions() connOptions {
+	return connOptions{
+		QueueSize:      256,
+		Overflow:       disconnect,
+		SlowCloseCode:  closeTryAgainLater,
+		SSEKeepAlive:   sseKeepAliveInterval,
+		PingInterval:   30 * time.Second,
+		PongTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxMessageSize: 1 << 20,
+
+		Compression:          true,
+		CompressionThreshold: 256,
+	}
+}
+
+// wsConn implements minimal WebSocket connection for server->client messages.
+// Messages are queued and written by a dedicated goroutine.
 
 type wsConn struct {
-	c  net.Conn
-	mu sync.Mutex
+	c          net.Conn
+	r          *bufio.Reader
+	mu         sync.Mutex
+	queue      *sendQueue
+	opts       connOptions
+	writerDone chan struct{}
+	closeSent  atomic.Bool
+	deflate    *deflater
+	inflate    *inflater
+	// onMessage, when set before readLoop starts, receives each data
+	// message from the client; a closeError it returns fails the
+	// connection
+	onMessage func(opcode byte, msg []byte) error
+	// cloudEvents sends events in the CloudEvents JSON format
+	cloudEvents bool
 }
 
-func newWSConn(c net.Conn) *wsConn {
-	return &wsConn{c: c}
+// newWSConn wraps c and starts its writer. Bytes the client sent before
+// the handshake completed may be passed in r; otherwise r is nil. pmd
+// holds the negotiated permessage-deflate parameters, if any.
+func newWSConn(c net.Conn, r *bufio.Reader, opts connOptions, pmd *deflateParams) *wsConn {
+	if r == nil {
+		r = bufio.NewReader(c)
+	}
+	w := &wsConn{
+		c:          c,
+		r:          r,
+		queue:      newSendQueue(opts.QueueSize, opts.Overflow),
+		opts:       opts,
+		writerDone: make(chan struct{}),
+	}
+	if pmd != nil {
+		w.deflate = newDeflater(!pmd.serverNoContextTakeover)
+		w.inflate = newInflater(!pmd.clientNoContextTakeover)
+	}
+	go w.writeLoop()
+	return w
 }
 
+// WriteJSON queues v as a text frame. A slow consumer whose queue is full
+// is handled by the overflow policy.
 func (w *wsConn) WriteJSON(v interface{}) error {
-	data, err := json.Marshal(v)
+	data, err := json.Marshal(encodeOutput(v, w.cloudEvents))
 	if err != nil {
 		return err
 	}
-	return w.writeFrame(1, data) // text frame opcode=1
+	err = w.queue.push(queuedFrame{opcode: opText, payload: data}, true)
+	if errors.Is(err, errSlowConsumer) {
+		w.closeWith(w.opts.SlowCloseCode, "slow consumer", true)
+	}
+	return err
+}
+
+// writeBacklog queues replayed history regardless of the queue bound
+func (w *wsConn) writeBacklog(v interface{}) error {
+	data, err := json.Marshal(encodeOutput(v, w.cloudEvents))
+	if err != nil {
+		return err
+	}
+	return w.queue.push(queuedFrame{opcode: opText, payload: data}, false)
+}
+
+// resyncPending reports whether an earlier resync is still being sent
+func (w *wsConn) resyncPending() bool {
+	return w.queue.resyncPending()
+}
+
+// writeResync queues a frame of a resync replay. A replay that does not
+// fit the send queue closes the connection like a slow consumer.
+func (w *wsConn) writeResync(v interface{}) error {
+	data, err := json.Marshal(encodeOutput(v, w.cloudEvents))
+	if err != nil {
+		return err
+	}
+	err = w.queue.pushResync(queuedFrame{opcode: opText, payload: data})
+	if errors.Is(err, errSlowConsumer) {
+		w.closeWith(w.opts.SlowCloseCode, "resync exceeds send queue", true)
+	}
+	return err
+}
+
+// writeLoop sends queued frames and periodic pings until the queue is
+// closed or a write fails. Once its close frame is out it leaves closing
+// the connection to readLoop, which waits for the peer's reply.
+func (w *wsConn) writeLoop() {
+	defer close(w.writerDone)
+	var ping <-chan time.Time
+	if w.opts.PingInterval > 0 {
+		ticker := time.NewTicker(w.opts.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	for {
+		select {
+		case <-w.queue.ready:
+			frames, done := w.queue.drain()
+			for _, f := range frames {
+				if f.opcode == opClose {
+					w.closeSent.Store(true)
+					w.c.SetReadDeadline(time.Now().Add(closeTimeout))
+				}
+				if err := w.writeMessage(f); err != nil {
+					w.queue.close(nil, true)
+					w.c.Close()
+					return
+				}
+				if f.resync {
+					w.queue.resyncWritten()
+				}
+			}
+			if done {
+				return
+			}
+		case <-ping:
+			if err := w.writeFrame(opPing, nil); err != nil {
+				w.queue.close(nil, true)
+				w.c.Close()
+				return
+			}
+		}
+	}
+}
+
+// extendReadDeadline gives the peer until the next ping plus PongTimeout
+// to show it is alive
+func (w *wsConn) extendReadDeadline() {
+	if w.opts.PingInterval > 0 && !w.closeSent.Load() {
+		w.c.SetReadDeadline(time.Now().Add(w.opts.PingInterval + w.opts.PongTimeout))
+	}
+}
+
+// writeMessage sends a queued frame, compressing data messages when
+// permessage-deflate was negotiated and the message is large enough
+func (w *wsConn) writeMessage(f queuedFrame) error {
+	if w.deflate == nil || isControl(f.opcode) || len(f.payload) < w.opts.CompressionThreshold {
+		return w.writeFrame(f.opcode, f.payload)
+	}
+	compressed, err := w.deflate.compress(f.payload)
+	if err != nil {
+		return err
+	}
+	return w.writeHeaderAndPayload(0x80|rsv1|f.opcode, compressed)
 }
 
 func (w *wsConn) writeFrame(opcode byte, payload []byte) error {
+	return w.writeHeaderAndPayload(0x80|opcode, payload)
+}
+
+// writeHeaderAndPayload writes a frame whose first header byte is b0
+func (w *wsConn) writeHeaderAndPayload(b0 byte, payload []byte) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	opcode := b0 & 0x0F
 
-	header := []byte{0x80 | opcode, 0}
+	timeout := w.opts.WriteTimeout
+	if opcode == opClose && (timeout == 0 || timeout > closeTimeout) {
+		timeout = closeTimeout
+	}
+	if timeout > 0 {
+		w.c.SetWriteDeadline(time.Now().Add(timeout))
+	}
+
+	header := []byte{b0, 0}
 	l := len(payload)
 	if l < 126 {
 		header[1] = byte(l)
@@ -60,87 +286,124 @@ func (w *wsConn) writeFrame(opcode byte, payload []byte) error {
 	return err
 }
 
+// readLoop reads client messages until the connection closes, answering
+// the closing handshake or failing the connection on protocol errors
 func (w *wsConn) readLoop(tenantID string, onClose func()) {
-	buf := make([]byte, 2)
+	w.extendReadDeadline()
 	for {
-		if _, err := io.ReadFull(w.c, buf); err != nil {
-			log.Printf("tenant %s: read error: %v", tenantID, err)
+		opcode, msg, err := w.readMessage()
+		var ce *closeError
+		if errors.As(err, &ce) {
+			log.Printf("tenant %s: protocol error: %v", tenantID, err)
+			w.closeWith(ce.code, ce.reason, true)
 			break
 		}
-		fin := buf[0]&0x80 != 0
-		opcode := buf[0] & 0x0F
-		masked := buf[1]&0x80 != 0
-		length := int(buf[1] & 0x7F)
-		if length == 126 {
-			ext := make([]byte, 2)
-			if _, err := io.ReadFull(w.c, ext); err != nil {
-				log.Printf("tenant %s: read error: %v", tenantID, err)
-				break
-			}
-			length = int(binary.BigEndian.Uint16(ext))
-		} else if length == 127 {
-			ext := make([]byte, 8)
-			if _, err := io.ReadFull(w.c, ext); err != nil {
-				log.Printf("tenant %s: read error: %v", tenantID, err)
-				break
-			}
-			length = int(binary.BigEndian.Uint64(ext))
-		}
-		maskKey := make([]byte, 4)
-		if masked {
-			if _, err := io.ReadFull(w.c, maskKey); err != nil {
-				log.Printf("tenant %s: read error: %v", tenantID, err)
-				break
-			}
-		}
-		payload := make([]byte, length)
-		if _, err := io.ReadFull(w.c, payload); err != nil {
+		if err != nil {
 			log.Printf("tenant %s: read error: %v", tenantID, err)
+			w.queue.close(nil, true)
 			break
 		}
-		if masked {
-			for i := range payload {
-				payload[i] ^= maskKey[i%4]
+		if opcode == opClose {
+			code, _, err := parseClose(msg)
+			if errors.As(err, &ce) {
+				w.closeWith(ce.code, ce.reason, true)
+			} else {
+				w.closeWith(code, "", true)
 			}
-		}
-		if opcode == 8 { // close frame
 			break
 		}
-		if !fin {
-			// ignore fragmented frames for simplicity
-			continue
+		if w.onMessage != nil {
+			if err := w.onMessage(opcode, msg); errors.As(err, &ce) {
+				log.Printf("tenant %s: %v", tenantID, err)
+				w.closeWith(ce.code, ce.reason, true)
+				break
+			}
 		}
-		// ignore payload for now
 	}
 	onClose()
+	// give the writer a chance to send the close frame before hanging up
+	select {
+	case <-w.writerDone:
+	case <-time.After(closeTimeout):
+	}
+	w.c.Close()
+	if n := w.queue.droppedCount(); n > 0 {
+		log.Printf("tenant %s: connection closed (%d messages dropped)", tenantID, n)
+		return
+	}
 	log.Printf("tenant %s: connection closed", tenantID)
 }
 
+// Close sends a normal closure after the queued messages and then closes
+// the underlying connection
 func (w *wsConn) Close() error {
-	return w.c.Close()
+	w.closeWith(closeNormal, "", false)
+	return nil
+}
+
+// goAway closes the connection with 1001 after the queued frames
+func (w *wsConn) goAway() <-chan struct{} {
+	w.closeWith(closeGoingAway, "server shutting down", false)
+	return w.writerDone
+}
+
+// closeWith queues a close frame with code and reason, discarding pending
+// messages when discard is set
+func (w *wsConn) closeWith(code int, reason string, discard bool) {
+	var payload []byte
+	if code != closeNoStatus {
+		payload = make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+	}
+	w.queue.close(&queuedFrame{opcode: opClose, payload: payload}, discard)
 }
 
 // serveWS handles WebSocket upgrade and connection registration
-func serveWS(hub *EventHub) http.HandlerFunc {
+func serveWS(hub *EventHub, auth *authenticator, opts connOptions) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tenantID := r.URL.Query().Get("tenant")
-		if tenantID == "" {
-			http.Error(w, "missing tenant", http.StatusBadRequest)
-			log.Printf("handshake failed: missing tenant")
-			return
-		}
 		if !headerContains(r.Header, "Connection", "upgrade") ||
 			!headerContains(r.Header, "Upgrade", "websocket") {
 			http.Error(w, "not websocket", http.StatusBadRequest)
-			log.Printf("tenant %s: handshake failed: not websocket", tenantID)
+			log.Printf("handshake failed: not websocket")
 			return
 		}
 		key := r.Header.Get("Sec-WebSocket-Key")
 		if key == "" {
 			http.Error(w, "missing key", http.StatusBadRequest)
-			log.Printf("tenant %s: handshake failed: missing key", tenantID)
+			log.Printf("handshake failed: missing key")
+			return
+		}
+		subs, err := subscriptionsFrom(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Printf("handshake failed: %v", err)
 			return
 		}
+		cloudEvents, err := outputFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Printf("handshake failed: %v", err)
+			return
+		}
+		if _, _, err := resumeSeqFrom(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Printf("handshake failed: %v", err)
+			return
+		}
+		if !hub.accepting() {
+			http.Error(w, errShuttingDown.msg, http.StatusServiceUnavailable)
+			log.Printf("handshake refused: server shutting down")
+			return
+		}
+		// the ticket is only redeemed once the request is a valid handshake
+		claims, err := auth.authenticateTicket(r, scopeRead)
+		if err != nil {
+			writeAuthError(w, err)
+			log.Printf("handshake failed: %v", err)
+			return
+		}
+		tenantID := claims.Tenant
 		hijacker, ok := w.(http.Hijacker)
 		if !ok {
 			http.Error(w, "cannot hijack", http.StatusInternalServerError)
@@ -153,28 +416,86 @@ func serveWS(hub *EventHub) http.HandlerFunc {
 			log.Printf("tenant %s: hijack error: %v", tenantID, err)
 			return
 		}
-		if buf.Reader.Buffered() > 0 {
-			log.Println("unexpected buffered data")
+		var pmd *deflateParams
+		if opts.Compression {
+			pmd = negotiateDeflate(r.Header, opts.CompressionContextTakeover)
 		}
 		accept := computeAcceptKey(key)
 		resp := "HTTP/1.1 101 Switching Protocols\r\n" +
 			"Upgrade: websocket\r\n" +
 			"Connection: Upgrade\r\n" +
-			"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+			"Sec-WebSocket-Accept: " + accept + "\r\n"
+		if pmd != nil {
+			resp += "Sec-WebSocket-Extensions: " + pmd.String() + "\r\n"
+		}
+		resp += "\r\n"
 		if _, err := netConn.Write([]byte(resp)); err != nil {
 			log.Printf("tenant %s: handshake write error: %v", tenantID, err)
 			netConn.Close()
 			return
 		}
 		log.Printf("tenant %s: websocket connection established", tenantID)
-		ws := newWSConn(netConn)
-		hub.registerConn(tenantID, ws)
+		ws := newWSConn(netConn, buf.Reader, opts, pmd)
+		ws.cloudEvents = cloudEvents
+		ws.queue.drops = hub.dropCounter(tenantID)
+		if err := attachConn(hub, tenantID, ws, r, subs); err != nil {
+			log.Printf("tenant %s: replay failed: %v", tenantID, err)
+			// readLoop still runs, without a message handler, to finish
+			// the closing handshake and hang up the socket
+			ws.Close()
+		} else {
+			ws.onMessage = func(opcode byte, msg []byte) error {
+				return handleClientMessage(hub, claims, ws, opcode, msg)
+			}
+		}
 		go ws.readLoop(tenantID, func() {
 			hub.unregisterConn(tenantID, ws)
 		})
 	}
 }
 
+// resumeFrom returns the last event ID the client has seen, taken from the
+// after query parameter, as in GET /events, or a Last-Event-ID header. The
+// since parameter is still read for clients written before after; unlike
+// since on GET /events it names an event, not a time.
+func resumeFrom(r *http.Request) string {
+	q := r.URL.Query()
+	if after := q.Get("after"); after != "" {
+		return after
+	}
+	if since := q.Get("since"); since != "" {
+		return since
+	}
+	return r.Header.Get("Last-Event-ID")
+}
+
+// resumeSeqFrom returns the last sequence number the client has seen, from
+// the since_seq query parameter, and whether one was given
+func resumeSeqFrom(r *http.Request) (uint64, bool, error) {
+	s := r.URL.Query().Get("since_seq")
+	if s == "" {
+		return 0, false, nil
+	}
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid since_seq %q", s)
+	}
+	return seq, true, nil
+}
+
+// attachConn registers c with subs, first replaying what the client missed
+// when r resumes by sequence number or event ID
+func attachConn(hub *EventHub, tenantID string, c Conn, r *http.Request, subs []subscription) error {
+	if seq, ok, _ := resumeSeqFrom(r); ok {
+		return hub.resumeConnSeq(tenantID, c, seq, subs...)
+	}
+	if since := resumeFrom(r); since != "" {
+		return hub.resumeConn(tenantID, c, since, subs...)
+	}
+	hub.registerConn(tenantID, c, subs...)
+	return nil
+}
+
 func computeAcceptKey(key string) string {
 	h := sha1.New()
 	h.Write([]byte(key + magicKey))
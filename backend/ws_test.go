@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"testing"
@@ -28,7 +30,7 @@ func TestWriteFrame(t *testing.T) {
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			client, server := net.Pipe()
-			ws := newWSConn(server)
+			ws := newWSConn(server, nil, defaultConnOptions(), nil)
 			go func() {
 				if err := ws.writeFrame(1, tc.payload); err != nil {
 					t.Errorf("writeFrame error: %v", err)
@@ -91,7 +93,7 @@ func sendMaskedFrame(w io.Writer, opcode byte, payload []byte) {
 
 func TestReadLoop(t *testing.T) {
 	client, server := net.Pipe()
-	ws := newWSConn(server)
+	ws := newWSConn(server, nil, defaultConnOptions(), nil)
 	closed := make(chan struct{})
 	go ws.readLoop("t1", func() { close(closed) })
 
@@ -108,3 +110,224 @@ func TestReadLoop(t *testing.T) {
 	}
 	ws.Close()
 }
+
+// readFrame reads one unmasked server frame
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint64(ext))
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(r, payload)
+	return header[0] & 0x0F, payload, err
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	opts := defaultConnOptions()
+	opts.QueueSize = 2
+	opts.SlowCloseCode = closePolicyViolation
+	ws := newWSConn(server, nil, opts, nil)
+
+	hub := newTenantHub(defaultMaxEvents)
+	hub.addConn(ws)
+
+	// nothing reads from client, so the writer stalls on the first frame
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			hub.addEvent(Event{ID: fmt.Sprintf("e%d", i), TenantID: "t1"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publishing blocked on a stalled connection")
+	}
+	hub.mu.Lock()
+	_, registered := hub.connections[ws]
+	hub.mu.Unlock()
+	if registered {
+		t.Fatalf("slow consumer should be unregistered")
+	}
+
+	var opcode byte
+	var payload []byte
+	for opcode != opClose {
+		var err error
+		if opcode, payload, err = readFrame(client); err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+	}
+	if code := binary.BigEndian.Uint16(payload); code != closePolicyViolation {
+		t.Fatalf("expected close code %d, got %d", closePolicyViolation, code)
+	}
+	if string(payload[2:]) != "slow consumer" {
+		t.Fatalf("unexpected close reason %q", payload[2:])
+	}
+}
+
+func TestResyncIsBounded(t *testing.T) {
+	hub := newTenantHub(defaultMaxEvents)
+	for i := 0; i < 5; i++ {
+		hub.addEvent(Event{ID: fmt.Sprintf("e%d", i), TenantID: "t1"})
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	opts := defaultConnOptions()
+	opts.QueueSize = 8
+	ws := newWSConn(server, nil, opts, nil)
+	hub.addConn(ws)
+	// nothing reads from client, so the first replay is never written
+	if err := hub.resyncConn(ws, 0); err != nil {
+		t.Fatalf("resyncConn: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := hub.resyncConn(ws, 0); !errors.Is(err, errResyncPending) {
+			t.Fatalf("resync %d: expected errResyncPending, got %v", i, err)
+		}
+	}
+	ws.queue.mu.Lock()
+	queued := len(ws.queue.items)
+	ws.queue.mu.Unlock()
+	if queued > 5 {
+		t.Fatalf("repeated resyncs queued %d frames", queued)
+	}
+
+	// a replay larger than the queue closes the connection
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	opts.QueueSize = 2
+	opts.SlowCloseCode = closeTryAgainLater
+	ws2 := newWSConn(server2, nil, opts, nil)
+	hub.addConn(ws2)
+	if err := hub.resyncConn(ws2, 0); !errors.Is(err, errSlowConsumer) {
+		t.Fatalf("expected errSlowConsumer, got %v", err)
+	}
+	var opcode byte
+	var payload []byte
+	for opcode != opClose {
+		var err error
+		if opcode, payload, err = readFrame(client2); err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+	}
+	if code := binary.BigEndian.Uint16(payload); code != closeTryAgainLater {
+		t.Fatalf("expected close code %d, got %d", closeTryAgainLater, code)
+	}
+}
+
+func heartbeatOptions() connOptions {
+	opts := defaultConnOptions()
+	opts.PingInterval = 50 * time.Millisecond
+	opts.PongTimeout = 50 * time.Millisecond
+	opts.WriteTimeout = 50 * time.Millisecond
+	return opts
+}
+
+func TestHeartbeatReapsSilentPeer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ws := newWSConn(server, nil, heartbeatOptions(), nil)
+	closed := make(chan struct{})
+	go ws.readLoop("t1", func() { close(closed) })
+
+	// read pings but never answer them
+	go func() {
+		for {
+			if _, _, err := readFrame(client); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection without pongs was not closed")
+	}
+}
+
+func TestHeartbeatKeepsLivePeer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ws := newWSConn(server, nil, heartbeatOptions(), nil)
+	closed := make(chan struct{})
+	go ws.readLoop("t1", func() { close(closed) })
+	defer ws.Close()
+
+	pings := make(chan struct{}, 16)
+	go func() {
+		for {
+			opcode, payload, err := readFrame(client)
+			if err != nil {
+				return
+			}
+			if opcode == opPing {
+				sendMaskedFrame(client, opPong, payload)
+				pings <- struct{}{}
+			}
+		}
+	}()
+	select {
+	case <-closed:
+		t.Fatal("responsive connection was closed")
+	case <-time.After(300 * time.Millisecond):
+	}
+	if len(pings) < 3 {
+		t.Fatalf("expected regular pings, got %d", len(pings))
+	}
+}
+
+func TestPingIsAnswered(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ws := newWSConn(server, nil, defaultConnOptions(), nil)
+	go ws.readLoop("t1", func() {})
+	defer ws.Close()
+
+	go sendMaskedFrame(client, opPing, []byte("are you there"))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	opcode, payload, err := readFrame(client)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if opcode != opPong || string(payload) != "are you there" {
+		t.Fatalf("expected pong echoing the ping, got opcode %d %q", opcode, payload)
+	}
+}
+
+func TestWriteDeadlineDropsStalledPeer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	opts := heartbeatOptions()
+	opts.PingInterval = 0
+	ws := newWSConn(server, nil, opts, nil)
+	closed := make(chan struct{})
+	go ws.readLoop("t1", func() { close(closed) })
+
+	// the peer never reads, so the write deadline must fire
+	ws.WriteJSON(Event{ID: "e1"})
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("stalled connection was not closed after the write deadline")
+	}
+}
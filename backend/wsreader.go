@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// closeError is a protocol violation by the peer; the connection is failed
+// with a close frame carrying code and reason
+type closeError struct {
+	code   int
+	reason string
+}
+
+func (e *closeError) Error() string {
+	return fmt.Sprintf("%s (close %d)", e.reason, e.code)
+}
+
+func protocolError(reason string) error {
+	return &closeError{code: closeProtocolError, reason: reason}
+}
+
+// wsFrame is one frame received from the client, already unmasked
+type wsFrame struct {
+	fin        bool
+	compressed bool
+	opcode     byte
+	payload    []byte
+}
+
+func isControl(opcode byte) bool {
+	return opcode&0x8 != 0
+}
+
+// readFrame reads and validates a single client frame. Frames longer than
+// limit are rejected before their payload is allocated.
+func (w *wsConn) readFrame(limit int) (wsFrame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(w.r, hdr[:]); err != nil {
+		return wsFrame{}, err
+	}
+	f := wsFrame{fin: hdr[0]&0x80 != 0, compressed: hdr[0]&rsv1 != 0, opcode: hdr[0] & 0x0F}
+	// RSV1 marks the first frame of a compressed message once
+	// permessage-deflate is negotiated; the other bits are never used
+	rsv := hdr[0] & 0x70
+	if f.compressed && w.inflate != nil && (f.opcode == opText || f.opcode == opBinary) {
+		rsv &^= rsv1
+	}
+	if rsv != 0 {
+		return f, protocolError("reserved bits set")
+	}
+	switch f.opcode {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return f, protocolError(fmt.Sprintf("unknown opcode %d", f.opcode))
+	}
+	if hdr[1]&0x80 == 0 {
+		return f, protocolError("unmasked client frame")
+	}
+
+	length := uint64(hdr[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(w.r, ext[:]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(w.r, ext[:]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return f, protocolError("invalid payload length")
+		}
+	}
+	if isControl(f.opcode) {
+		if !f.fin {
+			return f, protocolError("fragmented control frame")
+		}
+		if length > 125 {
+			return f, protocolError("control frame too long")
+		}
+	} else if length > uint64(limit) {
+		return f, &closeError{code: closeMessageTooBig, reason: "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(w.r, mask[:]); err != nil {
+		return f, err
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(w.r, f.payload); err != nil {
+		return f, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// readMessage returns the next complete data message, reassembling
+// continuation frames and answering pings that arrive between them.
+// A close frame is returned as a message with opcode opClose.
+func (w *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var compressed bool
+	var msg []byte
+	for {
+		f, err := w.readFrame(w.opts.MaxMessageSize - len(msg))
+		if err != nil {
+			return 0, nil, err
+		}
+		// any frame, pongs included, shows the peer is alive
+		w.extendReadDeadline()
+		switch f.opcode {
+		case opPing:
+			w.queue.pushPong(f.payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return opClose, f.payload, nil
+		case opContinuation:
+			if opcode == 0 {
+				return 0, nil, protocolError("unexpected continuation frame")
+			}
+		default:
+			if opcode != 0 {
+				return 0, nil, protocolError("expected continuation frame")
+			}
+			opcode = f.opcode
+			compressed = f.compressed
+		}
+		msg = append(msg, f.payload...)
+		if !f.fin {
+			continue
+		}
+		if compressed {
+			if msg, err = w.inflate.decompress(msg, w.opts.MaxMessageSize); err != nil {
+				return 0, nil, err
+			}
+		}
+		if opcode == opText && !utf8.Valid(msg) {
+			return 0, nil, &closeError{code: closeInvalidPayload, reason: "invalid utf-8"}
+		}
+		return opcode, msg, nil
+	}
+}
+
+// parseClose decodes a close frame payload, returning closeNoStatus when
+// the peer sent no code
+func parseClose(payload []byte) (int, string, error) {
+	if len(payload) == 0 {
+		return closeNoStatus, "", nil
+	}
+	if len(payload) == 1 {
+		return 0, "", protocolError("invalid close payload")
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	if !validCloseCode(code) {
+		return 0, "", protocolError(fmt.Sprintf("invalid close code %d", code))
+	}
+	reason := payload[2:]
+	if !utf8.Valid(reason) {
+		return 0, "", &closeError{code: closeInvalidPayload, reason: "invalid utf-8 in close reason"}
+	}
+	return code, string(reason), nil
+}
+
+// validCloseCode reports whether a peer may send code on the wire
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// writeClientFrame writes a frame with explicit FIN and mask settings
+func writeClientFrame(w io.Writer, fin bool, opcode byte, payload []byte, masked bool) {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	frame := []byte{b0}
+	l := len(payload)
+	switch {
+	case l < 126:
+		frame = append(frame, maskBit|byte(l))
+	case l <= 65535:
+		frame = append(frame, maskBit|126, byte(l>>8), byte(l))
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(l))
+		frame = append(append(frame, maskBit|127), ext...)
+	}
+	body := append([]byte(nil), payload...)
+	if masked {
+		mask := []byte{9, 8, 7, 6}
+		frame = append(frame, mask...)
+		for i := range body {
+			body[i] ^= mask[i%4]
+		}
+	}
+	w.Write(append(frame, body...))
+}
+
+func closePayload(code int, reason string) []byte {
+	p := make([]byte, 2)
+	binary.BigEndian.PutUint16(p, uint16(code))
+	return append(p, reason...)
+}
+
+// newPipeConn returns a server wsConn and the client end of its pipe; the
+// frames the server writes are delivered on the returned channel
+func newPipeConn(t *testing.T, opts connOptions) (*wsConn, net.Conn, chan wsFrame) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	ws := newWSConn(server, nil, opts, nil)
+	frames := make(chan wsFrame, 16)
+	go func() {
+		defer close(frames)
+		for {
+			opcode, payload, err := readFrame(client)
+			if err != nil {
+				return
+			}
+			frames <- wsFrame{fin: true, opcode: opcode, payload: payload}
+		}
+	}()
+	return ws, client, frames
+}
+
+func nextFrame(t *testing.T, frames chan wsFrame) wsFrame {
+	t.Helper()
+	select {
+	case f, ok := <-frames:
+		if !ok {
+			t.Fatalf("connection closed")
+		}
+		return f
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for frame")
+	}
+	return wsFrame{}
+}
+
+func TestReadMessageReassembly(t *testing.T) {
+	ws, client, frames := newPipeConn(t, defaultConnOptions())
+	go func() {
+		writeClientFrame(client, false, opText, []byte("caf"), true)
+		writeClientFrame(client, true, opPing, []byte("p"), true)
+		writeClientFrame(client, false, opContinuation, []byte{0xC3}, true)
+		writeClientFrame(client, true, opContinuation, []byte{0xA9}, true)
+	}()
+	opcode, msg, err := ws.readMessage()
+	if err != nil {
+		t.Fatalf("readMessage: %v", err)
+	}
+	if opcode != opText || string(msg) != "café" {
+		t.Fatalf("expected reassembled text, got %d %q", opcode, msg)
+	}
+	if f := nextFrame(t, frames); f.opcode != opPong || string(f.payload) != "p" {
+		t.Fatalf("expected pong for interleaved ping, got %+v", f)
+	}
+}
+
+func TestReadMessageProtocolErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		write func(c net.Conn)
+		code  int
+	}{
+		{"unmasked", func(c net.Conn) { writeClientFrame(c, true, opText, []byte("x"), false) }, closeProtocolError},
+		{"reserved bits", func(c net.Conn) { c.Write([]byte{0xC1, 0x80, 0, 0, 0, 0}) }, closeProtocolError},
+		{"unknown opcode", func(c net.Conn) { writeClientFrame(c, true, 3, nil, true) }, closeProtocolError},
+		{"fragmented control", func(c net.Conn) { writeClientFrame(c, false, opPing, nil, true) }, closeProtocolError},
+		{"long control", func(c net.Conn) { writeClientFrame(c, true, opPing, make([]byte, 126), true) }, closeProtocolError},
+		{"orphan continuation", func(c net.Conn) { writeClientFrame(c, true, opContinuation, []byte("x"), true) }, closeProtocolError},
+		{"interleaved message", func(c net.Conn) {
+			writeClientFrame(c, false, opText, []byte("a"), true)
+			writeClientFrame(c, true, opText, []byte("b"), true)
+		}, closeProtocolError},
+		{"invalid utf-8", func(c net.Conn) { writeClientFrame(c, true, opText, []byte{0xff, 0xfe}, true) }, closeInvalidPayload},
+		{"huge length", func(c net.Conn) {
+			// claims 1 TiB; must be refused from the header alone
+			c.Write([]byte{0x81, 0x80 | 127, 0, 0, 1, 0, 0, 0, 0, 0})
+		}, closeMessageTooBig},
+		{"negative length", func(c net.Conn) {
+			c.Write([]byte{0x81, 0x80 | 127, 0x80, 0, 0, 0, 0, 0, 0, 1})
+		}, closeProtocolError},
+		{"fragments too big", func(c net.Conn) {
+			writeClientFrame(c, false, opBinary, make([]byte, 60), true)
+			writeClientFrame(c, true, opContinuation, make([]byte, 60), true)
+		}, closeMessageTooBig},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := defaultConnOptions()
+			opts.MaxMessageSize = 100
+			ws, client, _ := newPipeConn(t, opts)
+			go tc.write(client)
+			_, _, err := ws.readMessage()
+			var ce *closeError
+			if !errors.As(err, &ce) || ce.code != tc.code {
+				t.Fatalf("expected close code %d, got %v", tc.code, err)
+			}
+		})
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	testCases := []struct {
+		name    string
+		payload []byte
+		expect  []byte
+	}{
+		{"echo code", closePayload(1001, "bye"), closePayload(1001, "")},
+		{"no status", nil, nil},
+		{"invalid code", closePayload(1005, ""), closePayload(closeProtocolError, "invalid close code 1005")},
+		{"one byte", []byte{3}, closePayload(closeProtocolError, "invalid close payload")},
+		{"bad reason", append(closePayload(1000, ""), 0xff), closePayload(closeInvalidPayload, "invalid utf-8 in close reason")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ws, client, frames := newPipeConn(t, defaultConnOptions())
+			closed := make(chan struct{})
+			go ws.readLoop("t1", func() { close(closed) })
+			go writeClientFrame(client, true, opClose, tc.payload, true)
+
+			f := nextFrame(t, frames)
+			if f.opcode != opClose || string(f.payload) != string(tc.expect) {
+				t.Fatalf("expected close %q, got opcode %d %q", tc.expect, f.opcode, f.payload)
+			}
+			<-closed
+			if _, ok := <-frames; ok {
+				t.Fatalf("expected connection to be closed after the handshake")
+			}
+		})
+	}
+}
+
+func TestProtocolErrorClosesWithCode(t *testing.T) {
+	ws, client, frames := newPipeConn(t, defaultConnOptions())
+	go ws.readLoop("t1", func() {})
+	go writeClientFrame(client, true, opText, []byte("x"), false)
+	f := nextFrame(t, frames)
+	if f.opcode != opClose || binary.BigEndian.Uint16(f.payload) != closeProtocolError {
+		t.Fatalf("expected close 1002, got opcode %d %q", f.opcode, f.payload)
+	}
+}
+
+func TestServerInitiatedClose(t *testing.T) {
+	ws, client, frames := newPipeConn(t, defaultConnOptions())
+	closed := make(chan struct{})
+	go ws.readLoop("t1", func() { close(closed) })
+
+	ws.Close()
+	f := nextFrame(t, frames)
+	if f.opcode != opClose || binary.BigEndian.Uint16(f.payload) != closeNormal {
+		t.Fatalf("expected close 1000, got opcode %d %q", f.opcode, f.payload)
+	}
+	start := time.Now()
+	writeClientFrame(client, true, opClose, f.payload, true)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("readLoop did not finish the handshake")
+	}
+	if time.Since(start) >= closeTimeout {
+		t.Fatalf("handshake should complete on the peer's reply, not the timeout")
+	}
+}